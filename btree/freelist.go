@@ -0,0 +1,54 @@
+package btree
+
+import (
+	"encoding/binary"
+	"toydb/constants"
+)
+
+// Free-list Trunk Page Layout
+//
+// Free pages are tracked by a chain of trunk pages. Each trunk page lists the
+// numbers of other free pages; when a trunk runs out of entries the trunk
+// page itself is handed out next.
+const (
+	FREE_TRUNK_NEXT_SIZE          = 4
+	FREE_TRUNK_NEXT_OFFSET        = COMMON_NODE_HEADER_SIZE
+	FREE_TRUNK_NUM_ENTRIES_SIZE   = 4
+	FREE_TRUNK_NUM_ENTRIES_OFFSET = FREE_TRUNK_NEXT_OFFSET + FREE_TRUNK_NEXT_SIZE
+	FREE_TRUNK_HEADER_SIZE        = COMMON_NODE_HEADER_SIZE + FREE_TRUNK_NEXT_SIZE + FREE_TRUNK_NUM_ENTRIES_SIZE
+	FREE_TRUNK_ENTRY_SIZE         = 4
+	FREE_TRUNK_MAX_ENTRIES        = (constants.PAGE_USABLE_SIZE - FREE_TRUNK_HEADER_SIZE) / FREE_TRUNK_ENTRY_SIZE
+)
+
+func FreeTrunkNext(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[FREE_TRUNK_NEXT_OFFSET:])
+}
+
+func SetFreeTrunkNext(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[FREE_TRUNK_NEXT_OFFSET:], pageNum)
+}
+
+func FreeTrunkNumEntries(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[FREE_TRUNK_NUM_ENTRIES_OFFSET:])
+}
+
+func SetFreeTrunkNumEntries(node []byte, numEntries uint32) {
+	binary.LittleEndian.PutUint32(node[FREE_TRUNK_NUM_ENTRIES_OFFSET:], numEntries)
+}
+
+func FreeTrunkEntry(node []byte, entryNum uint32) uint32 {
+	offset := FREE_TRUNK_HEADER_SIZE + entryNum*FREE_TRUNK_ENTRY_SIZE
+	return binary.LittleEndian.Uint32(node[offset:])
+}
+
+func SetFreeTrunkEntry(node []byte, entryNum uint32, pageNum uint32) {
+	offset := FREE_TRUNK_HEADER_SIZE + entryNum*FREE_TRUNK_ENTRY_SIZE
+	binary.LittleEndian.PutUint32(node[offset:], pageNum)
+}
+
+func InitializeFreeTrunk(node []byte) {
+	SetNodeType(node, NODE_FREE_TRUNK)
+	SetNodeRoot(node, false)
+	SetFreeTrunkNext(node, 0)
+	SetFreeTrunkNumEntries(node, 0)
+}
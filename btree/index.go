@@ -0,0 +1,36 @@
+package btree
+
+// Index Node Layout
+//
+// Index B-trees are laid out like table B-trees, and use the same cell
+// functions, but their keys are all there is: a leaf cell has an index key
+// and no value, and the index key ends with the key of the row it points
+// to. Internal index nodes have cells like those of table internal nodes,
+// except that their keys are only at least as large as every key under
+// their child. Index nodes do not keep parent pointers: the tree is always
+// walked down from its root, which never moves.
+const (
+	// Size of the largest index key, which leaves room for the child in
+	// the cell of an internal node
+	INDEX_MAX_KEY_SIZE = LEAF_NODE_MAX_LOCAL_SIZE - INTERNAL_NODE_CHILD_SIZE
+)
+
+func IsIndexNode(node []byte) bool {
+	nodeType := GetNodeType(node)
+	return nodeType == NODE_INDEX_LEAF || nodeType == NODE_INDEX_INTERNAL
+}
+
+// NewIndexLeafCell builds the cell of an index leaf for an index key
+func NewIndexLeafCell(key []byte) []byte {
+	return NewLeafNodeCell(key, 0, nil, 0)
+}
+
+func InitializeIndexLeafNode(node []byte) {
+	InitializeLeafNode(node)
+	SetNodeType(node, NODE_INDEX_LEAF)
+}
+
+func InitializeIndexInternalNode(node []byte) {
+	InitializeLeafNode(node)
+	SetNodeType(node, NODE_INDEX_INTERNAL)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"toydb/constants"
 	"fmt"
+	"slices"
 )
 
 // Node types
@@ -12,29 +13,25 @@ type NodeType uint8
 const (
 	NODE_INTERNAL NodeType = iota
 	NODE_LEAF
+	NODE_FREE_TRUNK
+	NODE_OVERFLOW
+	NODE_INDEX_LEAF
+	NODE_INDEX_INTERNAL
 )
 
-// Internal Node Header Layout
+// Internal Node Layout
+//
+// Internal nodes use the slotted layout of leaves and the same cell
+// functions. The key of a cell is the largest key under its child, and its
+// value is the child's page number. The right child, which has no key of
+// its own, takes the place of the next leaf pointer.
 const (
-	INTERNAL_NODE_NUM_KEYS_SIZE      = 4
-	INTERNAL_NODE_NUM_KEYS_OFFSET    = COMMON_NODE_HEADER_SIZE
-	INTERNAL_NODE_RIGHT_CHILD_SIZE   = 4
-	INTERNAL_NODE_RIGHT_CHILD_OFFSET = INTERNAL_NODE_NUM_KEYS_OFFSET + INTERNAL_NODE_NUM_KEYS_SIZE
-	INTERNAL_NODE_HEADER_SIZE        = COMMON_NODE_HEADER_SIZE + INTERNAL_NODE_NUM_KEYS_SIZE + INTERNAL_NODE_RIGHT_CHILD_SIZE
+	INTERNAL_NODE_CHILD_SIZE = 4 // size of uint32
 )
 
-// Internal Node Body Layout
+// Minimum fill of non-root nodes, below which deletes rebalance them
 const (
-	INTERNAL_NODE_KEY_SIZE   = 4
-	INTERNAL_NODE_CHILD_SIZE = 4
-	INTERNAL_NODE_CELL_SIZE  = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
-	INTERNAL_NODE_MAX_CELLS  = (constants.PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE) / INTERNAL_NODE_CELL_SIZE
-)
-
-// Split counts for leaf nodes
-const (
-	LEAF_NODE_RIGHT_SPLIT_COUNT = (LEAF_NODE_MAX_CELLS + 1) / 2
-	LEAF_NODE_LEFT_SPLIT_COUNT  = (LEAF_NODE_MAX_CELLS + 1) - LEAF_NODE_RIGHT_SPLIT_COUNT
+	LEAF_NODE_MIN_USED_SPACE = LEAF_NODE_SPACE_FOR_CELLS / 2
 )
 
 // Common Node Header Layout
@@ -54,18 +51,46 @@ const (
 	LEAF_NODE_NUM_CELLS_OFFSET         = COMMON_NODE_HEADER_SIZE
 	LEAF_NODE_NEXT_LEAF_POINTER_SIZE   = 4
 	LEAF_NODE_NEXT_LEAF_POINTER_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
-	LEAF_NODE_HEADER_SIZE              = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_POINTER_SIZE
+	LEAF_NODE_CONTENT_START_SIZE       = 2 // size of uint16
+	LEAF_NODE_CONTENT_START_OFFSET     = LEAF_NODE_NEXT_LEAF_POINTER_OFFSET + LEAF_NODE_NEXT_LEAF_POINTER_SIZE
+	LEAF_NODE_FRAGMENTED_BYTES_SIZE    = 2
+	LEAF_NODE_FRAGMENTED_BYTES_OFFSET  = LEAF_NODE_CONTENT_START_OFFSET + LEAF_NODE_CONTENT_START_SIZE
+	LEAF_NODE_HEADER_SIZE              = LEAF_NODE_FRAGMENTED_BYTES_OFFSET + LEAF_NODE_FRAGMENTED_BYTES_SIZE
 )
 
 // Leaf Node Body Layout
+//
+// The header is followed by an array of cell pointers, the page offsets of
+// the cells in key order. The cells themselves are packed from the end of
+// the usable space downwards, so the free space is the gap between the two
+// plus any bytes left behind by removed cells, which are reclaimed by
+// defragmenting the page. A cell is the sizes of its key and its value,
+// followed by the key and the value. A value too large for the cell keeps
+// only its first bytes there, followed by the number of the overflow page
+// holding the rest. Keys are compared byte by byte and are always stored
+// whole in their cell.
 const (
-	LEAF_NODE_KEY_SIZE        = 4 // size of uint32
-	LEAF_NODE_KEY_OFFSET      = 0
-	LEAF_NODE_VALUE_SIZE      = constants.ROW_SIZE
-	LEAF_NODE_VALUE_OFFSET    = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
-	LEAF_NODE_CELL_SIZE       = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
-	LEAF_NODE_SPACE_FOR_CELLS = constants.PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-	LEAF_NODE_MAX_CELLS       = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
+	LEAF_NODE_CELL_POINTER_SIZE     = 2 // size of uint16
+	LEAF_NODE_KEY_SIZE_SIZE         = 2 // size of uint16
+	LEAF_NODE_KEY_SIZE_OFFSET       = 0
+	LEAF_NODE_VALUE_SIZE_SIZE       = 4 // size of uint32
+	LEAF_NODE_VALUE_SIZE_OFFSET     = LEAF_NODE_KEY_SIZE_OFFSET + LEAF_NODE_KEY_SIZE_SIZE
+	LEAF_NODE_KEY_OFFSET            = LEAF_NODE_VALUE_SIZE_OFFSET + LEAF_NODE_VALUE_SIZE_SIZE
+	LEAF_NODE_CELL_HEADER_SIZE      = LEAF_NODE_KEY_OFFSET
+	LEAF_NODE_OVERFLOW_POINTER_SIZE = 4 // size of uint32
+	LEAF_NODE_SPACE_FOR_CELLS       = constants.PAGE_USABLE_SIZE - LEAF_NODE_HEADER_SIZE
+	LEAF_NODE_MAX_CELLS             = LEAF_NODE_SPACE_FOR_CELLS / (LEAF_NODE_CELL_HEADER_SIZE + LEAF_NODE_CELL_POINTER_SIZE)
+	// Every cell fits in a quarter of the page, so the cells of a full leaf
+	// plus one more can always be split into two leaves
+	LEAF_NODE_MAX_CELL_SIZE = LEAF_NODE_SPACE_FOR_CELLS/4 - LEAF_NODE_CELL_POINTER_SIZE
+	// A key and its value together take up to LEAF_NODE_MAX_LOCAL_SIZE
+	// bytes in their cell. When they are larger, at least
+	// LEAF_NODE_MIN_LOCAL_SIZE bytes of them stay in the cell.
+	LEAF_NODE_MAX_LOCAL_SIZE = LEAF_NODE_MAX_CELL_SIZE - LEAF_NODE_CELL_HEADER_SIZE
+	LEAF_NODE_MIN_LOCAL_SIZE = LEAF_NODE_SPACE_FOR_CELLS/8 - LEAF_NODE_CELL_HEADER_SIZE - LEAF_NODE_OVERFLOW_POINTER_SIZE
+	// Size of the largest row key, which always fits in the part of a cell
+	// that stays local
+	TABLE_MAX_KEY_SIZE = LEAF_NODE_MIN_LOCAL_SIZE
 )
 
 // Node header access functions
@@ -106,24 +131,271 @@ func SetLeafNodeNextLeaf(node []byte, pageNum uint32) {
 	binary.LittleEndian.PutUint32(node[LEAF_NODE_NEXT_LEAF_POINTER_OFFSET:], pageNum)
 }
 
+// LeafNodeContentStart returns the offset of the lowest cell in the page
+func LeafNodeContentStart(node []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(node[LEAF_NODE_CONTENT_START_OFFSET:]))
+}
+
+func setLeafNodeContentStart(node []byte, offset uint32) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_CONTENT_START_OFFSET:], uint16(offset))
+}
+
+// LeafNodeFragmentedBytes returns the bytes of removed cells that are still
+// inside the cell content area
+func LeafNodeFragmentedBytes(node []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(node[LEAF_NODE_FRAGMENTED_BYTES_OFFSET:]))
+}
+
+func setLeafNodeFragmentedBytes(node []byte, numBytes uint32) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_FRAGMENTED_BYTES_OFFSET:], uint16(numBytes))
+}
+
+func LeafNodeCellPointer(node []byte, cellNum uint32) uint32 {
+	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_POINTER_SIZE
+	return uint32(binary.LittleEndian.Uint16(node[offset:]))
+}
+
+func setLeafNodeCellPointer(node []byte, cellNum uint32, pointer uint32) {
+	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_POINTER_SIZE
+	binary.LittleEndian.PutUint16(node[offset:], uint16(pointer))
+}
+
+// LeafNodeLocalSize returns how many bytes of a key and a value of the
+// given total size are stored in their cell. When they spill, the local part
+// is chosen so that the last overflow page is as full as possible, as long
+// as the cell stays within LEAF_NODE_MAX_CELL_SIZE.
+func LeafNodeLocalSize(payloadSize uint32) uint32 {
+	if payloadSize <= LEAF_NODE_MAX_LOCAL_SIZE {
+		return payloadSize
+	}
+
+	localSize := LEAF_NODE_MIN_LOCAL_SIZE + (payloadSize-LEAF_NODE_MIN_LOCAL_SIZE)%OVERFLOW_PAGE_DATA_SIZE
+	if localSize > LEAF_NODE_MAX_LOCAL_SIZE-LEAF_NODE_OVERFLOW_POINTER_SIZE {
+		localSize = LEAF_NODE_MIN_LOCAL_SIZE
+	}
+	return localSize
+}
+
+// LeafNodeLocalValueSize returns how many bytes of a value of valueSize
+// bytes are stored in its cell along with a key of keySize bytes
+func LeafNodeLocalValueSize(keySize uint32, valueSize uint32) uint32 {
+	return LeafNodeLocalSize(keySize+valueSize) - keySize
+}
+
+// LeafNodeCellSize returns the bytes taken by a cell holding a key and a
+// value of the given sizes, not counting its cell pointer
+func LeafNodeCellSize(keySize uint32, valueSize uint32) uint32 {
+	cellSize := LEAF_NODE_CELL_HEADER_SIZE + LeafNodeLocalSize(keySize+valueSize)
+	if keySize+valueSize > LEAF_NODE_MAX_LOCAL_SIZE {
+		cellSize += LEAF_NODE_OVERFLOW_POINTER_SIZE
+	}
+	return cellSize
+}
+
+// NewLeafNodeCell builds a cell for key and a value of valueSize bytes, of
+// which localValue is the part stored in the cell and the rest starts on
+// overflowPageNum. The cell is ready to be stored with LeafNodeInsertCell or
+// SetLeafNodeCells.
+func NewLeafNodeCell(key []byte, valueSize uint32, localValue []byte, overflowPageNum uint32) []byte {
+	keySize := uint32(len(key))
+	cell := make([]byte, LeafNodeCellSize(keySize, valueSize))
+	binary.LittleEndian.PutUint16(cell[LEAF_NODE_KEY_SIZE_OFFSET:], uint16(keySize))
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_VALUE_SIZE_OFFSET:], valueSize)
+	copy(cell[LEAF_NODE_KEY_OFFSET:], key)
+	copy(cell[LEAF_NODE_KEY_OFFSET+keySize:], localValue)
+	if keySize+valueSize > LEAF_NODE_MAX_LOCAL_SIZE {
+		binary.LittleEndian.PutUint32(cell[len(cell)-LEAF_NODE_OVERFLOW_POINTER_SIZE:], overflowPageNum)
+	}
+	return cell
+}
+
+// CellKey returns the key of a cell
+func CellKey(cell []byte) []byte {
+	keySize := uint32(binary.LittleEndian.Uint16(cell[LEAF_NODE_KEY_SIZE_OFFSET:]))
+	return cell[LEAF_NODE_KEY_OFFSET : LEAF_NODE_KEY_OFFSET+keySize]
+}
+
+// cellSizes returns the sizes of the key and the value of the cell at offset
+func cellSizes(node []byte, offset uint32) (uint32, uint32) {
+	keySize := uint32(binary.LittleEndian.Uint16(node[offset+LEAF_NODE_KEY_SIZE_OFFSET:]))
+	valueSize := binary.LittleEndian.Uint32(node[offset+LEAF_NODE_VALUE_SIZE_OFFSET:])
+	return keySize, valueSize
+}
+
 func LeafNodeCell(node []byte, cellNum uint32) []byte {
-	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_SIZE
-	return node[offset : offset+LEAF_NODE_CELL_SIZE]
+	offset := LeafNodeCellPointer(node, cellNum)
+	keySize, valueSize := cellSizes(node, offset)
+	return node[offset : offset+LeafNodeCellSize(keySize, valueSize)]
 }
 
-func LeafNodeKey(node []byte, cellNum uint32) uint32 {
+// LeafNodeKey returns the key of a cell. It is part of the page, so it must
+// be copied to be kept after the page is unpinned or changed.
+func LeafNodeKey(node []byte, cellNum uint32) []byte {
+	return CellKey(LeafNodeCell(node, cellNum))
+}
+
+// LeafNodeValueSize returns the size of the whole value of a cell,
+// including any part of it on overflow pages
+func LeafNodeValueSize(node []byte, cellNum uint32) uint32 {
 	cell := LeafNodeCell(node, cellNum)
-	return binary.LittleEndian.Uint32(cell[LEAF_NODE_KEY_OFFSET:])
+	return binary.LittleEndian.Uint32(cell[LEAF_NODE_VALUE_SIZE_OFFSET:])
 }
 
-func SetLeafNodeKey(node []byte, cellNum uint32, key uint32) {
+// LeafNodeLocalValue returns the part of a cell's value stored in the cell
+func LeafNodeLocalValue(node []byte, cellNum uint32) []byte {
 	cell := LeafNodeCell(node, cellNum)
-	binary.LittleEndian.PutUint32(cell[LEAF_NODE_KEY_OFFSET:], key)
+	keySize := uint32(len(CellKey(cell)))
+	start := LEAF_NODE_KEY_OFFSET + keySize
+	return cell[start : start+LeafNodeLocalValueSize(keySize, LeafNodeValueSize(node, cellNum))]
 }
 
-func LeafNodeValue(node []byte, cellNum uint32) []byte {
+// LeafNodeOverflowPage returns the first overflow page of a cell's value,
+// or 0 if the value is stored whole in the cell
+func LeafNodeOverflowPage(node []byte, cellNum uint32) uint32 {
 	cell := LeafNodeCell(node, cellNum)
-	return cell[LEAF_NODE_VALUE_OFFSET : LEAF_NODE_VALUE_OFFSET+LEAF_NODE_VALUE_SIZE]
+	if uint32(len(CellKey(cell)))+LeafNodeValueSize(node, cellNum) <= LEAF_NODE_MAX_LOCAL_SIZE {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(cell[len(cell)-LEAF_NODE_OVERFLOW_POINTER_SIZE:])
+}
+
+// LeafNodeFreeSpace returns the bytes available for new cells and their
+// pointers, counting fragmented bytes that defragmenting would reclaim
+func LeafNodeFreeSpace(node []byte) uint32 {
+	pointersEnd := LEAF_NODE_HEADER_SIZE + LeafNodeNumCells(node)*LEAF_NODE_CELL_POINTER_SIZE
+	return LeafNodeContentStart(node) - pointersEnd + LeafNodeFragmentedBytes(node)
+}
+
+// LeafNodeUsedSpace returns the bytes taken by cells and their pointers
+func LeafNodeUsedSpace(node []byte) uint32 {
+	return LEAF_NODE_SPACE_FOR_CELLS - LeafNodeFreeSpace(node)
+}
+
+// LeafNodeInsertCell inserts a cell at cellNum, shifting the cells after it
+// right. It returns false, leaving the node unchanged, if the cell does not
+// fit.
+func LeafNodeInsertCell(node []byte, cellNum uint32, cell []byte) bool {
+	cellSize := uint32(len(cell))
+	if cellSize+LEAF_NODE_CELL_POINTER_SIZE > LeafNodeFreeSpace(node) {
+		return false
+	}
+
+	numCells := LeafNodeNumCells(node)
+	pointersEnd := LEAF_NODE_HEADER_SIZE + (numCells+1)*LEAF_NODE_CELL_POINTER_SIZE
+	if LeafNodeContentStart(node) < pointersEnd+cellSize {
+		LeafNodeDefragment(node)
+	}
+
+	offset := LeafNodeContentStart(node) - cellSize
+	copy(node[offset:], cell)
+	setLeafNodeContentStart(node, offset)
+
+	for i := numCells; i > cellNum; i-- {
+		setLeafNodeCellPointer(node, i, LeafNodeCellPointer(node, i-1))
+	}
+	setLeafNodeCellPointer(node, cellNum, offset)
+	SetLeafNodeNumCells(node, numCells+1)
+
+	return true
+}
+
+// LeafNodeRemoveCell removes a cell and shifts the cells after it left
+func LeafNodeRemoveCell(node []byte, cellNum uint32) {
+	offset := LeafNodeCellPointer(node, cellNum)
+	cellSize := uint32(len(LeafNodeCell(node, cellNum)))
+
+	if offset == LeafNodeContentStart(node) {
+		setLeafNodeContentStart(node, offset+cellSize)
+	} else {
+		setLeafNodeFragmentedBytes(node, LeafNodeFragmentedBytes(node)+cellSize)
+	}
+
+	numCells := LeafNodeNumCells(node)
+	for i := cellNum; i+1 < numCells; i++ {
+		setLeafNodeCellPointer(node, i, LeafNodeCellPointer(node, i+1))
+	}
+	SetLeafNodeNumCells(node, numCells-1)
+}
+
+// LeafNodeDefragment packs the cells against the end of the page so that
+// all of the free space is in one piece
+func LeafNodeDefragment(node []byte) {
+	SetLeafNodeCells(node, LeafNodeCells(node))
+}
+
+// LeafNodeCells returns copies of the cells of a leaf node in key order
+func LeafNodeCells(node []byte) [][]byte {
+	var cells [][]byte
+	for i := uint32(0); i < LeafNodeNumCells(node); i++ {
+		cells = append(cells, slices.Clone(LeafNodeCell(node, i)))
+	}
+	return cells
+}
+
+// SetLeafNodeCells replaces the cells of a leaf node, which must all fit
+func SetLeafNodeCells(node []byte, cells [][]byte) {
+	offset := uint32(constants.PAGE_USABLE_SIZE)
+	for i, cell := range cells {
+		offset -= uint32(len(cell))
+		copy(node[offset:], cell)
+		setLeafNodeCellPointer(node, uint32(i), offset)
+	}
+
+	SetLeafNodeNumCells(node, uint32(len(cells)))
+	setLeafNodeContentStart(node, offset)
+	setLeafNodeFragmentedBytes(node, 0)
+}
+
+// ValidateLeafNode checks that the cell pointers and free space accounting
+// of a leaf node describe cells that lie inside the page without
+// overlapping, so that its cells can be read safely
+func ValidateLeafNode(node []byte) error {
+	numCells := LeafNodeNumCells(node)
+	if numCells > LEAF_NODE_MAX_CELLS {
+		return fmt.Errorf("claims %d cells, more than the %d that fit", numCells, LEAF_NODE_MAX_CELLS)
+	}
+
+	pointersEnd := LEAF_NODE_HEADER_SIZE + numCells*LEAF_NODE_CELL_POINTER_SIZE
+	contentStart := LeafNodeContentStart(node)
+	if contentStart < pointersEnd || contentStart > constants.PAGE_USABLE_SIZE {
+		return fmt.Errorf("has cell content starting at offset %d, outside %d to %d", contentStart, pointersEnd, constants.PAGE_USABLE_SIZE)
+	}
+
+	type extent struct{ start, end uint32 }
+	var extents []extent
+	for i := uint32(0); i < numCells; i++ {
+		offset := LeafNodeCellPointer(node, i)
+		if offset < contentStart || offset+LEAF_NODE_CELL_HEADER_SIZE > constants.PAGE_USABLE_SIZE {
+			return fmt.Errorf("has cell %d at offset %d, outside the cell content area", i, offset)
+		}
+
+		keySize, valueSize := cellSizes(node, offset)
+		if keySize > LeafNodeLocalSize(keySize+valueSize) {
+			return fmt.Errorf("has cell %d with a key of %d bytes, too large to stay in the cell", i, keySize)
+		}
+
+		end := offset + LeafNodeCellSize(keySize, valueSize)
+		if end > constants.PAGE_USABLE_SIZE {
+			return fmt.Errorf("has cell %d running past the end of the page", i)
+		}
+		extents = append(extents, extent{offset, end})
+	}
+
+	slices.SortFunc(extents, func(a, b extent) int { return int(a.start) - int(b.start) })
+	usedBytes := uint32(0)
+	for i, e := range extents {
+		if i > 0 && e.start < extents[i-1].end {
+			return fmt.Errorf("has overlapping cells at offsets %d and %d", extents[i-1].start, e.start)
+		}
+		usedBytes += e.end - e.start
+	}
+
+	if contentStart+usedBytes+LeafNodeFragmentedBytes(node) != constants.PAGE_USABLE_SIZE {
+		return fmt.Errorf("has %d bytes of cells and %d fragmented bytes, which do not fill the content area from offset %d", usedBytes, LeafNodeFragmentedBytes(node), contentStart)
+	}
+
+	return nil
 }
 
 func InitializeLeafNode(node []byte) {
@@ -131,29 +403,36 @@ func InitializeLeafNode(node []byte) {
 	SetNodeRoot(node, false)
 	SetLeafNodeNumCells(node, 0)
 	SetLeafNodeNextLeaf(node, 0) // 0 represents no sibling
+	setLeafNodeContentStart(node, constants.PAGE_USABLE_SIZE)
+	setLeafNodeFragmentedBytes(node, 0)
 }
 
-func InternalNodeNumKeys(node []byte) uint32 {
-	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:])
+// NewInternalNodeCell builds the cell of an internal node for a child and
+// the largest key under it
+func NewInternalNodeCell(key []byte, child uint32) []byte {
+	value := binary.LittleEndian.AppendUint32(nil, child)
+	return NewLeafNodeCell(key, INTERNAL_NODE_CHILD_SIZE, value, 0)
 }
 
-func SetInternalNodeNumKeys(node []byte, numKeys uint32) {
-	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:], numKeys)
+// InternalCellChild returns the child of a cell built by NewInternalNodeCell
+func InternalCellChild(cell []byte) uint32 {
+	return binary.LittleEndian.Uint32(cell[LEAF_NODE_KEY_OFFSET+len(CellKey(cell)):])
 }
 
-func InternalNodeRightChild(node []byte) uint32 {
-	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:])
+func InternalNodeNumKeys(node []byte) uint32 {
+	return LeafNodeNumCells(node)
 }
 
-func SetInternalNodeRightChild(node []byte, pageNum uint32) {
-	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:], pageNum)
+func InternalNodeRightChild(node []byte) uint32 {
+	return LeafNodeNextLeaf(node)
 }
 
-func InternalNodeCell(node []byte, cellNum uint32) []byte {
-	offset := INTERNAL_NODE_HEADER_SIZE + cellNum*INTERNAL_NODE_CELL_SIZE
-	return node[offset : offset+INTERNAL_NODE_CELL_SIZE]
+func SetInternalNodeRightChild(node []byte, pageNum uint32) {
+	SetLeafNodeNextLeaf(node, pageNum)
 }
 
+// InternalNodeChild returns a child of an internal node. Child numKeys is
+// the right child.
 func InternalNodeChild(node []byte, childNum uint32) uint32 {
 	numKeys := InternalNodeNumKeys(node)
 
@@ -162,8 +441,7 @@ func InternalNodeChild(node []byte, childNum uint32) uint32 {
 	} else if childNum == numKeys {
 		return InternalNodeRightChild(node)
 	} else {
-		cell := InternalNodeCell(node, childNum)
-		return binary.LittleEndian.Uint32(cell)
+		return InternalCellChild(LeafNodeCell(node, childNum))
 	}
 }
 
@@ -174,23 +452,17 @@ func SetInternalNodeChild(node []byte, childNum uint32, child uint32) {
 	} else if childNum == numKeys {
 		SetInternalNodeRightChild(node, child)
 	} else {
-		cell := InternalNodeCell(node, childNum)
-		binary.LittleEndian.PutUint32(cell, child)
+		binary.LittleEndian.PutUint32(LeafNodeLocalValue(node, childNum), child)
 	}
 }
 
-func InternalNodeKey(node []byte, keyNum uint32) uint32 {
-	cell := InternalNodeCell(node, keyNum)
-	return binary.LittleEndian.Uint32(cell[INTERNAL_NODE_CHILD_SIZE:])
-}
-
-func SetInternalNodeKey(node []byte, keyNum uint32, key uint32) {
-	cell := InternalNodeCell(node, keyNum)
-	binary.LittleEndian.PutUint32(cell[INTERNAL_NODE_CHILD_SIZE:], key)
+// InternalNodeKey returns the largest key under a child of an internal
+// node. Like LeafNodeKey, it is part of the page.
+func InternalNodeKey(node []byte, keyNum uint32) []byte {
+	return LeafNodeKey(node, keyNum)
 }
 
 func InitializeInternalNode(node []byte) {
+	InitializeLeafNode(node)
 	SetNodeType(node, NODE_INTERNAL)
-	SetNodeRoot(node, false)
-	SetInternalNodeNumKeys(node, 0)
 }
@@ -0,0 +1,49 @@
+package btree
+
+import (
+	"encoding/binary"
+	"toydb/constants"
+)
+
+// Overflow Page Layout
+//
+// The part of a value that does not fit in its leaf cell is stored in a
+// chain of overflow pages. Each page holds the number of the next page in
+// the chain, 0 on the last one, followed by as many bytes of the value as
+// fit.
+const (
+	OVERFLOW_PAGE_NEXT_SIZE   = 4
+	OVERFLOW_PAGE_NEXT_OFFSET = COMMON_NODE_HEADER_SIZE
+	OVERFLOW_PAGE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + OVERFLOW_PAGE_NEXT_SIZE
+	OVERFLOW_PAGE_DATA_SIZE   = constants.PAGE_USABLE_SIZE - OVERFLOW_PAGE_HEADER_SIZE
+)
+
+func OverflowPageNext(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[OVERFLOW_PAGE_NEXT_OFFSET:])
+}
+
+func SetOverflowPageNext(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[OVERFLOW_PAGE_NEXT_OFFSET:], pageNum)
+}
+
+// OverflowPageData returns the part of the page that holds value bytes
+func OverflowPageData(node []byte) []byte {
+	return node[OVERFLOW_PAGE_HEADER_SIZE:constants.PAGE_USABLE_SIZE]
+}
+
+// OverflowPageCount returns how many overflow pages a value of the given
+// size needs when stored with a key of keySize bytes
+func OverflowPageCount(keySize uint32, valueSize uint32) uint32 {
+	spilled := keySize + valueSize - LeafNodeLocalSize(keySize+valueSize)
+	count := spilled / OVERFLOW_PAGE_DATA_SIZE
+	if spilled%OVERFLOW_PAGE_DATA_SIZE != 0 {
+		count++
+	}
+	return count
+}
+
+func InitializeOverflowPage(node []byte) {
+	SetNodeType(node, NODE_OVERFLOW)
+	SetNodeRoot(node, false)
+	SetOverflowPageNext(node, 0)
+}
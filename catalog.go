@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"toydb/btree"
+	"toydb/constants"
+	"toydb/header"
+	"toydb/record"
+)
+
+// The catalog is a table like any other, with one row per table or index
+// holding its name, the page its B-tree is rooted at and the statement that
+// created it. Its own root page is kept in the file header.
+const (
+	CATALOG_TABLE_NAME = "toydb_master"
+	DEFAULT_TABLE_NAME = "users" // Table used by statements that name none
+)
+
+// Columns of the catalog
+const (
+	CATALOG_TYPE_COLUMN      = 1 // "table" or "index"
+	CATALOG_NAME_COLUMN      = 2
+	CATALOG_ROOT_PAGE_COLUMN = 3
+	CATALOG_SQL_COLUMN       = 4
+)
+
+func catalogSchema() *record.Schema {
+	return &record.Schema{
+		TableName: CATALOG_TABLE_NAME,
+		Columns: []record.Column{
+			{Name: "id", Type: record.COLUMN_INTEGER},
+			{Name: "type", Type: record.COLUMN_TEXT},
+			{Name: "name", Type: record.COLUMN_TEXT},
+			{Name: "root_page", Type: record.COLUMN_INTEGER},
+			{Name: "sql", Type: record.COLUMN_TEXT},
+		},
+		PrimaryKey: []int{0},
+	}
+}
+
+// defaultSchema is the users table that every new database starts with
+func defaultSchema() *record.Schema {
+	return &record.Schema{
+		TableName: DEFAULT_TABLE_NAME,
+		Columns: []record.Column{
+			{Name: "id", Type: record.COLUMN_INTEGER},
+			{Name: "username", Type: record.COLUMN_TEXT, MaxLength: constants.COLUMN_USERNAME_SIZE},
+			{Name: "email", Type: record.COLUMN_TEXT, MaxLength: constants.COLUMN_EMAIL_SIZE},
+		},
+		PrimaryKey: []int{0},
+	}
+}
+
+// catalogRow builds the catalog row that describes a table or an index
+func catalogRow(key uint32, kind string, name string, rootPageNum uint32, sql string) *Row {
+	return &Row{
+		Key: integerKey(int64(key)),
+		Values: []record.Value{
+			int64(key),
+			kind,
+			name,
+			int64(rootPageNum),
+			sql,
+		},
+	}
+}
+
+// catalogKey returns the key of a row of the catalog as a number
+func catalogKey(row *Row) uint32 {
+	id, _ := row.Values[0].(int64)
+	return uint32(id)
+}
+
+// loadCatalog reads the catalog root from the header and every table and
+// index from the catalog, replacing whatever tables were loaded before
+func loadCatalog(db *Database) error {
+	headerPage, err := db.Pager.getPage(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	db.Catalog.RootPageNum = header.RootPage(headerPage)
+	db.Pager.unpinPage(header.HEADER_PAGE_NUM)
+
+	db.Tables = make(map[string]*Table)
+
+	cursor, err := tableStart(db.Catalog)
+	if err != nil {
+		return err
+	}
+
+	// Indexes are added to their tables once every table is loaded
+	var indexRows []*Row
+	for !cursor.EndOfTable {
+		row, err := cursorRow(cursor)
+		if err != nil {
+			return err
+		}
+
+		if kind, _ := row.Values[CATALOG_TYPE_COLUMN].(string); kind == "index" {
+			indexRows = append(indexRows, row)
+		} else {
+			table, err := catalogTable(db, row)
+			if err != nil {
+				return err
+			}
+			db.Tables[table.Schema.TableName] = table
+		}
+
+		err = cursorAdvance(cursor)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, row := range indexRows {
+		err = catalogIndex(db, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// catalogTable checks a catalog row and returns the table it describes
+func catalogTable(db *Database, row *Row) (*Table, error) {
+	kind, _ := row.Values[CATALOG_TYPE_COLUMN].(string)
+	name, _ := row.Values[CATALOG_NAME_COLUMN].(string)
+	rootPageNum, _ := row.Values[CATALOG_ROOT_PAGE_COLUMN].(int64)
+	sql, _ := row.Values[CATALOG_SQL_COLUMN].(string)
+
+	if kind != "table" {
+		return nil, fmt.Errorf("Catalog entry %d has unknown type %q", catalogKey(row), kind)
+	}
+
+	schema, result := parseCreateTable(sql)
+	if result != PREPARE_SUCCESS || schema.TableName != name {
+		return nil, fmt.Errorf("Catalog entry %d holds an invalid table definition: %s", catalogKey(row), sql)
+	}
+
+	if rootPageNum <= header.HEADER_PAGE_NUM || rootPageNum >= int64(db.Pager.NumPages) {
+		return nil, fmt.Errorf("Table %s has root page %d outside the file", name, rootPageNum)
+	}
+
+	if _, exists := db.Tables[name]; exists {
+		return nil, fmt.Errorf("Catalog lists table %s more than once", name)
+	}
+
+	table := &Table{
+		RootPageNum: uint32(rootPageNum),
+		Pager:       db.Pager,
+		Schema:      schema,
+		Catalog:     db.Catalog,
+		CatalogKey:  catalogKey(row),
+	}
+
+	return table, nil
+}
+
+// nextCatalogKey returns the key for a new row in the catalog
+func nextCatalogKey(db *Database) (uint32, error) {
+	last, err := endRow(db.Catalog, true)
+	if err != nil {
+		return 0, err
+	}
+
+	if last == nil {
+		return 1, nil
+	}
+	return catalogKey(last) + 1, nil
+}
+
+// catalogIndex checks a catalog row describing an index and adds the index
+// to its table
+func catalogIndex(db *Database, row *Row) error {
+	name, _ := row.Values[CATALOG_NAME_COLUMN].(string)
+	rootPageNum, _ := row.Values[CATALOG_ROOT_PAGE_COLUMN].(int64)
+	sql, _ := row.Values[CATALOG_SQL_COLUMN].(string)
+
+	statement, result := parseCreateIndex(sql, db)
+	if result != PREPARE_SUCCESS || statement.IndexToCreate.Name != name {
+		return fmt.Errorf("Catalog entry %d holds an invalid index definition: %s", catalogKey(row), sql)
+	}
+
+	if rootPageNum <= header.HEADER_PAGE_NUM || rootPageNum >= int64(db.Pager.NumPages) {
+		return fmt.Errorf("Index %s has root page %d outside the file", name, rootPageNum)
+	}
+
+	if findIndex(db, name) != nil {
+		return fmt.Errorf("Catalog lists index %s more than once", name)
+	}
+
+	index := statement.IndexToCreate
+	index.RootPageNum = uint32(rootPageNum)
+	index.CatalogKey = catalogKey(row)
+
+	table := db.Tables[statement.TableName]
+	table.Indexes = append(table.Indexes, index)
+	return nil
+}
+
+// createTable gives a new table an empty root leaf and adds it to the
+// catalog, along with a unique index for each of its unique columns
+func createTable(db *Database, schema *record.Schema) error {
+	key, err := nextCatalogKey(db)
+	if err != nil {
+		return err
+	}
+
+	rootPageNum, err := getUnusedPageNum(db.Pager)
+	if err != nil {
+		return err
+	}
+
+	root, err := db.Pager.getPageForWrite(rootPageNum)
+	if err != nil {
+		return err
+	}
+	btree.InitializeLeafNode(root)
+	btree.SetNodeRoot(root, true)
+	db.Pager.unpinPage(rootPageNum)
+
+	result, err := insertRow(db.Catalog, catalogRow(key, "table", schema.TableName, rootPageNum, schema.SQL()))
+	if err != nil {
+		return err
+	}
+	if result != EXECUTE_SUCCESS {
+		return fmt.Errorf("Catalog already has an entry %d", key)
+	}
+
+	table := &Table{
+		RootPageNum: rootPageNum,
+		Pager:       db.Pager,
+		Schema:      schema,
+		Catalog:     db.Catalog,
+		CatalogKey:  key,
+	}
+	db.Tables[schema.TableName] = table
+
+	for i, column := range schema.Columns {
+		if !column.Unique {
+			continue
+		}
+
+		err = createIndex(db, table, &Index{Name: autoIndexName(schema, i), Column: i, Unique: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setCatalogRootPage rewrites the root page recorded in a table's catalog row
+func setCatalogRootPage(table *Table, pageNum uint32) error {
+	update := &Row{Key: integerKey(int64(table.CatalogKey)), Values: make([]record.Value, len(table.Catalog.Schema.Columns))}
+	update.Values[CATALOG_ROOT_PAGE_COLUMN] = int64(pageNum)
+
+	result, err := updateRow(table.Catalog, update, []int{CATALOG_ROOT_PAGE_COLUMN})
+	if err != nil {
+		return err
+	}
+	if result != EXECUTE_SUCCESS {
+		return fmt.Errorf("Cannot record root page %d of table %s in the catalog", pageNum, table.Schema.TableName)
+	}
+
+	return nil
+}
+
+// tableNames returns the names of the tables in the catalog, sorted
+func tableNames(db *Database) []string {
+	names := make([]string, 0, len(db.Tables))
+	for name := range db.Tables {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"toydb/btree"
+	"toydb/header"
+)
+
+// integrityCheck collects what checkIntegrity learns while it walks the file
+type integrityCheck struct {
+	pager      *Pager
+	problems   []string
+	references map[uint32]string // What each page was reached from
+	leaves     []uint32          // Leaf pages of the current tree in key order
+	nextLeaf   map[uint32]uint32 // Next-leaf pointer of each leaf
+	leafDepth  int               // Depth of the first leaf found, -1 before that
+	indexKeys  [][]byte          // Keys in the leaves of the current index in order
+}
+
+// overflowChain is the overflow chain of the value of one leaf cell
+type overflowChain struct {
+	key      []byte
+	first    uint32 // First page of the chain
+	numPages uint32 // Pages the value's size calls for
+}
+
+// checkIntegrity walks the B-tree of the catalog and of every table and
+// index in it, and the free list from the header, and returns a description
+// of every problem it finds. An empty result means the file is consistent.
+func checkIntegrity(db *Database) ([]string, error) {
+	c := &integrityCheck{
+		pager:      db.Pager,
+		references: map[uint32]string{header.HEADER_PAGE_NUM: "the header"},
+		nextLeaf:   make(map[uint32]uint32),
+	}
+
+	headerPage, err := c.pager.getPage(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return nil, err
+	}
+	freeListHead := header.FreeListHead(headerPage)
+	if header.PageCount(headerPage) != c.pager.NumPages {
+		c.report("Header says %d pages but the file has %d", header.PageCount(headerPage), c.pager.NumPages)
+	}
+	c.pager.unpinPage(header.HEADER_PAGE_NUM)
+
+	c.checkTree(db.Catalog.RootPageNum, "the header as the catalog root")
+	for _, name := range tableNames(db) {
+		c.checkTree(db.Tables[name].RootPageNum, fmt.Sprintf("the catalog as the root of %s", name))
+	}
+	for _, name := range tableNames(db) {
+		for _, index := range db.Tables[name].Indexes {
+			c.checkIndex(db.Tables[name], index)
+		}
+	}
+	c.checkFreeList(freeListHead)
+
+	for pageNum := uint32(0); pageNum < c.pager.NumPages; pageNum++ {
+		if _, ok := c.references[pageNum]; !ok {
+			c.report("Page %d is leaked: it is neither in the tree nor on the free list", pageNum)
+		}
+	}
+
+	return c.problems, nil
+}
+
+func (c *integrityCheck) report(format string, args ...any) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// claim records that a page was reached from owner. It returns false if the
+// page does not exist or was already reached some other way, in which case
+// the caller must not descend into it again.
+func (c *integrityCheck) claim(pageNum uint32, owner string) bool {
+	if pageNum >= c.pager.NumPages {
+		c.report("Page %d, referenced from %s, is past the end of the file", pageNum, owner)
+		return false
+	}
+
+	if previous, ok := c.references[pageNum]; ok {
+		c.report("Page %d is referenced from both %s and %s", pageNum, previous, owner)
+		return false
+	}
+
+	c.references[pageNum] = owner
+	return true
+}
+
+// checkTree checks the B-tree rooted at rootPageNum and its leaf chain
+func (c *integrityCheck) checkTree(rootPageNum uint32, owner string) {
+	c.leaves = nil
+	c.leafDepth = -1
+
+	if c.claim(rootPageNum, owner) {
+		c.checkNode(rootPageNum, 0, true, nil, nil, 0)
+	}
+	c.checkLeafChain()
+}
+
+// checkNode checks the subtree rooted at pageNum, whose keys must all be
+// greater than low and at most high, where nil bounds are open. It returns
+// the largest key in the subtree, which is what getNodeMaxKey reports for a
+// well-formed node, and whether the subtree has any keys at all.
+func (c *integrityCheck) checkNode(pageNum uint32, parentPageNum uint32, isRoot bool, low []byte, high []byte, depth int) ([]byte, bool) {
+	node, err := c.pager.getPage(pageNum)
+	if err != nil {
+		c.report("Page %d cannot be read: %v", pageNum, err)
+		return nil, false
+	}
+
+	nodeType := btree.GetNodeType(node)
+	nodeIsRoot := btree.IsNodeRoot(node)
+	parent := nodeParent(node)
+
+	var keys [][]byte
+	var children []uint32
+	var chains []overflowChain
+	if nodeType == btree.NODE_LEAF || nodeType == btree.NODE_INTERNAL {
+		numCells := btree.LeafNodeNumCells(node)
+		err := btree.ValidateLeafNode(node)
+		if err != nil {
+			c.report("Page %d %v", pageNum, err)
+			numCells = 0
+		}
+		for i := uint32(0); i < numCells; i++ {
+			key := slices.Clone(btree.LeafNodeKey(node, i))
+			keys = append(keys, key)
+			if len(key) > btree.TABLE_MAX_KEY_SIZE {
+				c.report("Page %d has a key of %d bytes, more than the %d allowed", pageNum, len(key), btree.TABLE_MAX_KEY_SIZE)
+			}
+
+			valueSize := btree.LeafNodeValueSize(node, i)
+			if nodeType == btree.NODE_INTERNAL {
+				if valueSize != btree.INTERNAL_NODE_CHILD_SIZE {
+					c.report("Internal page %d has a cell of %d bytes for key %s, which is not a child page number", pageNum, valueSize, formatKey(key))
+					keys, children = nil, nil
+					break
+				}
+				children = append(children, btree.InternalNodeChild(node, i))
+			} else if uint32(len(key))+valueSize > btree.LEAF_NODE_MAX_LOCAL_SIZE {
+				chains = append(chains, overflowChain{
+					key:      key,
+					first:    btree.LeafNodeOverflowPage(node, i),
+					numPages: btree.OverflowPageCount(uint32(len(key)), valueSize),
+				})
+			}
+		}
+		if nodeType == btree.NODE_INTERNAL {
+			children = append(children, btree.InternalNodeRightChild(node))
+		} else {
+			c.nextLeaf[pageNum] = btree.LeafNodeNextLeaf(node)
+		}
+	}
+	c.pager.unpinPage(pageNum)
+
+	if nodeType != btree.NODE_LEAF && nodeType != btree.NODE_INTERNAL {
+		c.report("Page %d is in the tree but has node type %d", pageNum, nodeType)
+		return nil, false
+	}
+
+	if nodeIsRoot != isRoot {
+		c.report("Page %d has its root flag set to %t, expected %t", pageNum, nodeIsRoot, isRoot)
+	}
+	if !isRoot && parent != parentPageNum {
+		c.report("Page %d points to parent %d, but is a child of page %d", pageNum, parent, parentPageNum)
+	}
+
+	for i, key := range keys {
+		if i > 0 && bytes.Compare(key, keys[i-1]) <= 0 {
+			c.report("Page %d has key %s after key %s, keys must be strictly increasing", pageNum, formatKey(key), formatKey(keys[i-1]))
+		}
+		if (low != nil && bytes.Compare(key, low) <= 0) || (high != nil && bytes.Compare(key, high) > 0) {
+			c.report("Page %d has key %s outside the range %s allowed by its parent", pageNum, formatKey(key), formatBounds(low, high))
+		}
+	}
+
+	if nodeType == btree.NODE_LEAF {
+		if c.leafDepth == -1 {
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.report("Leaf page %d is at depth %d, but other leaves are at depth %d", pageNum, depth, c.leafDepth)
+		}
+		c.leaves = append(c.leaves, pageNum)
+
+		for _, chain := range chains {
+			c.checkOverflowChain(pageNum, chain)
+		}
+
+		if len(keys) == 0 {
+			if !isRoot {
+				c.report("Leaf page %d is empty", pageNum)
+			}
+			return nil, false
+		}
+		return keys[len(keys)-1], true
+	}
+
+	if len(keys) == 0 {
+		c.report("Internal page %d has no keys", pageNum)
+	}
+
+	var maxKey []byte
+	var hasKeys bool
+	childLow := low
+	for i, child := range children {
+		childHigh := high
+		if i < len(keys) {
+			childHigh = keys[i]
+		}
+
+		checked := c.claim(child, fmt.Sprintf("page %d", pageNum))
+		if checked {
+			maxKey, hasKeys = c.checkNode(child, pageNum, false, childLow, childHigh, depth+1)
+		} else {
+			maxKey, hasKeys = nil, false
+		}
+
+		if i == len(keys) {
+			// The right child has no separator of its own
+			break
+		}
+
+		if checked && !hasKeys {
+			c.report("Page %d has separator key %s for child %d, which has no keys", pageNum, formatKey(keys[i]), child)
+		} else if checked && !bytes.Equal(maxKey, keys[i]) {
+			c.report("Page %d has separator key %s for child %d, whose largest key is %s", pageNum, formatKey(keys[i]), child, formatKey(maxKey))
+		}
+
+		childLow = keys[i]
+	}
+
+	return maxKey, hasKeys
+}
+
+// formatBounds describes the keys greater than low and at most high, where
+// nil bounds are open
+func formatBounds(low []byte, high []byte) string {
+	switch {
+	case low == nil:
+		return "up to " + formatKey(high)
+	case high == nil:
+		return "above " + formatKey(low)
+	default:
+		return "above " + formatKey(low) + " up to " + formatKey(high)
+	}
+}
+
+// checkIndex checks the B-tree of an index and its leaf chain, and that it
+// holds exactly the index keys of the rows of its table
+func (c *integrityCheck) checkIndex(table *Table, index *Index) {
+	c.leaves = nil
+	c.leafDepth = -1
+	c.indexKeys = nil
+
+	if c.claim(index.RootPageNum, fmt.Sprintf("the catalog as the root of index %s", index.Name)) {
+		c.checkIndexNode(index.RootPageNum, true, nil, nil, 0)
+	}
+	c.checkLeafChain()
+
+	var rowKeys []string
+	expected := make(map[string]bool)
+	err := scanRows(table, KeyRange{}, nil, false, func(row *Row) bool {
+		key, err := indexKey(index, row)
+		if err != nil {
+			c.report("Row %s of %s cannot be indexed: %v", formatKey(row.Key), table.Schema.TableName, err)
+			return true
+		}
+		rowKeys = append(rowKeys, string(key))
+		expected[string(key)] = true
+		return true
+	})
+	if err != nil {
+		c.report("Table %s cannot be read to check index %s: %v", table.Schema.TableName, index.Name, err)
+		return
+	}
+
+	for i, key := range c.indexKeys {
+		if index.Unique && i > 0 && sameIndexedValue(c.indexKeys[i-1], key) {
+			c.report("Unique index %s has rows %s and %s with the same value", index.Name, formatKey(indexKeyRow(c.indexKeys[i-1])), formatKey(indexKeyRow(key)))
+		}
+
+		if expected[string(key)] {
+			delete(expected, string(key))
+		} else {
+			c.report("Index %s has an entry for row %s that does not match the row", index.Name, formatKey(indexKeyRow(key)))
+		}
+	}
+	for _, key := range rowKeys {
+		if expected[key] {
+			c.report("Index %s has no entry for row %s", index.Name, formatKey(indexKeyRow([]byte(key))))
+		}
+	}
+}
+
+// checkIndexNode checks the subtree of an index rooted at pageNum, whose
+// keys must all be greater than low and at most high, where nil bounds are
+// open. Keys in internal nodes only need to bound the keys below them.
+func (c *integrityCheck) checkIndexNode(pageNum uint32, isRoot bool, low []byte, high []byte, depth int) {
+	node, err := c.pager.getPage(pageNum)
+	if err != nil {
+		c.report("Page %d cannot be read: %v", pageNum, err)
+		return
+	}
+
+	nodeType := btree.GetNodeType(node)
+	nodeIsRoot := btree.IsNodeRoot(node)
+
+	var keys [][]byte
+	var children []uint32
+	if btree.IsIndexNode(node) {
+		numCells := btree.LeafNodeNumCells(node)
+		err := btree.ValidateLeafNode(node)
+		if err != nil {
+			c.report("Index page %d %v", pageNum, err)
+			numCells = 0
+		}
+		for i := uint32(0); i < numCells; i++ {
+			key := slices.Clone(btree.LeafNodeKey(node, i))
+			keys = append(keys, key)
+			if len(key) > btree.INDEX_MAX_KEY_SIZE {
+				c.report("Index page %d has a key of %d bytes, more than the %d allowed", pageNum, len(key), btree.INDEX_MAX_KEY_SIZE)
+			}
+
+			valueSize := btree.LeafNodeValueSize(node, i)
+			if nodeType == btree.NODE_INDEX_LEAF && valueSize != 0 {
+				c.report("Index page %d has a value of %d bytes for key %x, index keys have no values", pageNum, valueSize, key)
+			}
+			if nodeType == btree.NODE_INDEX_INTERNAL {
+				if valueSize != btree.INTERNAL_NODE_CHILD_SIZE {
+					c.report("Index page %d has a cell of %d bytes for key %x, which is not a child page number", pageNum, valueSize, key)
+					keys, children = nil, nil
+					break
+				}
+				children = append(children, btree.InternalNodeChild(node, i))
+			}
+		}
+		if nodeType == btree.NODE_INDEX_INTERNAL {
+			children = append(children, btree.LeafNodeNextLeaf(node))
+		} else {
+			c.nextLeaf[pageNum] = btree.LeafNodeNextLeaf(node)
+		}
+	}
+	c.pager.unpinPage(pageNum)
+
+	if nodeType != btree.NODE_INDEX_LEAF && nodeType != btree.NODE_INDEX_INTERNAL {
+		c.report("Page %d is in an index but has node type %d", pageNum, nodeType)
+		return
+	}
+
+	if nodeIsRoot != isRoot {
+		c.report("Page %d has its root flag set to %t, expected %t", pageNum, nodeIsRoot, isRoot)
+	}
+
+	for i, key := range keys {
+		if i > 0 && bytes.Compare(key, keys[i-1]) <= 0 {
+			c.report("Index page %d has key %x after key %x, keys must be strictly increasing", pageNum, key, keys[i-1])
+		}
+		if (low != nil && bytes.Compare(key, low) <= 0) || (high != nil && bytes.Compare(key, high) > 0) {
+			c.report("Index page %d has key %x outside the range allowed by its parent", pageNum, key)
+		}
+	}
+
+	if nodeType == btree.NODE_INDEX_LEAF {
+		if c.leafDepth == -1 {
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.report("Leaf page %d is at depth %d, but other leaves are at depth %d", pageNum, depth, c.leafDepth)
+		}
+		c.leaves = append(c.leaves, pageNum)
+
+		for _, key := range keys {
+			_, rowKey, err := splitIndexKey(key)
+			if err != nil || len(rowKey) == 0 {
+				c.report("Index page %d has key %x, which does not end with a row key", pageNum, key)
+				continue
+			}
+			c.indexKeys = append(c.indexKeys, key)
+		}
+
+		if len(keys) == 0 && !isRoot {
+			c.report("Leaf page %d is empty", pageNum)
+		}
+		return
+	}
+
+	if len(keys) == 0 && isRoot {
+		c.report("Internal page %d has no keys", pageNum)
+	}
+
+	childLow := low
+	for i, child := range children {
+		childHigh := high
+		if i < len(keys) {
+			childHigh = keys[i]
+		}
+
+		if c.claim(child, fmt.Sprintf("page %d", pageNum)) {
+			c.checkIndexNode(child, false, childLow, childHigh, depth+1)
+		}
+		childLow = childHigh
+	}
+}
+
+// checkOverflowChain claims the pages of a cell's overflow chain and checks
+// that it is as long as the cell's value needs
+func (c *integrityCheck) checkOverflowChain(leafPageNum uint32, chain overflowChain) {
+	owner := fmt.Sprintf("key %s in leaf page %d", formatKey(chain.key), leafPageNum)
+
+	var numPages uint32
+	for pageNum := chain.first; pageNum != 0; numPages++ {
+		if !c.claim(pageNum, owner) {
+			return
+		}
+
+		page, err := c.pager.getPage(pageNum)
+		if err != nil {
+			c.report("Page %d cannot be read: %v", pageNum, err)
+			return
+		}
+		nodeType := btree.GetNodeType(page)
+		next := btree.OverflowPageNext(page)
+		c.pager.unpinPage(pageNum)
+
+		if nodeType != btree.NODE_OVERFLOW {
+			c.report("Page %d is in an overflow chain but has node type %d", pageNum, nodeType)
+			return
+		}
+
+		owner = fmt.Sprintf("overflow page %d", pageNum)
+		pageNum = next
+	}
+
+	if numPages != chain.numPages {
+		c.report("Key %s in leaf page %d has %d overflow pages, expected %d", formatKey(chain.key), leafPageNum, numPages, chain.numPages)
+	}
+}
+
+// checkLeafChain checks that following next-leaf pointers from the leftmost
+// leaf visits every leaf exactly once, in key order
+func (c *integrityCheck) checkLeafChain() {
+	for i, pageNum := range c.leaves {
+		var expected uint32
+		if i+1 < len(c.leaves) {
+			expected = c.leaves[i+1]
+		}
+
+		if c.nextLeaf[pageNum] != expected {
+			c.report("Leaf page %d links to next leaf %d, expected %d", pageNum, c.nextLeaf[pageNum], expected)
+		}
+	}
+}
+
+// checkFreeList claims every page on the free list, so pages that are both
+// free and in the tree are reported
+func (c *integrityCheck) checkFreeList(head uint32) {
+	owner := "the header as the free list head"
+	for trunkPageNum := head; trunkPageNum != 0; {
+		if !c.claim(trunkPageNum, owner) {
+			return
+		}
+
+		trunk, err := c.pager.getPage(trunkPageNum)
+		if err != nil {
+			c.report("Page %d cannot be read: %v", trunkPageNum, err)
+			return
+		}
+
+		nodeType := btree.GetNodeType(trunk)
+		numEntries := btree.FreeTrunkNumEntries(trunk)
+		next := btree.FreeTrunkNext(trunk)
+		var entries []uint32
+		if nodeType == btree.NODE_FREE_TRUNK && numEntries <= btree.FREE_TRUNK_MAX_ENTRIES {
+			for i := uint32(0); i < numEntries; i++ {
+				entries = append(entries, btree.FreeTrunkEntry(trunk, i))
+			}
+		}
+		c.pager.unpinPage(trunkPageNum)
+
+		if nodeType != btree.NODE_FREE_TRUNK {
+			c.report("Page %d is on the free list but has node type %d", trunkPageNum, nodeType)
+			return
+		}
+		if numEntries > btree.FREE_TRUNK_MAX_ENTRIES {
+			c.report("Free list trunk page %d claims %d entries, more than the %d that fit", trunkPageNum, numEntries, btree.FREE_TRUNK_MAX_ENTRIES)
+		}
+
+		owner = fmt.Sprintf("free list trunk page %d", trunkPageNum)
+		for _, pageNum := range entries {
+			c.claim(pageNum, owner)
+		}
+		trunkPageNum = next
+	}
+}
+
+// printIntegrityReport runs checkIntegrity and prints every problem it finds.
+// It returns false if the check failed or found problems.
+func printIntegrityReport(db *Database) bool {
+	problems, err := checkIntegrity(db)
+	if err != nil {
+		fmt.Printf("Error checking database: %v\n", err)
+		return false
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("ok: %d pages checked\n", db.Pager.NumPages)
+		return true
+	}
+
+	fmt.Printf("%d problems found\n", len(problems))
+	return false
+}
+
+// checkFile is the check subcommand: it verifies a database file and prints
+// the report without starting the shell. The file is opened read-only, so
+// committed changes still in its write-ahead log are checked where they are
+// rather than checkpointed into it first.
+func checkFile(filename string, cachePages int) bool {
+	db, err := dbOpenReadOnly(filename, cachePages)
+	if err != nil {
+		fmt.Printf("Error opening database: %v\n", err)
+		return false
+	}
+
+	ok := printIntegrityReport(db)
+
+	err = dbClose(db)
+	if err != nil {
+		fmt.Printf("Error closing database: %v\n", err)
+		return false
+	}
+
+	return ok
+}
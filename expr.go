@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+	"toydb/parser"
+	"toydb/record"
+)
+
+// exprType is the type of value an expression evaluates to. It is worked
+// out when a statement is prepared, so that evaluating an expression
+// against a row cannot fail on values of the wrong type. Conditions are
+// integers: 1 for true and 0 for false.
+type exprType int
+
+const (
+	TYPE_NULL exprType = iota // The null literal, which goes with any type
+	TYPE_INTEGER
+	TYPE_REAL
+	TYPE_TEXT
+	TYPE_BLOB
+)
+
+func (t exprType) String() string {
+	switch t {
+	case TYPE_NULL:
+		return "null"
+	case TYPE_INTEGER:
+		return "integer"
+	case TYPE_REAL:
+		return "real"
+	case TYPE_TEXT:
+		return "text"
+	default:
+		return "blob"
+	}
+}
+
+func (t exprType) isNumeric() bool {
+	return t == TYPE_NULL || t == TYPE_INTEGER || t == TYPE_REAL
+}
+
+// comparableWith reports whether values of the two types can be compared:
+// numbers with numbers, and text and blobs with their own kind
+func (t exprType) comparableWith(other exprType) bool {
+	return t == other || t == TYPE_NULL || other == TYPE_NULL || (t.isNumeric() && other.isNumeric())
+}
+
+var columnExprTypes = map[record.ColumnType]exprType{
+	record.COLUMN_INTEGER: TYPE_INTEGER,
+	record.COLUMN_REAL:    TYPE_REAL,
+	record.COLUMN_TEXT:    TYPE_TEXT,
+	record.COLUMN_BLOB:    TYPE_BLOB,
+}
+
+// checkExpr checks that the columns an expression names exist in the
+// schema and that its operators are applied to values they work on, and
+// returns the type of the expression
+func checkExpr(statement *Statement, expr parser.Expr, schema *record.Schema) (exprType, PrepareResult) {
+	switch expr := expr.(type) {
+	case *parser.Literal:
+		if _, ok := literalConstant(expr); !ok {
+			return TYPE_NULL, syntaxError(statement, expr.Pos, "%s is out of range", expr.Raw)
+		}
+
+		switch expr.Kind {
+		case parser.LITERAL_INTEGER:
+			return TYPE_INTEGER, PREPARE_SUCCESS
+		case parser.LITERAL_REAL:
+			return TYPE_REAL, PREPARE_SUCCESS
+		case parser.LITERAL_STRING:
+			return TYPE_TEXT, PREPARE_SUCCESS
+		case parser.LITERAL_BLOB:
+			return TYPE_BLOB, PREPARE_SUCCESS
+		default:
+			return TYPE_NULL, PREPARE_SUCCESS
+		}
+	case *parser.ColumnRef:
+		if expr.Table != "" && expr.Table != schema.TableName {
+			return TYPE_NULL, syntaxError(statement, expr.Pos, "no such table %s", expr.Table)
+		}
+
+		columnIndex := schema.ColumnIndex(expr.Name)
+		if columnIndex == -1 {
+			return TYPE_NULL, syntaxError(statement, expr.Pos, "table %s has no column %s", schema.TableName, expr.Name)
+		}
+		return columnExprTypes[schema.Columns[columnIndex].Type], PREPARE_SUCCESS
+	case *parser.UnaryExpr:
+		operand, result := checkExpr(statement, expr.Expr, schema)
+		if result != PREPARE_SUCCESS {
+			return operand, result
+		}
+
+		if !operand.isNumeric() {
+			return operand, syntaxError(statement, expr.Pos, "cannot apply %s to a %v value", expr.Op, operand)
+		}
+
+		if expr.Op == "NOT" {
+			return TYPE_INTEGER, PREPARE_SUCCESS
+		}
+		return operand, PREPARE_SUCCESS
+	case *parser.BinaryExpr:
+		left, result := checkExpr(statement, expr.Left, schema)
+		if result != PREPARE_SUCCESS {
+			return left, result
+		}
+
+		right, result := checkExpr(statement, expr.Right, schema)
+		if result != PREPARE_SUCCESS {
+			return right, result
+		}
+
+		switch expr.Op {
+		case "=", "<>", "<", "<=", ">", ">=":
+			if !left.comparableWith(right) {
+				return left, syntaxError(statement, expr.Pos, "cannot compare %v with %v", left, right)
+			}
+			return TYPE_INTEGER, PREPARE_SUCCESS
+		case "||":
+			if left == TYPE_BLOB || right == TYPE_BLOB {
+				return left, syntaxError(statement, expr.Pos, "cannot apply || to a blob value")
+			}
+			return TYPE_TEXT, PREPARE_SUCCESS
+		}
+
+		if !left.isNumeric() || !right.isNumeric() {
+			return left, syntaxError(statement, expr.Pos, "cannot apply %s to %v and %v values", expr.Op, left, right)
+		}
+
+		switch {
+		case expr.Op == "AND" || expr.Op == "OR":
+			return TYPE_INTEGER, PREPARE_SUCCESS
+		case left == TYPE_REAL || right == TYPE_REAL:
+			return TYPE_REAL, PREPARE_SUCCESS
+		case left == TYPE_INTEGER || right == TYPE_INTEGER:
+			return TYPE_INTEGER, PREPARE_SUCCESS
+		default:
+			return TYPE_NULL, PREPARE_SUCCESS
+		}
+	case *parser.BetweenExpr:
+		return checkComparisons(statement, expr.Pos, expr.Expr, []parser.Expr{expr.Low, expr.High}, schema)
+	case *parser.InExpr:
+		return checkComparisons(statement, expr.Pos, expr.Expr, expr.Values, schema)
+	case *parser.LikeExpr:
+		for _, operand := range []parser.Expr{expr.Expr, expr.Pattern} {
+			operandType, result := checkExpr(statement, operand, schema)
+			if result != PREPARE_SUCCESS {
+				return operandType, result
+			}
+
+			if operandType != TYPE_TEXT && operandType != TYPE_NULL {
+				return operandType, syntaxError(statement, operand.Position(), "LIKE works on text, not %v values", operandType)
+			}
+		}
+		return TYPE_INTEGER, PREPARE_SUCCESS
+	case *parser.IsNullExpr:
+		_, result := checkExpr(statement, expr.Expr, schema)
+		return TYPE_INTEGER, result
+	case *parser.FunctionCall:
+		return checkFunction(statement, expr, schema)
+	case *aggregateRef:
+		return expr.Type, PREPARE_SUCCESS
+	default:
+		return TYPE_NULL, syntaxError(statement, expr.Position(), "unsupported expression")
+	}
+}
+
+// checkComparisons checks that left can be compared with each of values
+func checkComparisons(statement *Statement, pos parser.Pos, left parser.Expr, values []parser.Expr, schema *record.Schema) (exprType, PrepareResult) {
+	leftType, result := checkExpr(statement, left, schema)
+	if result != PREPARE_SUCCESS {
+		return leftType, result
+	}
+
+	for _, value := range values {
+		valueType, result := checkExpr(statement, value, schema)
+		if result != PREPARE_SUCCESS {
+			return valueType, result
+		}
+
+		if !leftType.comparableWith(valueType) {
+			return leftType, syntaxError(statement, pos, "cannot compare %v with %v", leftType, valueType)
+		}
+	}
+
+	return TYPE_INTEGER, PREPARE_SUCCESS
+}
+
+// literalConstant returns the value of a literal, or false if it is a
+// number too large to represent
+func literalConstant(literal *parser.Literal) (record.Value, bool) {
+	switch literal.Kind {
+	case parser.LITERAL_INTEGER:
+		value, err := strconv.ParseInt(literal.Text, 10, 64)
+		return value, err == nil
+	case parser.LITERAL_REAL:
+		value, err := strconv.ParseFloat(literal.Text, 64)
+		return value, err == nil
+	case parser.LITERAL_STRING, parser.LITERAL_WORD:
+		return literal.Text, true
+	case parser.LITERAL_BLOB:
+		value, err := hex.DecodeString(literal.Text)
+		return value, err == nil
+	default:
+		return nil, true
+	}
+}
+
+// evalExpr evaluates an expression that checkExpr accepted against a row.
+// As in SQL, an operator applied to NULL gives NULL, except that AND and
+// OR give a result when one side alone decides it. Division by zero is
+// NULL, and integer arithmetic that overflows is done in reals.
+func evalExpr(expr parser.Expr, schema *record.Schema, row *Row) record.Value {
+	switch expr := expr.(type) {
+	case *parser.Literal:
+		value, _ := literalConstant(expr)
+		return value
+	case *parser.ColumnRef:
+		return row.Values[schema.ColumnIndex(expr.Name)]
+	case *parser.UnaryExpr:
+		operand := evalExpr(expr.Expr, schema, row)
+		switch {
+		case operand == nil:
+			return nil
+		case expr.Op == "NOT":
+			return sqlBool(!isTrue(operand))
+		case expr.Op == "-":
+			return arithmetic("-", int64(0), operand)
+		default:
+			return operand
+		}
+	case *parser.BinaryExpr:
+		return evalBinary(expr, schema, row)
+	case *parser.BetweenExpr:
+		value := evalExpr(expr.Expr, schema, row)
+		low := evalExpr(expr.Low, schema, row)
+		high := evalExpr(expr.High, schema, row)
+
+		within := and(compare(">=", value, low), compare("<=", value, high))
+		return negate(within, expr.Not)
+	case *parser.InExpr:
+		value := evalExpr(expr.Expr, schema, row)
+		if value == nil {
+			return nil
+		}
+
+		var found record.Value = sqlBool(false)
+		for _, candidate := range expr.Values {
+			switch equal := compare("=", value, evalExpr(candidate, schema, row)); {
+			case equal == nil:
+				found = nil
+			case isTrue(equal):
+				return negate(equal, expr.Not)
+			}
+		}
+		return negate(found, expr.Not)
+	case *parser.LikeExpr:
+		text := evalExpr(expr.Expr, schema, row)
+		pattern := evalExpr(expr.Pattern, schema, row)
+		if text == nil || pattern == nil {
+			return nil
+		}
+		return negate(sqlBool(likeMatch(pattern.(string), text.(string))), expr.Not)
+	case *parser.IsNullExpr:
+		return sqlBool((evalExpr(expr.Expr, schema, row) == nil) != expr.Not)
+	case *parser.FunctionCall:
+		return evalFunction(expr, schema, row)
+	case *aggregateRef:
+		return row.Values[len(schema.Columns)+expr.Index]
+	default:
+		return nil
+	}
+}
+
+func evalBinary(expr *parser.BinaryExpr, schema *record.Schema, row *Row) record.Value {
+	left := evalExpr(expr.Left, schema, row)
+
+	// AND and OR skip their right side when the left one decides the result
+	switch {
+	case expr.Op == "AND" && left != nil && !isTrue(left):
+		return sqlBool(false)
+	case expr.Op == "OR" && isTrue(left):
+		return sqlBool(true)
+	}
+
+	right := evalExpr(expr.Right, schema, row)
+	switch expr.Op {
+	case "AND":
+		return and(left, right)
+	case "OR":
+		if isTrue(right) {
+			return sqlBool(true)
+		}
+		if left == nil || right == nil {
+			return nil
+		}
+		return sqlBool(false)
+	case "||":
+		if left == nil || right == nil {
+			return nil
+		}
+		return formatValue(left) + formatValue(right)
+	case "=", "<>", "<", "<=", ">", ">=":
+		return compare(expr.Op, left, right)
+	default:
+		return arithmetic(expr.Op, left, right)
+	}
+}
+
+// sqlBool returns the integer SQL uses for a truth value
+func sqlBool(b bool) record.Value {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// isTrue reports whether a condition holds, which it does for any number
+// other than zero but not for NULL
+func isTrue(value record.Value) bool {
+	switch value := value.(type) {
+	case int64:
+		return value != 0
+	case float64:
+		return value != 0
+	default:
+		return false
+	}
+}
+
+// and combines two conditions: false if either is false, else NULL if
+// either is NULL
+func and(left, right record.Value) record.Value {
+	if (left != nil && !isTrue(left)) || (right != nil && !isTrue(right)) {
+		return sqlBool(false)
+	}
+	if left == nil || right == nil {
+		return nil
+	}
+	return sqlBool(true)
+}
+
+// negate inverts a condition if not is set, leaving NULL as it is
+func negate(condition record.Value, not bool) record.Value {
+	if condition == nil || !not {
+		return condition
+	}
+	return sqlBool(!isTrue(condition))
+}
+
+// compare applies a comparison operator, giving NULL if either side is
+// NULL
+func compare(op string, left, right record.Value) record.Value {
+	if left == nil || right == nil {
+		return nil
+	}
+
+	c := compareValues(left, right)
+	switch op {
+	case "=":
+		return sqlBool(c == 0)
+	case "<>":
+		return sqlBool(c != 0)
+	case "<":
+		return sqlBool(c < 0)
+	case "<=":
+		return sqlBool(c <= 0)
+	case ">":
+		return sqlBool(c > 0)
+	default:
+		return sqlBool(c >= 0)
+	}
+}
+
+// compareValues orders two values, returning -1, 0 or 1. NULL comes
+// first, then numbers by value, then text and blobs byte by byte.
+func compareValues(left, right record.Value) int {
+	leftRank, rightRank := valueRank(left), valueRank(right)
+	if leftRank != rightRank {
+		return leftRank - rightRank
+	}
+
+	switch left := left.(type) {
+	case int64:
+		if right, ok := right.(int64); ok {
+			return compareOrdered(left, right)
+		}
+		return compareOrdered(float64(left), right.(float64))
+	case float64:
+		if right, ok := right.(int64); ok {
+			return compareOrdered(left, float64(right))
+		}
+		return compareOrdered(left, right.(float64))
+	case string:
+		return strings.Compare(left, right.(string))
+	case []byte:
+		return bytes.Compare(left, right.([]byte))
+	default:
+		return 0
+	}
+}
+
+func compareOrdered[T int64 | float64](left, right T) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// valueRank orders values of different kinds
+func valueRank(value record.Value) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// arithmetic applies +, -, *, / or % to two numbers
+func arithmetic(op string, left, right record.Value) record.Value {
+	if left == nil || right == nil {
+		return nil
+	}
+
+	a, leftIsInteger := left.(int64)
+	b, rightIsInteger := right.(int64)
+	if leftIsInteger && rightIsInteger {
+		if (op == "/" || op == "%") && b == 0 {
+			return nil
+		}
+
+		result, ok := integerArithmetic(op, a, b)
+		if ok {
+			return result
+		}
+	}
+
+	x, y := toReal(left), toReal(right)
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	}
+
+	if y == 0 {
+		return nil
+	}
+	if op == "/" {
+		return x / y
+	}
+	return math.Mod(x, y)
+}
+
+// integerArithmetic applies an operator to two integers, returning false
+// if the result does not fit in 64 bits
+func integerArithmetic(op string, a, b int64) (int64, bool) {
+	switch op {
+	case "+":
+		c := a + b
+		return c, (c > a) == (b > 0)
+	case "-":
+		c := a - b
+		return c, (c < a) == (b > 0)
+	case "*":
+		c := a * b
+		return c, a == 0 || (c/a == b && !(a == -1 && b == math.MinInt64))
+	case "/":
+		return a / b, !(a == math.MinInt64 && b == -1)
+	default:
+		return a % b, true
+	}
+}
+
+func toReal(value record.Value) float64 {
+	if integer, ok := value.(int64); ok {
+		return float64(integer)
+	}
+	return value.(float64)
+}
+
+// likeMatch reports whether text matches a LIKE pattern, where % matches
+// any run of characters and _ any one character. Letters match in either
+// case, as they do in SQLite.
+func likeMatch(pattern, text string) bool {
+	p, t := []rune(pattern), []rune(text)
+
+	// Where the last % was seen, to go back to when a match fails after it
+	star, starText := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && p[i] == '%':
+			star, starText = i, j
+			i++
+		case i < len(p) && (p[i] == '_' || foldASCII(p[i]) == foldASCII(t[j])):
+			i++
+			j++
+		case star != -1:
+			starText++
+			i, j = star+1, starText
+		default:
+			return false
+		}
+	}
+
+	for i < len(p) && p[i] == '%' {
+		i++
+	}
+	return i == len(p)
+}
+
+func foldASCII(r rune) rune {
+	if r >= 'A' && r <= 'Z' {
+		return r + 'a' - 'A'
+	}
+	return r
+}
+
+// replaceAliases returns expr with the names of result columns in aliases
+// replaced by the expressions they name. Columns of the table take
+// precedence over aliases with the same name.
+func replaceAliases(expr parser.Expr, aliases map[string]parser.Expr, schema *record.Schema) parser.Expr {
+	return rewriteExpr(expr, func(expr parser.Expr) parser.Expr {
+		column, ok := expr.(*parser.ColumnRef)
+		if !ok || schema.ColumnIndex(column.Name) != -1 {
+			return nil
+		}
+		return aliases[column.Name]
+	})
+}
+
+// rewriteExpr returns a copy of expr in which replace has been given each
+// expression, outermost first. Where replace returns an expression it takes
+// the place of the one given, operands and all; where it returns nil the
+// expression is kept and its operands are rewritten in turn.
+func rewriteExpr(expr parser.Expr, replace func(parser.Expr) parser.Expr) parser.Expr {
+	if expr == nil {
+		return nil
+	}
+	if replacement := replace(expr); replacement != nil {
+		return replacement
+	}
+
+	rewrite := func(expr parser.Expr) parser.Expr {
+		return rewriteExpr(expr, replace)
+	}
+	rewriteAll := func(exprs []parser.Expr) []parser.Expr {
+		if exprs == nil {
+			return nil
+		}
+		rewritten := make([]parser.Expr, len(exprs))
+		for i, expr := range exprs {
+			rewritten[i] = rewrite(expr)
+		}
+		return rewritten
+	}
+
+	switch expr := expr.(type) {
+	case *parser.UnaryExpr:
+		return &parser.UnaryExpr{Pos: expr.Pos, Op: expr.Op, Expr: rewrite(expr.Expr)}
+	case *parser.BinaryExpr:
+		return &parser.BinaryExpr{Pos: expr.Pos, Op: expr.Op, Left: rewrite(expr.Left), Right: rewrite(expr.Right)}
+	case *parser.BetweenExpr:
+		return &parser.BetweenExpr{Pos: expr.Pos, Expr: rewrite(expr.Expr), Low: rewrite(expr.Low), High: rewrite(expr.High), Not: expr.Not}
+	case *parser.InExpr:
+		return &parser.InExpr{Pos: expr.Pos, Expr: rewrite(expr.Expr), Values: rewriteAll(expr.Values), Not: expr.Not}
+	case *parser.LikeExpr:
+		return &parser.LikeExpr{Pos: expr.Pos, Expr: rewrite(expr.Expr), Pattern: rewrite(expr.Pattern), Not: expr.Not}
+	case *parser.IsNullExpr:
+		return &parser.IsNullExpr{Pos: expr.Pos, Expr: rewrite(expr.Expr), Not: expr.Not}
+	case *parser.FunctionCall:
+		return &parser.FunctionCall{Pos: expr.Pos, Name: expr.Name, Args: rewriteAll(expr.Args), Star: expr.Star}
+	default:
+		return expr
+	}
+}
+
+// whereKeyRange narrows the keys a WHERE clause can match using its
+// conditions on the first column of the primary key, so that a statement
+// looks up one row or scans part of the table instead of all of it.
+// Conditions joined by AND narrow the range together; the rest of the
+// clause is left to be checked against each row in the range. Keys made of
+// an INTEGER column get an exact range, and other keys the range of values
+// whereValueRange finds.
+func whereKeyRange(where parser.Expr, schema *record.Schema) KeyRange {
+	column := schema.Columns[schema.PrimaryKey[0]]
+	if column.Type != record.COLUMN_INTEGER {
+		low, high, ok := whereValueRange(where, column)
+		if !ok {
+			return KeyRange{}
+		}
+		return KeyRange{Low: low, High: high}
+	}
+
+	isPrimaryKey := func(expr parser.Expr) bool {
+		ref, ok := expr.(*parser.ColumnRef)
+		return ok && ref.Name == column.Name
+	}
+
+	// Only a declared key can be negative
+	least := int64(math.MinInt64)
+	if schema.HasDefaultKey() {
+		least = 0
+	}
+
+	switch where := where.(type) {
+	case *parser.BinaryExpr:
+		if where.Op == "AND" {
+			return intersectKeyRanges(whereKeyRange(where.Left, schema), whereKeyRange(where.Right, schema))
+		}
+
+		// Put the key on the left, as in 5 < id to id > 5
+		flipped := map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+		left, op, right := where.Left, where.Op, where.Right
+		if isPrimaryKey(right) && flipped[op] != "" {
+			left, op, right = right, flipped[op], left
+		}
+
+		value, ok := integerLiteral(right)
+		if !isPrimaryKey(left) || !ok {
+			return KeyRange{}
+		}
+		return comparisonKeyRange(op, value, least)
+	case *parser.BetweenExpr:
+		low, lowOk := integerLiteral(where.Low)
+		high, highOk := integerLiteral(where.High)
+		if !isPrimaryKey(where.Expr) || where.Not || !lowOk || !highOk {
+			return KeyRange{}
+		}
+		return intersectKeyRanges(comparisonKeyRange(">=", low, least), comparisonKeyRange("<=", high, least))
+	case *parser.InExpr:
+		if !isPrimaryKey(where.Expr) || where.Not {
+			return KeyRange{}
+		}
+
+		// The smallest range that holds every key in the list
+		keys := noKeys()
+		for _, candidate := range where.Values {
+			value, ok := integerLiteral(candidate)
+			if !ok {
+				return KeyRange{}
+			}
+
+			key := comparisonKeyRange("=", value, least)
+			if key.isEmpty() {
+				continue
+			}
+			if keys.isEmpty() {
+				keys = key
+			}
+			if bytes.Compare(key.Low, keys.Low) < 0 {
+				keys.Low = key.Low
+			}
+			if bytes.Compare(key.High, keys.High) > 0 {
+				keys.High = key.High
+			}
+		}
+		return keys
+	case *parser.IsNullExpr:
+		// The primary key is never NULL
+		if isPrimaryKey(where.Expr) && !where.Not {
+			return noKeys()
+		}
+	}
+
+	return KeyRange{}
+}
+
+// comparisonKeyRange returns the integer keys for which "key <op> value"
+// holds. Keys are never less than least.
+func comparisonKeyRange(op string, value int64, least int64) KeyRange {
+	switch op {
+	case "=":
+		if value < least {
+			return noKeys()
+		}
+		return KeyRange{Low: integerKey(value), High: integerKey(value)}
+	case ">":
+		if value == math.MaxInt64 {
+			return noKeys()
+		}
+		value++
+		fallthrough
+	case ">=":
+		if value <= least {
+			return KeyRange{}
+		}
+		return KeyRange{Low: integerKey(value)}
+	case "<":
+		if value <= least {
+			return noKeys()
+		}
+		value--
+		fallthrough
+	case "<=":
+		if value < least {
+			return noKeys()
+		}
+		return KeyRange{High: integerKey(value)}
+	default:
+		return KeyRange{}
+	}
+}
+
+// noKeys returns a range that no key is in
+func noKeys() KeyRange {
+	return KeyRange{Low: integerKey(1), High: integerKey(0)}
+}
+
+func intersectKeyRanges(a, b KeyRange) KeyRange {
+	low, high := intersectValueRanges(a.Low, a.High, b.Low, b.High)
+	return KeyRange{Low: low, High: high}
+}
+
+// integerLiteral returns the value of an integer literal
+func integerLiteral(expr parser.Expr) (int64, bool) {
+	literal, ok := expr.(*parser.Literal)
+	if !ok || literal.Kind != parser.LITERAL_INTEGER {
+		return 0, false
+	}
+
+	value, err := strconv.ParseInt(literal.Text, 10, 64)
+	return value, err == nil
+}
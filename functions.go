@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"toydb/parser"
+	"toydb/record"
+	"unicode/utf8"
+)
+
+// Scalar functions work on the values of one row. Aggregate functions work
+// on all the rows of a group and are taken out of the expressions that use
+// them when a select is prepared, see extractAggregates.
+
+// functionSignature gives the types of the arguments of a scalar function,
+// of which the last optional ones may be left out, and the type of its
+// result. TYPE_NULL as an argument type accepts a value of any type.
+type functionSignature struct {
+	args     []exprType
+	optional int
+	result   exprType
+}
+
+var scalarFunctions = map[string]functionSignature{
+	"length": {args: []exprType{TYPE_NULL}, result: TYPE_INTEGER},
+	"lower":  {args: []exprType{TYPE_TEXT}, result: TYPE_TEXT},
+	"upper":  {args: []exprType{TYPE_TEXT}, result: TYPE_TEXT},
+	"instr":  {args: []exprType{TYPE_TEXT, TYPE_TEXT}, result: TYPE_INTEGER},
+	"substr": {args: []exprType{TYPE_TEXT, TYPE_INTEGER, TYPE_INTEGER}, optional: 1, result: TYPE_TEXT},
+}
+
+var aggregateFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+}
+
+// checkFunction checks a call of a scalar function and returns its type.
+// An aggregate function found here is in a place it cannot be used, such
+// as a WHERE clause or the argument of another aggregate.
+func checkFunction(statement *Statement, call *parser.FunctionCall, schema *record.Schema) (exprType, PrepareResult) {
+	if aggregateFunctions[call.Name] {
+		return TYPE_NULL, syntaxError(statement, call.Pos, "%s() cannot be used here", call.Name)
+	}
+
+	signature, ok := scalarFunctions[call.Name]
+	if !ok {
+		return TYPE_NULL, syntaxError(statement, call.Pos, "no such function %s()", call.Name)
+	}
+
+	required := len(signature.args) - signature.optional
+	if call.Star || len(call.Args) < required || len(call.Args) > len(signature.args) {
+		return TYPE_NULL, syntaxError(statement, call.Pos, "%s() takes %s", call.Name, argumentCount(required, len(signature.args)))
+	}
+
+	for i, arg := range call.Args {
+		argType, result := checkExpr(statement, arg, schema)
+		if result != PREPARE_SUCCESS {
+			return argType, result
+		}
+
+		want := signature.args[i]
+		if want != TYPE_NULL && argType != TYPE_NULL && argType != want {
+			return argType, syntaxError(statement, arg.Position(), "argument %d of %s() must be %v, not %v", i+1, call.Name, want, argType)
+		}
+	}
+
+	return signature.result, PREPARE_SUCCESS
+}
+
+// argumentCount describes how many arguments a function takes
+func argumentCount(least, most int) string {
+	switch {
+	case least != most:
+		return fmt.Sprintf("%d or %d arguments", least, most)
+	case most == 1:
+		return "1 argument"
+	default:
+		return fmt.Sprintf("%d arguments", most)
+	}
+}
+
+// evalFunction calls a scalar function that checkFunction accepted. As
+// with operators, a NULL argument gives NULL.
+func evalFunction(call *parser.FunctionCall, schema *record.Schema, row *Row) record.Value {
+	args := make([]record.Value, len(call.Args))
+	for i, arg := range call.Args {
+		args[i] = evalExpr(arg, schema, row)
+		if args[i] == nil {
+			return nil
+		}
+	}
+
+	switch call.Name {
+	case "length":
+		switch arg := args[0].(type) {
+		case string:
+			return int64(utf8.RuneCountInString(arg))
+		case []byte:
+			return int64(len(arg))
+		default:
+			return int64(len(formatValue(arg)))
+		}
+	case "lower":
+		return strings.ToLower(args[0].(string))
+	case "upper":
+		return strings.ToUpper(args[0].(string))
+	case "instr":
+		text, search := args[0].(string), args[1].(string)
+		index := strings.Index(text, search)
+		if index == -1 {
+			return int64(0)
+		}
+		return int64(utf8.RuneCountInString(text[:index]) + 1)
+	default:
+		length := int64(math.MaxInt64)
+		if len(args) == 3 {
+			length = args[2].(int64)
+		}
+		return substr(args[0].(string), args[1].(int64), length)
+	}
+}
+
+// substr returns length characters of text from the 1-based position
+// start. As in SQLite, a negative start counts back from the end of the
+// text and a negative length takes the characters before start.
+func substr(text string, start, length int64) string {
+	runes := []rune(text)
+	size := int64(len(runes))
+
+	before := length < 0
+	if before {
+		length = -length
+	}
+
+	switch {
+	case start < 0:
+		start += size
+		if start < 0 {
+			length = max(length+start, 0)
+			start = 0
+		}
+	case start > 0:
+		start--
+	case length > 0:
+		length--
+	}
+
+	if before {
+		start -= length
+		if start < 0 {
+			length += start
+			start = 0
+		}
+	}
+
+	if start >= size || length <= 0 {
+		return ""
+	}
+	return string(runes[start : start+min(length, size-start)])
+}
+
+// aggregate is a call of an aggregate function in a select. Its argument
+// is nil for count(*).
+type aggregate struct {
+	Name string
+	Arg  parser.Expr
+	Type exprType
+}
+
+// aggregateRef takes the place of an aggregate call in the expressions of
+// a select once it has been taken out into Aggregates. The rows of a group
+// hold the values of the aggregates after those of the columns, so it is
+// evaluated like a column.
+type aggregateRef struct {
+	Pos   parser.Pos
+	Index int
+	Type  exprType
+}
+
+func (e *aggregateRef) Position() parser.Pos { return e.Pos }
+
+// extractAggregates replaces the aggregate calls in expr with references
+// to statement.Aggregates, to which it adds them
+func extractAggregates(statement *Statement, expr parser.Expr, schema *record.Schema) (parser.Expr, PrepareResult) {
+	result := PREPARE_SUCCESS
+	rewritten := rewriteExpr(expr, func(expr parser.Expr) parser.Expr {
+		call, ok := expr.(*parser.FunctionCall)
+		if !ok || !aggregateFunctions[call.Name] || result != PREPARE_SUCCESS {
+			return nil
+		}
+
+		var function aggregate
+		function, result = checkAggregate(statement, call, schema)
+		statement.Aggregates = append(statement.Aggregates, function)
+		return &aggregateRef{Pos: call.Pos, Index: len(statement.Aggregates) - 1, Type: function.Type}
+	})
+
+	return rewritten, result
+}
+
+// checkAggregate checks the argument of an aggregate function and works
+// out the type of its result. sum and avg add up numbers, while min and max
+// work on any values that can be compared.
+func checkAggregate(statement *Statement, call *parser.FunctionCall, schema *record.Schema) (aggregate, PrepareResult) {
+	function := aggregate{Name: call.Name, Type: TYPE_INTEGER}
+	if call.Name == "count" && call.Star {
+		return function, PREPARE_SUCCESS
+	}
+
+	if call.Star || len(call.Args) != 1 {
+		return function, syntaxError(statement, call.Pos, "%s() takes 1 argument", call.Name)
+	}
+	function.Arg = call.Args[0]
+
+	argType, result := checkExpr(statement, function.Arg, schema)
+	if result != PREPARE_SUCCESS {
+		return function, result
+	}
+
+	switch call.Name {
+	case "count":
+	case "sum", "avg":
+		if !argType.isNumeric() {
+			return function, syntaxError(statement, function.Arg.Position(), "%s() adds up numbers, not %v values", call.Name, argType)
+		}
+
+		function.Type = argType
+		if call.Name == "avg" {
+			function.Type = TYPE_REAL
+		}
+	default:
+		function.Type = argType
+	}
+
+	return function, PREPARE_SUCCESS
+}
+
+// accumulator collects the value of an aggregate over the rows of a group.
+// NULL values are left out, as in SQL.
+type accumulator struct {
+	count int64
+	value record.Value // The sum so far, or the smallest or largest value
+}
+
+func (a *accumulator) add(function aggregate, value record.Value) {
+	if function.Arg != nil && value == nil {
+		return
+	}
+
+	a.count++
+	switch function.Name {
+	case "sum", "avg":
+		if a.value == nil {
+			a.value = value
+		} else {
+			a.value = arithmetic("+", a.value, value)
+		}
+	case "min":
+		if a.value == nil || compareValues(value, a.value) < 0 {
+			a.value = value
+		}
+	case "max":
+		if a.value == nil || compareValues(value, a.value) > 0 {
+			a.value = value
+		}
+	}
+}
+
+// result returns the value of the aggregate. Only count gives a value for
+// a group without any values; the others give NULL.
+func (a *accumulator) result(function aggregate) record.Value {
+	switch function.Name {
+	case "count":
+		return a.count
+	case "avg":
+		if a.count == 0 {
+			return nil
+		}
+		return toReal(a.value) / float64(a.count)
+	default:
+		return a.value
+	}
+}
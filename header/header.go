@@ -0,0 +1,100 @@
+package header
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"toydb/constants"
+)
+
+// Page 0 of every database file is reserved for the file header. The rest of
+// the page is unused.
+const HEADER_PAGE_NUM = 0
+
+const (
+	MAGIC          = "toydb format\x00\x00\x00\x00"
+	FORMAT_VERSION = 8 // Version 8 keys rows by encoded primary key values
+)
+
+// File Header Layout
+const (
+	MAGIC_SIZE            = 16
+	MAGIC_OFFSET          = 0
+	VERSION_SIZE          = 4
+	VERSION_OFFSET        = MAGIC_OFFSET + MAGIC_SIZE
+	PAGE_SIZE_SIZE        = 4
+	PAGE_SIZE_OFFSET      = VERSION_OFFSET + VERSION_SIZE
+	ROOT_PAGE_SIZE        = 4
+	ROOT_PAGE_OFFSET      = PAGE_SIZE_OFFSET + PAGE_SIZE_SIZE
+	FREE_LIST_HEAD_SIZE   = 4
+	FREE_LIST_HEAD_OFFSET = ROOT_PAGE_OFFSET + ROOT_PAGE_SIZE
+	PAGE_COUNT_SIZE       = 4
+	PAGE_COUNT_OFFSET     = FREE_LIST_HEAD_OFFSET + FREE_LIST_HEAD_SIZE
+	HEADER_SIZE           = PAGE_COUNT_OFFSET + PAGE_COUNT_SIZE
+)
+
+func Version(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[VERSION_OFFSET:])
+}
+
+func PageSize(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[PAGE_SIZE_OFFSET:])
+}
+
+// RootPage returns the root page of the catalog, the B-tree that lists every
+// table and where its own root is
+func RootPage(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[ROOT_PAGE_OFFSET:])
+}
+
+func SetRootPage(page []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(page[ROOT_PAGE_OFFSET:], pageNum)
+}
+
+// FreeListHead returns the first trunk page of the free list, or 0 when the
+// list is empty
+func FreeListHead(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[FREE_LIST_HEAD_OFFSET:])
+}
+
+func SetFreeListHead(page []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(page[FREE_LIST_HEAD_OFFSET:], pageNum)
+}
+
+func PageCount(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[PAGE_COUNT_OFFSET:])
+}
+
+func SetPageCount(page []byte, numPages uint32) {
+	binary.LittleEndian.PutUint32(page[PAGE_COUNT_OFFSET:], numPages)
+}
+
+func Initialize(page []byte) {
+	copy(page[MAGIC_OFFSET:], MAGIC)
+	binary.LittleEndian.PutUint32(page[VERSION_OFFSET:], FORMAT_VERSION)
+	binary.LittleEndian.PutUint32(page[PAGE_SIZE_OFFSET:], constants.PAGE_SIZE)
+	SetRootPage(page, 0)
+	SetFreeListHead(page, 0)
+	SetPageCount(page, 0)
+}
+
+// Validate checks that a header page belongs to a database this build can read
+func Validate(page []byte) error {
+	if !bytes.Equal(page[MAGIC_OFFSET:MAGIC_OFFSET+MAGIC_SIZE], []byte(MAGIC)) {
+		return fmt.Errorf("File is not a toydb database")
+	}
+
+	if Version(page) != FORMAT_VERSION {
+		return fmt.Errorf("Unsupported file format version %d, expected %d", Version(page), FORMAT_VERSION)
+	}
+
+	if PageSize(page) != constants.PAGE_SIZE {
+		return fmt.Errorf("Unsupported page size %d, expected %d", PageSize(page), constants.PAGE_SIZE)
+	}
+
+	if RootPage(page) == HEADER_PAGE_NUM {
+		return fmt.Errorf("Header points the root at the header page")
+	}
+
+	return nil
+}
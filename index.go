@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"toydb/btree"
+	"toydb/parser"
+	"toydb/record"
+)
+
+// Index is a secondary index on one column of a table. Its B-tree holds an
+// index key for every row: the encoded value of the column followed by the
+// key of the row, so that rows with equal values are next to each other
+// and every index key is different. Unlike a table's, the root of an
+// index never moves, so the catalog is only written when the index is
+// created. A unique index also keeps any two rows from having the same
+// value in its column, although any number of them may be NULL.
+type Index struct {
+	Name        string
+	Column      int // Position of the indexed column in the table's schema
+	Unique      bool
+	RootPageNum uint32
+	CatalogKey  uint32 // Key of the index's row in the catalog
+}
+
+// ConstraintError is a statement that would give two rows the same value
+// in the column of a unique index. The constraint is named after the index.
+type ConstraintError struct {
+	Index  string
+	Table  string
+	Column string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("UNIQUE constraint %s failed on %s.%s", e.Index, e.Table, e.Column)
+}
+
+// AUTOINDEX_PREFIX starts the names of the indexes created for unique
+// columns of a CREATE TABLE
+const AUTOINDEX_PREFIX = "toydb_autoindex_"
+
+// IndexRange is an inclusive range of index keys to scan for the rows a
+// WHERE clause can match. Each end is an encoded column value, or a prefix
+// of one; a nil end leaves that side of the range open.
+type IndexRange struct {
+	Index *Index
+	Low   []byte
+	High  []byte
+}
+
+// indexStep is an internal node an index search went through, and the
+// child it went on to
+type indexStep struct {
+	PageNum  uint32
+	ChildNum uint32
+}
+
+// indexSQL renders the create index statement that defines an index
+func indexSQL(table *Table, index *Index) string {
+	unique := ""
+	if index.Unique {
+		unique = "unique "
+	}
+	return fmt.Sprintf("create %sindex %s on %s (%s)", unique, index.Name, table.Schema.TableName, table.Schema.Columns[index.Column].Name)
+}
+
+// autoIndexName returns the name of the index that enforces a unique
+// column of a table
+func autoIndexName(schema *record.Schema, column int) string {
+	return AUTOINDEX_PREFIX + schema.TableName + "_" + schema.Columns[column].Name
+}
+
+// isAutoIndex reports whether an index was created along with its table
+// for a unique column, rather than by a CREATE INDEX
+func isAutoIndex(table *Table, index *Index) bool {
+	return table.Schema.Columns[index.Column].Unique && index.Name == autoIndexName(table.Schema, index.Column)
+}
+
+// constraintError describes a row that breaks the constraint of a unique
+// index
+func constraintError(table *Table, index *Index) *ConstraintError {
+	return &ConstraintError{Index: index.Name, Table: table.Schema.TableName, Column: table.Schema.Columns[index.Column].Name}
+}
+
+// indexKey returns the index key of a row. It fails if the key is too
+// long to be stored, which can only happen for TEXT and BLOB values.
+func indexKey(index *Index, row *Row) ([]byte, error) {
+	key, err := record.AppendKey(nil, row.Values[index.Column])
+	if err != nil {
+		return nil, err
+	}
+
+	key = append(key, row.Key...)
+	if len(key) > btree.INDEX_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("Value of row %s is too long for index %s", formatKey(row.Key), index.Name)
+	}
+
+	return key, nil
+}
+
+// splitIndexKey splits an index key into the encoded value and the key of
+// the row it points to. It fails if the key does not start with a value.
+func splitIndexKey(key []byte) ([]byte, []byte, error) {
+	_, n, err := record.DecodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key[:n], key[n:], nil
+}
+
+// indexKeyRow returns the key of the row an index key points to
+func indexKeyRow(key []byte) []byte {
+	_, rowKey, _ := splitIndexKey(key)
+	return rowKey
+}
+
+// sameIndexedValue reports whether two index keys hold the same value other
+// than NULL
+func sameIndexedValue(a []byte, b []byte) bool {
+	value, _, err := splitIndexKey(a)
+	return err == nil && value[0] != record.KEY_NULL && bytes.HasPrefix(b, value)
+}
+
+// indexValueFits reports whether a value is short enough to be indexed
+// along with a row key of keySize bytes
+func indexValueFits(value record.Value, keySize int) bool {
+	key, err := record.AppendKey(nil, value)
+	return err == nil && len(key)+keySize <= btree.INDEX_MAX_KEY_SIZE
+}
+
+// indexNodeSearch returns the first cell of an index node whose key is not
+// less than key, and whether it is equal
+func indexNodeSearch(node []byte, key []byte) (uint32, bool) {
+	minIdx := uint32(0)
+	maxIdx := btree.LeafNodeNumCells(node)
+	for minIdx != maxIdx {
+		idx := (minIdx + maxIdx) / 2
+		if bytes.Compare(btree.LeafNodeKey(node, idx), key) >= 0 {
+			maxIdx = idx
+		} else {
+			minIdx = idx + 1
+		}
+	}
+
+	found := minIdx < btree.LeafNodeNumCells(node) && bytes.Equal(btree.LeafNodeKey(node, minIdx), key)
+	return minIdx, found
+}
+
+// indexFind walks down an index to the leaf where key is or would be
+// inserted. It returns the internal nodes on the way, the leaf, the
+// position of key in it and whether key is there.
+func indexFind(pager *Pager, index *Index, key []byte) ([]indexStep, uint32, uint32, bool, error) {
+	var path []indexStep
+	pageNum := index.RootPageNum
+	for {
+		node, err := pager.getPage(pageNum)
+		if err != nil {
+			return nil, 0, 0, false, err
+		}
+
+		cellNum, found := indexNodeSearch(node, key)
+		switch btree.GetNodeType(node) {
+		case btree.NODE_INDEX_LEAF:
+			pager.unpinPage(pageNum)
+			return path, pageNum, cellNum, found, nil
+		case btree.NODE_INDEX_INTERNAL:
+			child := btree.InternalNodeChild(node, cellNum)
+			pager.unpinPage(pageNum)
+
+			path = append(path, indexStep{PageNum: pageNum, ChildNum: cellNum})
+			pageNum = child
+		default:
+			pager.unpinPage(pageNum)
+			return nil, 0, 0, false, fmt.Errorf("Page %d of index %s is not an index node", pageNum, index.Name)
+		}
+	}
+}
+
+// indexInsert adds a key to an index
+func indexInsert(pager *Pager, index *Index, key []byte) error {
+	path, pageNum, cellNum, found, err := indexFind(pager, index, key)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("Index %s already has an entry for row %s", index.Name, formatKey(indexKeyRow(key)))
+	}
+
+	return indexNodeInsertCell(pager, path, pageNum, cellNum, btree.NewIndexLeafCell(key))
+}
+
+// indexNodeInsertCell inserts a cell into a node of an index, splitting the
+// node if the cell does not fit. The cells are divided by size between the
+// node, which keeps the left half, and a new node to its right, which takes
+// the old node's place in the parent while the old node is added in front
+// of it. In an internal node, the child of the last cell of the left half
+// becomes the left node's right child and the key of that cell goes up to
+// the parent. The root stays on its page, so when it splits both halves
+// move to new nodes.
+func indexNodeInsertCell(pager *Pager, path []indexStep, pageNum uint32, cellNum uint32, cell []byte) error {
+	node, err := pager.getPageForWrite(pageNum)
+	if err != nil {
+		return err
+	}
+	defer pager.unpinPage(pageNum)
+
+	if btree.LeafNodeInsertCell(node, cellNum, cell) {
+		return nil
+	}
+
+	cells := slices.Insert(btree.LeafNodeCells(node), int(cellNum), cell)
+	splitIndex := leafCellsSplitIndex(cells)
+	left, right := cells[:splitIndex], cells[splitIndex:]
+
+	isLeaf := btree.GetNodeType(node) == btree.NODE_INDEX_LEAF
+	separator := btree.CellKey(left[len(left)-1])
+	rightNext := btree.LeafNodeNextLeaf(node)
+	var leftNext uint32
+	if !isLeaf {
+		leftNext = btree.InternalCellChild(left[len(left)-1])
+		left = left[:len(left)-1]
+	}
+
+	rightPageNum, err := newIndexNode(pager, isLeaf, right, rightNext)
+	if err != nil {
+		return err
+	}
+	if isLeaf {
+		leftNext = rightPageNum
+	}
+
+	if btree.IsNodeRoot(node) {
+		leftPageNum, err := newIndexNode(pager, isLeaf, left, leftNext)
+		if err != nil {
+			return err
+		}
+
+		btree.InitializeIndexInternalNode(node)
+		btree.SetNodeRoot(node, true)
+		btree.SetLeafNodeCells(node, [][]byte{btree.NewInternalNodeCell(separator, leftPageNum)})
+		btree.SetLeafNodeNextLeaf(node, rightPageNum)
+		return nil
+	}
+
+	btree.SetLeafNodeCells(node, left)
+	btree.SetLeafNodeNextLeaf(node, leftNext)
+
+	parent := path[len(path)-1]
+	parentNode, err := pager.getPageForWrite(parent.PageNum)
+	if err != nil {
+		return err
+	}
+	btree.SetInternalNodeChild(parentNode, parent.ChildNum, rightPageNum)
+	pager.unpinPage(parent.PageNum)
+
+	return indexNodeInsertCell(pager, path[:len(path)-1], parent.PageNum, parent.ChildNum, btree.NewInternalNodeCell(separator, pageNum))
+}
+
+// newIndexNode allocates an index node holding cells, with next as its next
+// leaf or, for an internal node, its right child
+func newIndexNode(pager *Pager, isLeaf bool, cells [][]byte, next uint32) (uint32, error) {
+	pageNum, err := getUnusedPageNum(pager)
+	if err != nil {
+		return 0, err
+	}
+	node, err := pager.getPageForWrite(pageNum)
+	if err != nil {
+		return 0, err
+	}
+	defer pager.unpinPage(pageNum)
+
+	if isLeaf {
+		btree.InitializeIndexLeafNode(node)
+	} else {
+		btree.InitializeIndexInternalNode(node)
+	}
+	btree.SetLeafNodeCells(node, cells)
+	btree.SetLeafNodeNextLeaf(node, next)
+
+	return pageNum, nil
+}
+
+// indexDelete removes a key from an index. Nodes are not merged when they
+// get less full, but a leaf that is left empty is unlinked from the leaves
+// and freed, along with any internal node that is left without children.
+// Keys in internal nodes may end up larger than the largest key under
+// their child, which is still a correct bound for searches.
+func indexDelete(pager *Pager, index *Index, key []byte) error {
+	path, pageNum, cellNum, found, err := indexFind(pager, index, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Index %s has no entry for row %s", index.Name, formatKey(indexKeyRow(key)))
+	}
+
+	node, err := pager.getPageForWrite(pageNum)
+	if err != nil {
+		return err
+	}
+	btree.LeafNodeRemoveCell(node, cellNum)
+	isEmpty := btree.LeafNodeNumCells(node) == 0 && !btree.IsNodeRoot(node)
+	nextLeaf := btree.LeafNodeNextLeaf(node)
+	pager.unpinPage(pageNum)
+
+	if !isEmpty {
+		return nil
+	}
+
+	previous, err := indexPreviousLeaf(pager, path)
+	if err != nil {
+		return err
+	}
+	if previous != 0 {
+		previousNode, err := pager.getPageForWrite(previous)
+		if err != nil {
+			return err
+		}
+		btree.SetLeafNodeNextLeaf(previousNode, nextLeaf)
+		pager.unpinPage(previous)
+	}
+
+	err = freePage(pager, pageNum)
+	if err != nil {
+		return err
+	}
+
+	return indexRemoveChild(pager, path)
+}
+
+// indexPreviousLeaf returns the leaf before the one path leads to, or 0
+// for the first leaf. It is the rightmost leaf under the child to the left
+// of the lowest step that did not take the first child.
+func indexPreviousLeaf(pager *Pager, path []indexStep) (uint32, error) {
+	i := len(path) - 1
+	for i >= 0 && path[i].ChildNum == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil
+	}
+
+	node, err := pager.getPage(path[i].PageNum)
+	if err != nil {
+		return 0, err
+	}
+	pageNum := btree.InternalNodeChild(node, path[i].ChildNum-1)
+	pager.unpinPage(path[i].PageNum)
+
+	for {
+		node, err := pager.getPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
+
+		if btree.GetNodeType(node) == btree.NODE_INDEX_LEAF {
+			pager.unpinPage(pageNum)
+			return pageNum, nil
+		}
+
+		rightChild := btree.LeafNodeNextLeaf(node)
+		pager.unpinPage(pageNum)
+		pageNum = rightChild
+	}
+}
+
+// indexRemoveChild removes the child the last step of path went to, which
+// has been freed, from its parent. A root left with a single child takes
+// over that child's contents, so the tree gets shorter, until the root has
+// keys again or is a leaf.
+func indexRemoveChild(pager *Pager, path []indexStep) error {
+	parent := path[len(path)-1]
+	node, err := pager.getPageForWrite(parent.PageNum)
+	if err != nil {
+		return err
+	}
+	defer pager.unpinPage(parent.PageNum)
+
+	numCells := btree.LeafNodeNumCells(node)
+	switch {
+	case parent.ChildNum < numCells:
+		btree.LeafNodeRemoveCell(node, parent.ChildNum)
+	case numCells > 0:
+		// The right child went, so the last child takes its place
+		lastChild := btree.InternalNodeChild(node, numCells-1)
+		btree.LeafNodeRemoveCell(node, numCells-1)
+		btree.SetLeafNodeNextLeaf(node, lastChild)
+	default:
+		// That was the only child, so the node goes too. The root always
+		// has keys, so this is not the root.
+		err = freePage(pager, parent.PageNum)
+		if err != nil {
+			return err
+		}
+		return indexRemoveChild(pager, path[:len(path)-1])
+	}
+
+	if !btree.IsNodeRoot(node) {
+		return nil
+	}
+
+	for btree.GetNodeType(node) == btree.NODE_INDEX_INTERNAL && btree.LeafNodeNumCells(node) == 0 {
+		childPageNum := btree.LeafNodeNextLeaf(node)
+		child, err := pager.getPage(childPageNum)
+		if err != nil {
+			return err
+		}
+		copy(node, child)
+		pager.unpinPage(childPageNum)
+		btree.SetNodeRoot(node, true)
+
+		err = freePage(pager, childPageNum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexScan calls visit with each key of an index from the first one not
+// less than low, in order, until visit returns false
+func indexScan(pager *Pager, index *Index, low []byte, visit func(key []byte) bool) error {
+	_, pageNum, cellNum, _, err := indexFind(pager, index, low)
+	if err != nil {
+		return err
+	}
+
+	for pageNum != 0 {
+		node, err := pager.getPage(pageNum)
+		if err != nil {
+			return err
+		}
+
+		var keys [][]byte
+		for ; cellNum < btree.LeafNodeNumCells(node); cellNum++ {
+			keys = append(keys, slices.Clone(btree.LeafNodeKey(node, cellNum)))
+		}
+		nextLeaf := btree.LeafNodeNextLeaf(node)
+		pager.unpinPage(pageNum)
+
+		for _, key := range keys {
+			if !visit(key) {
+				return nil
+			}
+		}
+
+		pageNum = nextLeaf
+		cellNum = 0
+	}
+
+	return nil
+}
+
+// insertIndexKeys adds a new row to every index of its table
+func insertIndexKeys(table *Table, row *Row) error {
+	for _, index := range table.Indexes {
+		key, err := indexKey(index, row)
+		if err != nil {
+			return err
+		}
+
+		err = indexInsert(table.Pager, index, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uniqueConflict returns the first unique index of the row's table that
+// already has another row with the row's value, and that row's key, or nil
+// if there is none. It is called before the row is written, so a statement
+// that breaks a constraint changes nothing.
+func uniqueConflict(table *Table, row *Row) (*Index, []byte, error) {
+	for _, index := range table.Indexes {
+		if !index.Unique || row.Values[index.Column] == nil {
+			continue
+		}
+
+		value, err := record.AppendKey(nil, row.Values[index.Column])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var conflict []byte
+		err = indexScan(table.Pager, index, value, func(key []byte) bool {
+			if !bytes.HasPrefix(key, value) {
+				return false
+			}
+			if !bytes.Equal(indexKeyRow(key), row.Key) {
+				conflict = slices.Clone(indexKeyRow(key))
+			}
+			return conflict == nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if conflict != nil {
+			return index, conflict, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// deleteIndexKeys removes a row from every index of its table
+func deleteIndexKeys(table *Table, row *Row) error {
+	for _, index := range table.Indexes {
+		key, err := indexKey(index, row)
+		if err != nil {
+			return err
+		}
+
+		err = indexDelete(table.Pager, index, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateIndexKeys moves a row whose values changed from old to row in every
+// index on a column that changed
+func updateIndexKeys(table *Table, old *Row, row *Row) error {
+	for _, index := range table.Indexes {
+		oldKey, err := indexKey(index, old)
+		if err != nil {
+			return err
+		}
+		key, err := indexKey(index, row)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(oldKey, key) {
+			continue
+		}
+
+		err = indexDelete(table.Pager, index, oldKey)
+		if err != nil {
+			return err
+		}
+		err = indexInsert(table.Pager, index, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanIndexRows calls visit with each row an index range points to that
+// meets the where condition, in key order or, if reverse is set, from the
+// highest key down, until visit returns false. The index lists the rows in
+// the order of their values, so their keys are collected and sorted first.
+func scanIndexRows(table *Table, indexRange *IndexRange, where parser.Expr, reverse bool, visit func(row *Row) bool) error {
+	var keys [][]byte
+	var keyErr error
+	err := indexScan(table.Pager, indexRange.Index, indexRange.Low, func(key []byte) bool {
+		var value, rowKey []byte
+		value, rowKey, keyErr = splitIndexKey(key)
+		if keyErr != nil {
+			return false
+		}
+		if indexRange.High != nil && bytes.Compare(value, indexRange.High) > 0 {
+			return false
+		}
+
+		keys = append(keys, rowKey)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if keyErr != nil {
+		return fmt.Errorf("Index %s has a malformed key: %v", indexRange.Index.Name, keyErr)
+	}
+
+	slices.SortFunc(keys, bytes.Compare)
+	if reverse {
+		slices.Reverse(keys)
+	}
+
+	for _, key := range keys {
+		row, err := findRow(table, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return fmt.Errorf("Index %s points to row %s, which does not exist", indexRange.Index.Name, formatKey(key))
+		}
+
+		if where == nil || isTrue(evalExpr(where, table.Schema, row)) {
+			if !visit(row) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// createIndex adds an index to the catalog and fills it with the rows
+// already in the table. Every row is checked to fit in the index, and for a
+// unique index no two rows may have the same value, before anything is
+// written. That returns a *ConstraintError.
+func createIndex(db *Database, table *Table, index *Index) error {
+	var keys [][]byte
+	var keyErr error
+	err := scanRows(table, KeyRange{}, nil, false, func(row *Row) bool {
+		var key []byte
+		key, keyErr = indexKey(index, row)
+		keys = append(keys, key)
+		return keyErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if keyErr != nil {
+		return keyErr
+	}
+
+	if index.Unique {
+		sorted := slices.Clone(keys)
+		slices.SortFunc(sorted, bytes.Compare)
+		for i := 1; i < len(sorted); i++ {
+			if sameIndexedValue(sorted[i-1], sorted[i]) {
+				return constraintError(table, index)
+			}
+		}
+	}
+
+	key, err := nextCatalogKey(db)
+	if err != nil {
+		return err
+	}
+
+	rootPageNum, err := getUnusedPageNum(db.Pager)
+	if err != nil {
+		return err
+	}
+
+	root, err := db.Pager.getPageForWrite(rootPageNum)
+	if err != nil {
+		return err
+	}
+	btree.InitializeIndexLeafNode(root)
+	btree.SetNodeRoot(root, true)
+	db.Pager.unpinPage(rootPageNum)
+
+	index.RootPageNum = rootPageNum
+	index.CatalogKey = key
+
+	result, err := insertRow(db.Catalog, catalogRow(key, "index", index.Name, rootPageNum, indexSQL(table, index)))
+	if err != nil {
+		return err
+	}
+	if result != EXECUTE_SUCCESS {
+		return fmt.Errorf("Catalog already has an entry %d", key)
+	}
+
+	for _, key := range keys {
+		err = indexInsert(db.Pager, index, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	table.Indexes = append(table.Indexes, index)
+	return nil
+}
+
+// findIndex returns the index with the given name on any table, or nil
+func findIndex(db *Database, name string) *Index {
+	for _, table := range db.Tables {
+		for _, index := range table.Indexes {
+			if index.Name == name {
+				return index
+			}
+		}
+	}
+
+	return nil
+}
+
+// whereIndexRange picks an index to find the rows a WHERE clause can match
+// with, for a clause that says nothing about the primary key. An index
+// whose column the clause asks to equal a value is preferred over one
+// whose column it only bounds. It returns nil if no index helps.
+func whereIndexRange(where parser.Expr, table *Table) *IndexRange {
+	var best *IndexRange
+	for _, index := range table.Indexes {
+		low, high, ok := whereValueRange(where, table.Schema.Columns[index.Column])
+		if !ok {
+			continue
+		}
+
+		indexRange := &IndexRange{Index: index, Low: low, High: high}
+		if low != nil && bytes.Equal(low, high) {
+			return indexRange
+		}
+		if best == nil {
+			best = indexRange
+		}
+	}
+
+	return best
+}
+
+// whereValueRange narrows the values of a column a WHERE clause can match
+// to a range of encoded values, in the same way whereKeyRange narrows
+// keys. Only literals of the column's own type are used, and a strict
+// comparison gives an inclusive range, since each row is checked against
+// the clause anyway. It returns false if the clause does not narrow the
+// column's values.
+func whereValueRange(where parser.Expr, column record.Column) ([]byte, []byte, bool) {
+	isColumn := func(expr parser.Expr) bool {
+		ref, ok := expr.(*parser.ColumnRef)
+		return ok && ref.Name == column.Name
+	}
+
+	// A bound below every encoded value except NULL, which no comparison
+	// matches
+	notNull := []byte{record.KEY_NULL + 1}
+
+	switch where := where.(type) {
+	case *parser.BinaryExpr:
+		if where.Op == "AND" {
+			leftLow, leftHigh, leftOk := whereValueRange(where.Left, column)
+			rightLow, rightHigh, rightOk := whereValueRange(where.Right, column)
+			switch {
+			case !leftOk:
+				return rightLow, rightHigh, rightOk
+			case !rightOk:
+				return leftLow, leftHigh, true
+			}
+			low, high := intersectValueRanges(leftLow, leftHigh, rightLow, rightHigh)
+			return low, high, true
+		}
+
+		// Put the column on the left, as in 'a' < name to name > 'a'
+		flipped := map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+		left, op, right := where.Left, where.Op, where.Right
+		if isColumn(right) && flipped[op] != "" {
+			left, op, right = right, flipped[op], left
+		}
+
+		value, ok := columnLiteral(right, column)
+		if !isColumn(left) || !ok {
+			return nil, nil, false
+		}
+
+		switch op {
+		case "=":
+			return value, value, true
+		case ">", ">=":
+			return value, nil, true
+		case "<", "<=":
+			return notNull, value, true
+		}
+	case *parser.BetweenExpr:
+		low, lowOk := columnLiteral(where.Low, column)
+		high, highOk := columnLiteral(where.High, column)
+		if isColumn(where.Expr) && !where.Not && lowOk && highOk {
+			return low, high, true
+		}
+	case *parser.InExpr:
+		if !isColumn(where.Expr) || where.Not {
+			return nil, nil, false
+		}
+
+		// The smallest range that holds every value in the list
+		var low, high []byte
+		for _, candidate := range where.Values {
+			value, ok := columnLiteral(candidate, column)
+			if !ok {
+				return nil, nil, false
+			}
+			if low == nil || bytes.Compare(value, low) < 0 {
+				low = value
+			}
+			if high == nil || bytes.Compare(value, high) > 0 {
+				high = value
+			}
+		}
+		return low, high, true
+	case *parser.IsNullExpr:
+		if !isColumn(where.Expr) {
+			return nil, nil, false
+		}
+		if where.Not {
+			return notNull, nil, true
+		}
+		null, _ := record.AppendKey(nil, nil)
+		return null, null, true
+	}
+
+	return nil, nil, false
+}
+
+// intersectValueRanges returns the values in both of two ranges of encoded
+// values, where a nil end is open
+func intersectValueRanges(aLow, aHigh, bLow, bHigh []byte) ([]byte, []byte) {
+	low, high := aLow, aHigh
+	if low == nil || (bLow != nil && bytes.Compare(bLow, low) > 0) {
+		low = bLow
+	}
+	if high == nil || (bHigh != nil && bytes.Compare(bHigh, high) < 0) {
+		high = bHigh
+	}
+	return low, high
+}
+
+// columnLiteral returns the encoded value of a literal of the column's
+// type. Integers are also accepted for real columns, as when storing them.
+func columnLiteral(expr parser.Expr, column record.Column) ([]byte, bool) {
+	literal, ok := expr.(*parser.Literal)
+	if !ok {
+		return nil, false
+	}
+
+	value, ok := literalConstant(literal)
+	if !ok {
+		return nil, false
+	}
+
+	switch v := value.(type) {
+	case int64:
+		if column.Type == record.COLUMN_REAL {
+			value = float64(v)
+		} else {
+			ok = column.Type == record.COLUMN_INTEGER
+		}
+	case float64:
+		ok = column.Type == record.COLUMN_REAL
+	case string:
+		ok = column.Type == record.COLUMN_TEXT
+	case []byte:
+		ok = column.Type == record.COLUMN_BLOB
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	key, err := record.AppendKey(nil, value)
+	return key, err == nil
+}
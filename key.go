@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"toydb/record"
+)
+
+// integerKey returns the key of the row with the given id in a table keyed
+// by a single INTEGER column, such as the catalog
+func integerKey(id int64) []byte {
+	key, _ := record.AppendKey(nil, id)
+	return key
+}
+
+// formatKey renders a row key for messages and .btree: a key of one value
+// as that value is printed in rows, and a key of several as a list of them
+// in parentheses. A key that cannot be decoded is shown in hex.
+func formatKey(key []byte) string {
+	var formatted []string
+	for rest := key; len(rest) > 0; {
+		value, n, err := record.DecodeKey(rest)
+		if err != nil {
+			return fmt.Sprintf("x'%x'", key)
+		}
+		formatted = append(formatted, formatValue(value))
+		rest = rest[n:]
+	}
+
+	if len(formatted) == 1 {
+		return formatted[0]
+	}
+	return "(" + strings.Join(formatted, ", ") + ")"
+}
+
+// isFull reports whether a key range covers every key
+func (r KeyRange) isFull() bool {
+	return r.Low == nil && r.High == nil
+}
+
+// isEmpty reports whether no key can be in a range
+func (r KeyRange) isEmpty() bool {
+	return r.Low != nil && r.High != nil && bytes.Compare(r.Low[:min(len(r.Low), len(r.High))], r.High) > 0
+}
+
+// isBelow reports whether a key comes before the range
+func (r KeyRange) isBelow(key []byte) bool {
+	return r.Low != nil && bytes.Compare(key, r.Low) < 0
+}
+
+// isAbove reports whether a key comes after the range. Only as much of the
+// key as High holds is compared, so keys that start with High are in the
+// range. An encoded value is never a prefix of another, so the value at
+// the start of a longer key cannot compare equal unless it is High.
+func (r KeyRange) isAbove(key []byte) bool {
+	return r.High != nil && bytes.Compare(key[:min(len(key), len(r.High))], r.High) > 0
+}
+
+// keyAfterPrefix returns the smallest key that is larger than every key
+// starting with prefix. Every encoded value starts with a tag below 0xFF, so
+// a key of 0xFF alone is larger than any row key and is what an empty
+// prefix gives.
+func keyAfterPrefix(prefix []byte) []byte {
+	key := bytes.Clone(prefix)
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] < 0xFF {
+			key[i]++
+			return key[:i+1]
+		}
+	}
+	return []byte{0xFF}
+}
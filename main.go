@@ -2,20 +2,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"flag"
 	"fmt"
-	"io"
+	"math"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"toydb/btree"
 	"toydb/constants"
-)
-
-// hardcoded DB
-const (
-	ID_OFFSET       = 0
-	USERNAME_OFFSET = ID_OFFSET + constants.ID_SIZE
-	EMAIL_OFFSET    = USERNAME_OFFSET + constants.COLUMN_USERNAME_SIZE
+	"toydb/header"
+	"toydb/parser"
+	"toydb/record"
 )
 
 type Cursor struct {
@@ -25,25 +25,30 @@ type Cursor struct {
 	EndOfTable bool // Indicates a position one past the last element
 }
 
-// Pager handles reading/writing pages to disk
-type Pager struct {
-	FileDescriptor *os.File
-	FileLength     int64
-	NumPages       uint32
-	Pages          [constants.TABLE_MAX_PAGES][]byte
-}
-
-// Row represents a single row in our table
+// Row represents a single row in our table, one value per column of the
+// table's schema. Key is the row's key in the table's B-tree, which the
+// schema builds from the values of its primary key columns.
 type Row struct {
-	ID       uint32
-	Username [constants.COLUMN_USERNAME_SIZE]byte
-	Email    [constants.COLUMN_EMAIL_SIZE]byte
+	Key    []byte
+	Values []record.Value
 }
 
 // Table represent our in-memory table structure
 type Table struct {
 	RootPageNum uint32
 	Pager       *Pager
+	Schema      *record.Schema
+	Catalog     *Table // Catalog that records RootPageNum, nil for the catalog itself
+	CatalogKey  uint32 // Key of the table's row in the catalog
+	Indexes     []*Index
+}
+
+// Database is an open database file: the catalog and every table it lists,
+// all sharing one pager
+type Database struct {
+	Pager   *Pager
+	Catalog *Table
+	Tables  map[string]*Table
 }
 
 // StatementType represents the type of SQL statement
@@ -52,14 +57,70 @@ type StatementType int
 const (
 	STATEMENT_INSERT StatementType = iota
 	STATEMENT_SELECT
+	STATEMENT_DELETE
+	STATEMENT_UPDATE
+	STATEMENT_BEGIN
+	STATEMENT_COMMIT
+	STATEMENT_ROLLBACK
+	STATEMENT_CREATE_TABLE
+	STATEMENT_CREATE_INDEX
 )
 
+// KeyRange is an inclusive range of keys, bounded by encoded values of the
+// first primary key column. Low is the smallest key in the range, and every
+// key that starts with High is in it too. A nil end leaves that side open,
+// so the zero KeyRange covers every key, and Low > High means the range is
+// empty.
+type KeyRange struct {
+	Low  []byte
+	High []byte
+}
+
+// OrderTerm is one expression a SELECT sorts its rows by
+type OrderTerm struct {
+	Expr       parser.Expr
+	Descending bool
+}
+
 // Statement holds a parsed SQL statement
 type Statement struct {
-	Type        StatementType
-	RowToInsert Row // Add this field to hold the row data for INSERT statements
+	Type           StatementType
+	TableName      string         // Table the statement works on
+	RowToInsert    Row            // Add this field to hold the row data for INSERT statements
+	KeysToScan     KeyRange       // Keys the WHERE clause of a SELECT or DELETE can match
+	IndexToScan    *IndexRange    // Index to find the rows of a SELECT or DELETE with, nil to scan KeysToScan
+	Where          parser.Expr    // Condition rows of a SELECT or DELETE must meet, nil for every row
+	Projection     []parser.Expr  // Values a SELECT prints for each row, nil for the whole row
+	Grouped        bool           // Whether a SELECT prints one row per group of rows
+	GroupBy        []parser.Expr  // Values rows of a group have in common, nil for a single group
+	Having         parser.Expr    // Condition groups must meet, nil for every group
+	Aggregates     []aggregate    // Aggregate functions a grouped SELECT works out for each group
+	OrderBy        []OrderTerm    // Sort order of a SELECT, nil for key order
+	Descending     bool           // Whether a SELECT in key order goes from the highest key down
+	Limit          int64          // Most rows a SELECT prints, -1 for no limit
+	Offset         int64          // Rows a SELECT skips before it starts printing
+	OnConflict     ConflictAction // What an INSERT does if the key of RowToInsert is taken
+	RowToUpdate    Row            // New column values for an UPDATE, Key selects the row
+	ColumnsToSet   []int          // Columns of RowToUpdate assigned by the UPDATE, or by an INSERT's DO UPDATE
+	SchemaToCreate *record.Schema // Table defined by a CREATE TABLE
+	IndexToCreate  *Index         // Index defined by a CREATE INDEX, on the table named by TableName
+	SyntaxError    error          // What is wrong with the statement if it does not prepare
+	Violation      error          // Constraint the statement broke if it fails with EXECUTE_UNIQUE_VIOLATION
+	Failure        error          // Why the statement stopped if it fails with EXECUTE_FAILED
 }
 
+// ConflictAction is what an INSERT does with a row whose key is already in
+// the table, or whose value for a unique index is
+type ConflictAction int
+
+const (
+	CONFLICT_ABORT   ConflictAction = iota // Fail with EXECUTE_DUPLICATE_KEY
+	CONFLICT_NOTHING                       // Leave the row with the key as it is
+	CONFLICT_IGNORE                        // Leave the table as it is if the key or a unique value is taken
+	CONFLICT_UPDATE                        // Set ColumnsToSet of the existing row from RowToUpdate
+	CONFLICT_REPLACE                       // Delete rows with the row's unique values and give the one with its key every value
+)
+
 // MetaCommandResult represents the result of executing a meta command
 type MetaCommandResult int
 
@@ -77,6 +138,8 @@ const (
 	PREPARE_NEGATIVE_ID
 	PREPARE_STRING_TOO_LONG
 	PREPARE_UNRECOGNIZED_STATEMENT
+	PREPARE_BAD_PRIMARY_KEY
+	PREPARE_NO_SUCH_TABLE
 )
 
 // ExecuteResult represents the result of executing a statement
@@ -85,7 +148,13 @@ type ExecuteResult int
 const (
 	EXECUTE_SUCCESS ExecuteResult = iota
 	EXECUTE_DUPLICATE_KEY
-	EXECUTE_TABLE_FULL
+	EXECUTE_UNIQUE_VIOLATION
+	EXECUTE_ROW_NOT_FOUND
+	EXECUTE_TRANSACTION_OPEN
+	EXECUTE_NO_TRANSACTION
+	EXECUTE_TABLE_EXISTS
+	EXECUTE_INDEX_EXISTS
+	EXECUTE_FAILED
 )
 
 type InputBuffer struct {
@@ -118,22 +187,28 @@ func tableStart(table *Table) (*Cursor, error) {
 
             numCells := btree.LeafNodeNumCells(node)
             cursor.EndOfTable = numCells == 0
+            table.Pager.unpinPage(pageNum)
 
             return cursor, nil
         }
 
         // It's an internal node, go to the leftmost child
-        pageNum = btree.InternalNodeChild(node, 0)
+        childPageNum := btree.InternalNodeChild(node, 0)
+        table.Pager.unpinPage(pageNum)
+        pageNum = childPageNum
     }
 }
 
-func tableFind(table *Table, key uint32) (*Cursor, error) {
+// tableFind returns a cursor at the row with the given key or, if there is
+// none, where it would be inserted
+func tableFind(table *Table, key []byte) (*Cursor, error) {
 	rootPageNum := table.RootPageNum
 	rootNode, err := table.Pager.getPage(rootPageNum)
 
 	if err != nil {
 		return nil, err
 	}
+	defer table.Pager.unpinPage(rootPageNum)
 
 	if btree.GetNodeType(rootNode) == btree.NODE_LEAF {
 		return leafNodeFind(table, rootPageNum, key)
@@ -142,12 +217,13 @@ func tableFind(table *Table, key uint32) (*Cursor, error) {
 	}
 }
 
-func internalNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
+func internalNodeFind(table *Table, pageNum uint32, key []byte) (*Cursor, error) {
 	node, err := table.Pager.getPage(pageNum)
 
 	if err != nil {
 		return nil, err
 	}
+	defer table.Pager.unpinPage(pageNum)
 
 	numKeys := btree.InternalNodeNumKeys(node)
 
@@ -157,7 +233,7 @@ func internalNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error)
 	for minIdx != maxIdx {
 		idx := (minIdx + maxIdx) / 2
 		keyToRight := btree.InternalNodeKey(node, idx)
-		if keyToRight >= key {
+		if bytes.Compare(keyToRight, key) >= 0 {
 			maxIdx = idx
 		} else {
 			minIdx = idx + 1
@@ -170,6 +246,7 @@ func internalNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error)
 	if err != nil {
 		return nil, err
 	}
+	defer table.Pager.unpinPage(childNum)
 
 	// Recursively search the child
     switch btree.GetNodeType(child) {
@@ -182,64 +259,236 @@ func internalNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error)
     }
 }
 
-// getUnusedPageNum returns the next available page number
-func getUnusedPageNum(pager *Pager) uint32 {
-	// For now, we just append to the end of the file
-	return pager.NumPages
+// setRootPage records a new root page for the table. The catalog's root is
+// kept in the file header and every other table's in its catalog row.
+func setRootPage(table *Table, pageNum uint32) error {
+	if table.Catalog != nil {
+		err := setCatalogRootPage(table, pageNum)
+		if err != nil {
+			return err
+		}
+
+		table.RootPageNum = pageNum
+		return nil
+	}
+
+	headerPage, err := table.Pager.getPageForWrite(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(header.HEADER_PAGE_NUM)
+
+	header.SetRootPage(headerPage, pageNum)
+	table.RootPageNum = pageNum
+
+	return nil
 }
 
-// getNodeMaxKey returns the max key in a node
-func getNodeMaxKey(node []byte) uint32 {
+// getNodeMaxKey returns a copy of the max key in the subtree rooted at
+// node. For an internal node that is the max key of its rightmost child.
+func getNodeMaxKey(pager *Pager, node []byte) ([]byte, error) {
 	switch btree.GetNodeType(node) {
 	case btree.NODE_INTERNAL:
-		numKeys := btree.InternalNodeNumKeys(node)
-		return btree.InternalNodeKey(node, numKeys-1)
+		rightChildPageNum := btree.InternalNodeRightChild(node)
+		rightChild, err := pager.getPage(rightChildPageNum)
+		if err != nil {
+			return nil, err
+		}
+		defer pager.unpinPage(rightChildPageNum)
+
+		return getNodeMaxKey(pager, rightChild)
 	case btree.NODE_LEAF:
 		numCells := btree.LeafNodeNumCells(node)
-		return btree.LeafNodeKey(node, numCells-1)
+		return bytes.Clone(btree.LeafNodeKey(node, numCells-1)), nil
 	default:
-		panic("Unknown node type")
+		return nil, fmt.Errorf("Unknown node type")
 	}
 }
 
+// createNewRoot handles splitting the root. The old root stays on its page
+// as the left child, and a newly allocated page becomes the root.
 func createNewRoot(table *Table, rightChildPageNum uint32) error {
-	root, err := table.Pager.getPage(table.RootPageNum)
+	leftChildPageNum := table.RootPageNum
+	leftChild, err := table.Pager.getPageForWrite(leftChildPageNum)
 	if err != nil {
 		return err
 	}
+	defer table.Pager.unpinPage(leftChildPageNum)
 
-	rightChild, err := table.Pager.getPage(rightChildPageNum)
+	rightChild, err := table.Pager.getPageForWrite(rightChildPageNum)
 	if err != nil {
 		return err
 	}
+	defer table.Pager.unpinPage(rightChildPageNum)
 
-	leftChildPageNum := getUnusedPageNum(table.Pager)
-	leftChild, err := table.Pager.getPage(leftChildPageNum)
+	rootPageNum, err := getUnusedPageNum(table.Pager)
+	if err != nil {
+		return err
+	}
+	root, err := table.Pager.getPageForWrite(rootPageNum)
 	if err != nil {
 		return err
 	}
+	defer table.Pager.unpinPage(rootPageNum)
 
-	// Left child has data copied from old root
-	copy(leftChild, root)
 	btree.SetNodeRoot(leftChild, false)
 
 	// Root node is a new internal node with one key and two children
 	btree.InitializeInternalNode(root)
 	btree.SetNodeRoot(root, true)
-	btree.SetInternalNodeNumKeys(root, 1)
-	btree.SetInternalNodeChild(root, 0, leftChildPageNum)
 
-	leftChildMaxKey := getNodeMaxKey(leftChild)
-	btree.SetInternalNodeKey(root, 0, leftChildMaxKey)
-	btree.SetInternalNodeRightChild(root, rightChildPageNum)
+	leftChildMaxKey, err := getNodeMaxKey(table.Pager, leftChild)
+	if err != nil {
+		return err
+	}
+	setInternalNodeEntries(root, []uint32{leftChildPageNum, rightChildPageNum}, [][]byte{leftChildMaxKey})
 
 	// Update parent pointers
-	setNodeParent(leftChild, table.RootPageNum)
-	setNodeParent(rightChild, table.RootPageNum)
+	setNodeParent(leftChild, rootPageNum)
+	setNodeParent(rightChild, rootPageNum)
+
+	return setRootPage(table, rootPageNum)
+}
+
+// internalNodeEntries returns the children (right child last) and copies of
+// the separator keys of an internal node
+func internalNodeEntries(node []byte) ([]uint32, [][]byte) {
+	numKeys := btree.InternalNodeNumKeys(node)
+	children := make([]uint32, 0, numKeys+1)
+	keys := make([][]byte, 0, numKeys)
+
+	for i := uint32(0); i < numKeys; i++ {
+		children = append(children, btree.InternalNodeChild(node, i))
+		keys = append(keys, bytes.Clone(btree.InternalNodeKey(node, i)))
+	}
+	children = append(children, btree.InternalNodeRightChild(node))
+
+	return children, keys
+}
+
+// setInternalNodeEntries overwrites the body of an internal node. children
+// must hold exactly one more entry than keys, and the keys must fit.
+func setInternalNodeEntries(node []byte, children []uint32, keys [][]byte) {
+	cells := make([][]byte, len(keys))
+	for i, key := range keys {
+		cells[i] = btree.NewInternalNodeCell(key, children[i])
+	}
+	btree.SetLeafNodeCells(node, cells)
+	btree.SetInternalNodeRightChild(node, children[len(keys)])
+}
 
+// internalNodeSize returns the bytes the cells of an internal node with the
+// given keys take, counting their cell pointers
+func internalNodeSize(keys [][]byte) uint32 {
+	size := uint32(0)
+	for _, key := range keys {
+		size += btree.LeafNodeCellSize(uint32(len(key)), btree.INTERNAL_NODE_CHILD_SIZE) + btree.LEAF_NODE_CELL_POINTER_SIZE
+	}
+	return size
+}
+
+// updateInternalNode replaces the entries of an internal node, splitting it
+// if they no longer fit, as a new child or a longer separator key can make
+// them
+func updateInternalNode(table *Table, pageNum uint32, children []uint32, keys [][]byte) error {
+	if internalNodeSize(keys) > btree.LEAF_NODE_SPACE_FOR_CELLS {
+		return internalNodeSplitAndInsert(table, pageNum, children, keys)
+	}
+
+	node, err := table.Pager.getPageForWrite(pageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(pageNum)
+
+	setInternalNodeEntries(node, children, keys)
 	return nil
 }
 
+// internalNodeInsert adds rightChildPageNum to the parent, directly after its
+// sibling leftChildPageNum. The left child's separator becomes leftMaxKey and
+// the right child inherits the separator the left child had before.
+func internalNodeInsert(table *Table, parentPageNum uint32, leftChildPageNum uint32, leftMaxKey []byte, rightChildPageNum uint32) error {
+	parent, err := table.Pager.getPage(parentPageNum)
+	if err != nil {
+		return err
+	}
+	children, keys := internalNodeEntries(parent)
+	table.Pager.unpinPage(parentPageNum)
+
+	index := slices.Index(children, leftChildPageNum)
+	if index < 0 {
+		return fmt.Errorf("Page %d is not a child of page %d", leftChildPageNum, parentPageNum)
+	}
+
+	children = slices.Insert(children, index+1, rightChildPageNum)
+	keys = slices.Insert(keys, index, leftMaxKey)
+
+	return updateInternalNode(table, parentPageNum, children, keys)
+}
+
+// internalKeysSplitIndex returns which key goes up to the parent when the
+// entries of an internal node are divided between two, so that each side
+// gets about half of the bytes
+func internalKeysSplitIndex(keys [][]byte) int {
+	cells := make([][]byte, len(keys))
+	for i, key := range keys {
+		cells[i] = btree.NewInternalNodeCell(key, 0)
+	}
+	return leafCellsSplitIndex(cells) - 1
+}
+
+// internalNodeSplitAndInsert divides an overfull set of entries between the
+// existing node and a new right sibling, then pushes the middle key up.
+func internalNodeSplitAndInsert(table *Table, pageNum uint32, children []uint32, keys [][]byte) error {
+	oldNode, err := table.Pager.getPageForWrite(pageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(pageNum)
+
+	newPageNum, err := getUnusedPageNum(table.Pager)
+	if err != nil {
+		return err
+	}
+	newNode, err := table.Pager.getPageForWrite(newPageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(newPageNum)
+
+	btree.InitializeInternalNode(newNode)
+	setNodeParent(newNode, nodeParent(oldNode))
+
+	// The key between the two halves is the max key of the left half, so it
+	// becomes the separator in the parent rather than staying in either node
+	splitIndex := internalKeysSplitIndex(keys)
+	separator := keys[splitIndex]
+
+	setInternalNodeEntries(oldNode, children[:splitIndex+1], keys[:splitIndex])
+	setInternalNodeEntries(newNode, children[splitIndex+1:], keys[splitIndex+1:])
+
+	for i, childPageNum := range children {
+		child, err := table.Pager.getPageForWrite(childPageNum)
+		if err != nil {
+			return err
+		}
+
+		if i <= splitIndex {
+			setNodeParent(child, pageNum)
+		} else {
+			setNodeParent(child, newPageNum)
+		}
+		table.Pager.unpinPage(childPageNum)
+	}
+
+	if btree.IsNodeRoot(oldNode) {
+		return createNewRoot(table, newPageNum)
+	}
+
+	return internalNodeInsert(table, nodeParent(oldNode), pageNum, separator, newPageNum)
+}
+
 // Node parent functions (we'll use these later)
 func nodeParent(node []byte) uint32 {
 	return binary.LittleEndian.Uint32(node[btree.PARENT_POINTER_OFFSET:])
@@ -249,12 +498,13 @@ func setNodeParent(node []byte, parent uint32) {
 	binary.LittleEndian.PutUint32(node[btree.PARENT_POINTER_OFFSET:], parent)
 }
 
-func leafNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
+func leafNodeFind(table *Table, pageNum uint32, key []byte) (*Cursor, error) {
 	node, err := table.Pager.getPage(pageNum)
 
 	if err != nil {
 		return nil, err
 	}
+	defer table.Pager.unpinPage(pageNum)
 
 	numCells := btree.LeafNodeNumCells(node)
 
@@ -268,14 +518,14 @@ func leafNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
 
 	for onePastMaxIndex != minIndex {
 		idx := (minIndex + onePastMaxIndex) / 2
-		keyAtIndex := btree.LeafNodeKey(node, idx)
+		c := bytes.Compare(key, btree.LeafNodeKey(node, idx))
 
-		if key == keyAtIndex {
+		if c == 0 {
 			cursor.CellNum = idx
 			return cursor, nil
 		}
 
-		if key < keyAtIndex {
+		if c < 0 {
 			onePastMaxIndex = idx
 		} else {
 			minIndex = idx + 1
@@ -286,14 +536,91 @@ func leafNodeFind(table *Table, pageNum uint32, key uint32) (*Cursor, error) {
 	return cursor, nil
 }
 
-// cursorValue returns a slice pointing to the position described by the cursor
+// cursorValue returns the value at the position described by the cursor,
+// reading the part that does not fit in its cell from overflow pages
 func cursorValue(cursor *Cursor) ([]byte, error) {
+	pager := cursor.Table.Pager
+	page, err := pager.getPage(cursor.PageNum)
+	if err != nil {
+		return nil, err
+	}
+
+	valueSize := btree.LeafNodeValueSize(page, cursor.CellNum)
+	value := slices.Clone(btree.LeafNodeLocalValue(page, cursor.CellNum))
+	overflowPageNum := btree.LeafNodeOverflowPage(page, cursor.CellNum)
+	pager.unpinPage(cursor.PageNum)
+
+	for pageNum := overflowPageNum; uint32(len(value)) < valueSize; {
+		if pageNum == 0 {
+			return nil, fmt.Errorf("Overflow chain of page %d ends %d bytes short", cursor.PageNum, valueSize-uint32(len(value)))
+		}
+
+		page, err := pager.getPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		if btree.GetNodeType(page) != btree.NODE_OVERFLOW {
+			pager.unpinPage(pageNum)
+			return nil, fmt.Errorf("Page %d in an overflow chain is not an overflow page", pageNum)
+		}
+
+		data := btree.OverflowPageData(page)
+		value = append(value, data[:min(valueSize-uint32(len(value)), uint32(len(data)))]...)
+		next := btree.OverflowPageNext(page)
+		pager.unpinPage(pageNum)
+
+		pageNum = next
+	}
+
+	return value, nil
+}
+
+// cursorRow decodes the row at the position described by the cursor
+func cursorRow(cursor *Cursor) (*Row, error) {
 	page, err := cursor.Table.Pager.getPage(cursor.PageNum)
 	if err != nil {
 		return nil, err
 	}
+	key := bytes.Clone(btree.LeafNodeKey(page, cursor.CellNum))
+	cursor.Table.Pager.unpinPage(cursor.PageNum)
+
+	value, err := cursorValue(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return deserializeRow(cursor.Table.Schema, key, value)
+}
+
+// cursorHasKey reports whether a cursor tableFind returned for key points
+// at a row with that key. The cursor is in the leaf that would hold key,
+// which is only the root while the tree has a single level, and may point
+// one past its last cell.
+func cursorHasKey(cursor *Cursor, key []byte) (bool, error) {
+	node, err := cursor.Table.Pager.getPage(cursor.PageNum)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Table.Pager.unpinPage(cursor.PageNum)
+
+	return cursor.CellNum < btree.LeafNodeNumCells(node) && bytes.Equal(btree.LeafNodeKey(node, cursor.CellNum), key), nil
+}
+
+// findRow returns the row with the given key, or nil if there is none
+func findRow(table *Table, key []byte) (*Row, error) {
+	cursor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
 
-	return btree.LeafNodeValue(page, cursor.CellNum), nil
+	found, err := cursorHasKey(cursor, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+	return cursorRow(cursor)
 }
 
 // cursorAdvance moves the cursor to the next row
@@ -304,6 +631,7 @@ func cursorAdvance(cursor *Cursor) error {
     if err != nil {
         return err
     }
+    defer cursor.Table.Pager.unpinPage(pageNum)
 
     cursor.CellNum++
     if cursor.CellNum >= btree.LeafNodeNumCells(node) {
@@ -322,174 +650,255 @@ func cursorAdvance(cursor *Cursor) error {
     return nil
 }
 
-// pagerOpen opens the database file and initializes the pager
-func pagerOpen(filename string) (*Pager, error) {
-	// Open file with read/write permissions, create if doesn't exist
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to open file: %v", err)
+// cursorRetreat moves the cursor to the previous row
+func cursorRetreat(cursor *Cursor) error {
+	if cursor.CellNum > 0 {
+		cursor.CellNum--
+		return nil
 	}
 
-	// Get file size
-	fileInfo, err := file.Stat()
+	pager := cursor.Table.Pager
+	node, err := pager.getPage(cursor.PageNum)
 	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("Unable to get file info: %v", err)
+		return err
 	}
+	firstKey := bytes.Clone(btree.LeafNodeKey(node, 0))
+	pager.unpinPage(cursor.PageNum)
 
-	fileLength := fileInfo.Size()
-	numPages := uint32(fileLength / constants.PAGE_SIZE)
-
-	if fileLength%constants.PAGE_SIZE != 0 {
-		file.Close()
-		return nil, fmt.Errorf("Db file is not a whole number of pages. Corrupt file.")
+	pageNum, err := previousLeaf(cursor.Table, firstKey)
+	if err != nil {
+		return err
 	}
-
-	pager := &Pager{
-		FileDescriptor: file,
-		FileLength:     fileLength,
-		NumPages:       numPages,
+	if pageNum == 0 {
+		cursor.EndOfTable = true
+		return nil
 	}
 
-	// Initialize all pages to nil
-	for i := 0; i < constants.TABLE_MAX_PAGES; i++ {
-		pager.Pages[i] = nil
+	node, err = pager.getPage(pageNum)
+	if err != nil {
+		return err
 	}
+	cursor.PageNum = pageNum
+	cursor.CellNum = btree.LeafNodeNumCells(node) - 1
+	pager.unpinPage(pageNum)
 
-	return pager, nil
+	return nil
 }
 
-// dbOpen opens a database connection
-func dbOpen(filename string) (*Table, error) {
-    pager, err := pagerOpen(filename)
-    if err != nil {
-        return nil, err
-    }
+// previousLeaf returns the leaf before the one that holds key, or 0 if that
+// is the first leaf. Leaves only link to the next one, so it searches down
+// from the root for key, remembering the child left of the last one the
+// search went into that has a left sibling, and then takes the rightmost
+// leaf under that child.
+func previousLeaf(table *Table, key []byte) (uint32, error) {
+	pageNum := table.RootPageNum
+	leftSibling := uint32(0)
+	for {
+		node, err := table.Pager.getPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
 
-    table := &Table{
-        Pager:       pager,
-        RootPageNum: 0,
-    }
+		if btree.GetNodeType(node) == btree.NODE_LEAF {
+			table.Pager.unpinPage(pageNum)
+			break
+		}
 
-    if pager.NumPages == 0 {
-        // New database file. Initialize page 0 as leaf node.
-        rootNode, err := pager.getPage(0)
-        if err != nil {
-            return nil, err
-        }
+		children, keys := internalNodeEntries(node)
+		table.Pager.unpinPage(pageNum)
 
-        btree.InitializeLeafNode(rootNode)
-        btree.SetNodeRoot(rootNode, true)
-    }
+		index, _ := slices.BinarySearchFunc(keys, key, bytes.Compare)
+		if index > 0 {
+			leftSibling = children[index-1]
+		}
+		pageNum = children[index]
+	}
+
+	for pageNum = leftSibling; pageNum != 0; {
+		node, err := table.Pager.getPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
+
+		if btree.GetNodeType(node) == btree.NODE_LEAF {
+			table.Pager.unpinPage(pageNum)
+			break
+		}
+
+		rightChild := btree.InternalNodeRightChild(node)
+		table.Pager.unpinPage(pageNum)
+		pageNum = rightChild
+	}
 
-    return table, nil
+	return pageNum, nil
 }
 
-func (p *Pager) getPage(pageNum uint32) ([]byte, error) {
-	if pageNum > constants.TABLE_MAX_PAGES {
-		return nil, fmt.Errorf("Tried to fetch page number out of bounds, %d > %d", pageNum, constants.TABLE_MAX_PAGES)
+// dbOpen opens a database connection and loads the catalog
+func dbOpen(filename string, cachePages int) (*Database, error) {
+	pager, err := pagerOpen(filename, cachePages, false)
+	if err != nil {
+		return nil, err
 	}
 
-	if p.Pages[pageNum] == nil {
-		// Cache miss, Allocate meemory and load from file
-		page := make([]byte, constants.PAGE_SIZE)
-		numPages := p.FileLength / constants.PAGE_SIZE
+	return dbLoad(pager)
+}
 
-		// We might have a partial page at the end of the file
-		if p.FileLength%constants.PAGE_SIZE != 0 {
-			numPages++
-		}
+// dbOpenReadOnly is dbOpen for a database that is only read, such as one
+// being checked. Neither the file nor its write-ahead log is written to.
+func dbOpenReadOnly(filename string, cachePages int) (*Database, error) {
+	pager, err := pagerOpen(filename, cachePages, true)
+	if err != nil {
+		return nil, err
+	}
 
-		if int64(pageNum) < numPages {
-			// Seek to the correct position in the file
-			_, err := p.FileDescriptor.Seek(int64(pageNum)*constants.PAGE_SIZE, 0)
-			if err != nil {
-				return nil, fmt.Errorf("Error seeking file: %v", err)
-			}
+	if pager.NumPages == 0 {
+		pager.pagerClose()
+		return nil, fmt.Errorf("File is not a toydb database")
+	}
 
-			// Read the page
-			bytesRead, err := p.FileDescriptor.Read(page)
-			if err != nil && err != io.EOF {
-				return nil, fmt.Errorf("Error reading file: %v", err)
-			}
+	return dbLoad(pager)
+}
 
-			// If we read less than a full page, that's okay
-			_ = bytesRead
+// dbLoad reads the header and the catalog of the database a pager has
+// opened, first setting up a new database if the file is empty
+func dbLoad(pager *Pager) (*Database, error) {
+	var err error
+	isNewFile := pager.NumPages == 0
+
+	// Check that the file is a toydb database before trusting its page
+	// checksums, so that other files are refused as such rather than
+	// reported as corrupt. A read-only pager may find the header in the
+	// log instead, whose frames are checked as they are read.
+	_, headerInLog := pager.Wal.frameFor(header.HEADER_PAGE_NUM)
+	if !isNewFile && !headerInLog {
+		rawHeader := make([]byte, header.HEADER_SIZE)
+		_, err = pager.FileDescriptor.ReadAt(rawHeader, 0)
+		if err == nil {
+			err = header.Validate(rawHeader)
+		}
+		if err != nil {
+			pager.pagerClose()
+			return nil, err
 		}
+	}
+
+	var headerPage []byte
+	if isNewFile {
+		_, headerPage, err = pager.allocatePage()
+	} else {
+		headerPage, err = pager.getPage(header.HEADER_PAGE_NUM)
+	}
+	if err != nil {
+		pager.pagerClose()
+		return nil, err
+	}
 
-		p.Pages[pageNum] = page
+	if isNewFile {
+		// New database file. Write the header and initialize page 1 as the
+		// root leaf node of the catalog.
+		header.Initialize(headerPage)
 
-		if pageNum >= p.NumPages {
-			p.NumPages = pageNum + 1
+		rootPageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			pager.unpinPage(header.HEADER_PAGE_NUM)
+			pager.pagerClose()
+			return nil, err
 		}
-	}
 
-	return p.Pages[pageNum], nil
-}
+		rootNode, err := pager.getPageForWrite(rootPageNum)
+		if err != nil {
+			pager.unpinPage(header.HEADER_PAGE_NUM)
+			pager.pagerClose()
+			return nil, err
+		}
 
-// pagerFlush writes a page to disk
-func (p *Pager) pagerFlush(pageNum uint32, size uint32) error {
-	if p.Pages[pageNum] == nil {
-		return fmt.Errorf("Tried to flush null page")
+		btree.InitializeLeafNode(rootNode)
+		btree.SetNodeRoot(rootNode, true)
+		header.SetRootPage(headerPage, rootPageNum)
+		pager.unpinPage(rootPageNum)
+	} else {
+		if header.PageCount(headerPage) != pager.NumPages {
+			err = fmt.Errorf("Header says %d pages but file has %d", header.PageCount(headerPage), pager.NumPages)
+		}
+		if err == nil && header.RootPage(headerPage) >= pager.NumPages {
+			err = fmt.Errorf("Root page %d is past the end of the file", header.RootPage(headerPage))
+		}
 	}
-
-	// Seek to the correct position
-	_, err := p.FileDescriptor.Seek(int64(pageNum)*constants.PAGE_SIZE, 0)
+	pager.unpinPage(header.HEADER_PAGE_NUM)
 	if err != nil {
-		return fmt.Errorf("Error seeking: %v", err)
+		pager.pagerClose()
+		return nil, err
+	}
+
+	db := &Database{
+		Pager:   pager,
+		Catalog: &Table{Pager: pager, Schema: catalogSchema()},
 	}
 
-	// Write the page
-	bytesWritten, err := p.FileDescriptor.Write(p.Pages[pageNum][:size])
+	err = loadCatalog(db)
 	if err != nil {
-		return fmt.Errorf("Error writing: %v", err)
+		pager.pagerClose()
+		return nil, err
 	}
 
-	if uint32(bytesWritten) != size {
-		return fmt.Errorf("Wrote %d bytes, expected %d", bytesWritten, size)
+	if isNewFile {
+		// Every database starts with the users table, and is committed
+		// straight away so a rollback has something to return to
+		err = createTable(db, defaultSchema())
+		if err == nil {
+			err = pager.commit()
+		}
+		if err != nil {
+			pager.pagerClose()
+			return nil, err
+		}
 	}
 
-	return nil
+	return db, nil
 }
 
-// dbClose flushes all pages to disk and closes the database
-func dbClose(table *Table) error {
-	pager := table.Pager
+// dbClose checkpoints every committed change into the database file and
+// closes the database. A transaction that is still open is rolled back.
+func dbClose(db *Database) error {
+	pager := db.Pager
 
-	// Flush all pages that are in memory
-	for i := uint32(0); i < pager.NumPages; i++ {
-		if pager.Pages[i] == nil {
-			continue
-		}
+	if pager.ReadOnly {
+		return pager.pagerClose()
+	}
 
-		err := pager.pagerFlush(i, constants.PAGE_SIZE)
+	if pager.InTransaction {
+		err := pager.rollback()
 		if err != nil {
 			return err
 		}
-
-		pager.Pages[i] = nil
 	}
 
-	// Close the file
-	err := pager.FileDescriptor.Close()
+	// Write back the pages that were modified
+	err := pager.Sync()
 	if err != nil {
-		return fmt.Errorf("Error closing db file: %v", err)
+		return err
 	}
 
-	return nil
+	// Close the file
+	return pager.pagerClose()
 }
 
-func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *Row) error {
-	oldNode, err := cursor.Table.Pager.getPage(cursor.PageNum)
+func leafNodeSplitAndInsert(cursor *Cursor, cell []byte) error {
+	oldNode, err := cursor.Table.Pager.getPageForWrite(cursor.PageNum)
 	if err != nil {
 		return err
 	}
+	defer cursor.Table.Pager.unpinPage(cursor.PageNum)
 
-	newPageNum := getUnusedPageNum(cursor.Table.Pager)
-	newNode, err := cursor.Table.Pager.getPage(newPageNum)
+	newPageNum, err := getUnusedPageNum(cursor.Table.Pager)
 	if err != nil {
 		return err
 	}
+	newNode, err := cursor.Table.Pager.getPageForWrite(newPageNum)
+	if err != nil {
+		return err
+	}
+	defer cursor.Table.Pager.unpinPage(newPageNum)
 
 	btree.InitializeLeafNode(newNode)
     setNodeParent(newNode, nodeParent(oldNode))
@@ -499,280 +908,1436 @@ func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *Row) error {
     btree.SetLeafNodeNextLeaf(oldNode, newPageNum)
     btree.SetLeafNodeNextLeaf(newNode, nextLeaf)
 
-	// All existing keys plus new key should be divided
-	// evenly between old (left) and new (right) nodes.
-	// Starting from the right, move each key to correct position.
-	for i := int32(btree.LEAF_NODE_MAX_CELLS); i >= 0; i-- {
-		var destinationNode []byte
-		if i >= int32(btree.LEAF_NODE_LEFT_SPLIT_COUNT) {
-			destinationNode = newNode
-		} else {
-			destinationNode = oldNode
-		}
-
-		indexWithinNode := uint32(i % int32(btree.LEAF_NODE_LEFT_SPLIT_COUNT))
-		destination := btree.LeafNodeCell(destinationNode, indexWithinNode)
-
-		if i == int32(cursor.CellNum) {
-			// This is where the new cell goes
-			btree.SetLeafNodeKey(destinationNode, indexWithinNode, key)
-			serializeRow(value, btree.LeafNodeValue(destinationNode, indexWithinNode))
-		} else if i > int32(cursor.CellNum) {
-			// Move existing cell
-			source := btree.LeafNodeCell(oldNode, uint32(i-1))
-			copy(destination, source)
-		} else {
-			// Move existing cell
-			source := btree.LeafNodeCell(oldNode, uint32(i))
-			copy(destination, source)
-		}
-	}
+	// All existing cells plus the new one are divided evenly by size
+	// between the old (left) and new (right) nodes
+	cells := btree.LeafNodeCells(oldNode)
+	cells = slices.Insert(cells, int(cursor.CellNum), cell)
 
-	// Update cell counts
-	btree.SetLeafNodeNumCells(oldNode, btree.LEAF_NODE_LEFT_SPLIT_COUNT)
-	btree.SetLeafNodeNumCells(newNode, btree.LEAF_NODE_RIGHT_SPLIT_COUNT)
+	splitIndex := leafCellsSplitIndex(cells)
+	btree.SetLeafNodeCells(oldNode, cells[:splitIndex])
+	btree.SetLeafNodeCells(newNode, cells[splitIndex:])
 
 	if btree.IsNodeRoot(oldNode) {
 		return createNewRoot(cursor.Table, newPageNum)
-	} else {
-		// We'll implement this in a later part
-		return fmt.Errorf("Need to implement updating parent after split")
 	}
-}
 
-func leafNodeInsert(cursor *Cursor, key uint32, value *Row) error {
-	node, err := cursor.Table.Pager.getPage(cursor.PageNum)
+	oldMaxKey, err := getNodeMaxKey(cursor.Table.Pager, oldNode)
 	if err != nil {
 		return err
 	}
 
-	numCells := btree.LeafNodeNumCells(node)
-	if numCells >= btree.LEAF_NODE_MAX_CELLS {
-		// Node full - split it
-		return leafNodeSplitAndInsert(cursor, key, value)
+	return internalNodeInsert(cursor.Table, nodeParent(oldNode), cursor.PageNum, oldMaxKey, newPageNum)
+}
+
+// leafCellsSplitIndex returns where to divide cells between two leaves so
+// that each gets about half of the bytes. Both sides get at least one cell.
+func leafCellsSplitIndex(cells [][]byte) int {
+	total := 0
+	for _, cell := range cells {
+		total += len(cell) + btree.LEAF_NODE_CELL_POINTER_SIZE
 	}
 
-	if cursor.CellNum < numCells {
-		// Make room for new cell
-		for i := numCells; i > cursor.CellNum; i-- {
-			destCell := btree.LeafNodeCell(node, i)
-			srcCell := btree.LeafNodeCell(node, i-1)
-			copy(destCell, srcCell)
+	used := 0
+	for i, cell := range cells[:len(cells)-1] {
+		used += len(cell) + btree.LEAF_NODE_CELL_POINTER_SIZE
+		if 2*used >= total {
+			return i + 1
 		}
 	}
 
-	btree.SetLeafNodeNumCells(node, numCells+1)
-	btree.SetLeafNodeKey(node, cursor.CellNum, key)
-	serializeRow(value, btree.LeafNodeValue(node, cursor.CellNum))
-
-	return nil
+	return len(cells) - 1
 }
 
-func serializeRow(source *Row, destination []byte) {
-	binary.LittleEndian.PutUint32(destination[ID_OFFSET:], source.ID)
+// leafCell builds the leaf cell for key and value, moving the part of the
+// value that does not fit in the cell to a new chain of overflow pages
+func leafCell(pager *Pager, key []byte, value []byte) ([]byte, error) {
+	if len(key) > btree.TABLE_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("Key of %d bytes is longer than the %d bytes allowed", len(key), btree.TABLE_MAX_KEY_SIZE)
+	}
 
-	copy(destination[USERNAME_OFFSET:], source.Username[:])
-	copy(destination[EMAIL_OFFSET:], source.Email[:])
-}
+	keySize, valueSize := uint32(len(key)), uint32(len(value))
+	localSize := btree.LeafNodeLocalValueSize(keySize, valueSize)
 
-func deserializeRow(source []byte, destination *Row) {
-	destination.ID = binary.LittleEndian.Uint32(source[ID_OFFSET:])
+	// Write the chain back to front, so each page can point to the next
+	var next uint32
+	spilled := value[localSize:]
+	for i := int(btree.OverflowPageCount(keySize, valueSize)) - 1; i >= 0; i-- {
+		pageNum, err := getUnusedPageNum(pager)
+		if err != nil {
+			return nil, err
+		}
+		page, err := pager.getPageForWrite(pageNum)
+		if err != nil {
+			return nil, err
+		}
 
-	copy(destination.Username[:], source[USERNAME_OFFSET:USERNAME_OFFSET+constants.COLUMN_USERNAME_SIZE])
-	copy(destination.Email[:], source[EMAIL_OFFSET:EMAIL_OFFSET+constants.COLUMN_EMAIL_SIZE])
-}
+		btree.InitializeOverflowPage(page)
+		btree.SetOverflowPageNext(page, next)
+		data := btree.OverflowPageData(page)
+		clear(data)
+		copy(data, spilled[i*len(data):])
+		pager.unpinPage(pageNum)
 
-func printRow(row *Row) {
-	username := strings.TrimRight(string(row.Username[:]), "\x00")
-	email := strings.TrimRight(string(row.Email[:]), "\x00")
-	fmt.Printf("(%d, %s, %s)\n", row.ID, username, email)
-}
+		next = pageNum
+	}
 
-func printPrompt() {
-	fmt.Print("db > ")
+	return btree.NewLeafNodeCell(key, valueSize, value[:localSize], next), nil
 }
 
-func (ib *InputBuffer) readInput(reader *bufio.Reader) error {
-	input, err := reader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("Error reading input: %v", err)
+// freeOverflowPages returns every page of the overflow chain starting at
+// pageNum to the free list
+func freeOverflowPages(pager *Pager, pageNum uint32) error {
+	for pageNum != 0 {
+		page, err := pager.getPage(pageNum)
+		if err != nil {
+			return err
+		}
+		next := btree.OverflowPageNext(page)
+		pager.unpinPage(pageNum)
+
+		err = freePage(pager, pageNum)
+		if err != nil {
+			return err
+		}
+		pageNum = next
 	}
 
-	// Remove the trailing newline
-	ib.buffer = strings.TrimRight(input, "\n\r")
 	return nil
 }
 
-func doMetaCommand(inputBuffer *InputBuffer, table *Table) MetaCommandResult {
-	switch inputBuffer.buffer {
-	case ".exit":
-		err := dbClose(table)
-		if err != nil {
-			fmt.Printf("Error closing database: %v\n", err)
-		}
+func leafNodeInsert(cursor *Cursor, key []byte, value *Row) error {
+	data, err := serializeRow(cursor.Table.Schema, value)
+	if err != nil {
+		return err
+	}
+
+	cell, err := leafCell(cursor.Table.Pager, key, data)
+	if err != nil {
+		return err
+	}
+
+	node, err := cursor.Table.Pager.getPageForWrite(cursor.PageNum)
+	if err != nil {
+		return err
+	}
+	defer cursor.Table.Pager.unpinPage(cursor.PageNum)
+
+	if !btree.LeafNodeInsertCell(node, cursor.CellNum, cell) {
+		// Node full - split it
+		return leafNodeSplitAndInsert(cursor, cell)
+	}
+
+	return nil
+}
+
+// leafNodeDelete removes the cell under the cursor and rebalances the tree
+// if the leaf drops below its minimum fill
+func leafNodeDelete(cursor *Cursor) error {
+	table := cursor.Table
+	node, err := table.Pager.getPageForWrite(cursor.PageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(cursor.PageNum)
+
+	err = freeOverflowPages(table.Pager, btree.LeafNodeOverflowPage(node, cursor.CellNum))
+	if err != nil {
+		return err
+	}
+
+	numCells := btree.LeafNodeNumCells(node)
+	btree.LeafNodeRemoveCell(node, cursor.CellNum)
+
+	if btree.IsNodeRoot(node) {
+		return nil
+	}
+
+	if cursor.CellNum == numCells-1 && numCells > 1 {
+		// We removed the max key, so the separators above are stale
+		err = updateSeparators(table, cursor.PageNum)
+		if err != nil {
+			return err
+		}
+	}
+
+	if btree.LeafNodeUsedSpace(node) < btree.LEAF_NODE_MIN_USED_SPACE {
+		return rebalanceNode(table, cursor.PageNum)
+	}
+
+	return nil
+}
+
+// updateSeparators rewrites the separator keys above a node after its max
+// key changed. Walks up while the node is the right child of its parent,
+// since only then does the parent's max change too. Keys vary in length,
+// so a parent can split when its separator is replaced.
+func updateSeparators(table *Table, pageNum uint32) error {
+	node, err := table.Pager.getPage(pageNum)
+	if err != nil {
+		return err
+	}
+
+	maxKey, err := getNodeMaxKey(table.Pager, node)
+	if err != nil {
+		table.Pager.unpinPage(pageNum)
+		return err
+	}
+
+	for !btree.IsNodeRoot(node) {
+		parentPageNum := nodeParent(node)
+		table.Pager.unpinPage(pageNum)
+
+		parent, err := table.Pager.getPage(parentPageNum)
+		if err != nil {
+			return err
+		}
+
+		children, keys := internalNodeEntries(parent)
+		index := slices.Index(children, pageNum)
+		if index < 0 {
+			table.Pager.unpinPage(parentPageNum)
+			return fmt.Errorf("Page %d is not a child of page %d", pageNum, parentPageNum)
+		}
+
+		if index < len(keys) {
+			table.Pager.unpinPage(parentPageNum)
+			keys[index] = maxKey
+			return updateInternalNode(table, parentPageNum, children, keys)
+		}
+
+		pageNum = parentPageNum
+		node = parent
+	}
+
+	table.Pager.unpinPage(pageNum)
+	return nil
+}
+
+// rebalanceNode fixes an underfull non-root node by merging it with a
+// sibling, or by borrowing from the sibling when both will not fit in one
+// page. Merges can leave the parent underfull, in which case it is
+// rebalanced in turn.
+func rebalanceNode(table *Table, pageNum uint32) error {
+	node, err := table.Pager.getPage(pageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(pageNum)
+
+	parentPageNum := nodeParent(node)
+	parent, err := table.Pager.getPageForWrite(parentPageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(parentPageNum)
+
+	children, keys := internalNodeEntries(parent)
+	index := slices.Index(children, pageNum)
+	if index < 0 {
+		return fmt.Errorf("Page %d is not a child of page %d", pageNum, parentPageNum)
+	}
+
+	// Pair the node with its left sibling, or its right one if it has none
+	leftIndex := index
+	if index > 0 {
+		leftIndex = index - 1
+	}
+
+	var merged bool
+	var separator []byte
+	if btree.GetNodeType(node) == btree.NODE_LEAF {
+		merged, separator, err = rebalanceLeaves(table, parent, leftIndex)
+	} else {
+		merged, separator, err = rebalanceInternalNodes(table, parent, leftIndex)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !merged {
+		// The pair was evened out, which gave the left node a new max key
+		keys[leftIndex] = separator
+		return updateInternalNode(table, parentPageNum, children, keys)
+	}
+
+	// The right node of the pair is gone, and the left node takes over its
+	// separator
+	err = freePage(table.Pager, children[leftIndex+1])
+	if err != nil {
+		return err
+	}
+
+	children = slices.Delete(children, leftIndex+1, leftIndex+2)
+	keys = slices.Delete(keys, leftIndex, leftIndex+1)
+	setInternalNodeEntries(parent, children, keys)
+
+	if btree.IsNodeRoot(parent) {
+		if len(keys) == 0 {
+			return shrinkRoot(table)
+		}
+		return nil
+	}
+
+	if btree.LeafNodeUsedSpace(parent) < btree.LEAF_NODE_MIN_USED_SPACE {
+		return rebalanceNode(table, parentPageNum)
+	}
+
+	return nil
+}
+
+// rebalanceLeaves evens out the leaves at leftIndex and leftIndex+1 of
+// parent. Returns true if the right leaf was merged into the left one, and
+// otherwise the new max key of the left leaf.
+func rebalanceLeaves(table *Table, parent []byte, leftIndex int) (bool, []byte, error) {
+	leftPageNum := btree.InternalNodeChild(parent, uint32(leftIndex))
+	rightPageNum := btree.InternalNodeChild(parent, uint32(leftIndex+1))
+
+	left, err := table.Pager.getPageForWrite(leftPageNum)
+	if err != nil {
+		return false, nil, err
+	}
+	defer table.Pager.unpinPage(leftPageNum)
+
+	right, err := table.Pager.getPageForWrite(rightPageNum)
+	if err != nil {
+		return false, nil, err
+	}
+	defer table.Pager.unpinPage(rightPageNum)
+
+	cells := append(btree.LeafNodeCells(left), btree.LeafNodeCells(right)...)
+
+	if btree.LeafNodeUsedSpace(left)+btree.LeafNodeUsedSpace(right) <= btree.LEAF_NODE_SPACE_FOR_CELLS {
+		// Merge: the left leaf takes every cell and the right one leaves
+		// the chain
+		btree.SetLeafNodeCells(left, cells)
+		btree.SetLeafNodeNextLeaf(left, btree.LeafNodeNextLeaf(right))
+		return true, nil, nil
+	}
+
+	// Borrow: split the cells evenly by size. The right leaf keeps its max
+	// key, so only the separator of the left one changes.
+	splitIndex := leafCellsSplitIndex(cells)
+	btree.SetLeafNodeCells(left, cells[:splitIndex])
+	btree.SetLeafNodeCells(right, cells[splitIndex:])
+
+	return false, bytes.Clone(btree.CellKey(cells[splitIndex-1])), nil
+}
+
+// rebalanceInternalNodes evens out the internal nodes at leftIndex and
+// leftIndex+1 of parent, pulling their separator down between them. Returns
+// true if the right node was merged into the left one, and otherwise the
+// key that goes up to become their separator.
+func rebalanceInternalNodes(table *Table, parent []byte, leftIndex int) (bool, []byte, error) {
+	leftPageNum := btree.InternalNodeChild(parent, uint32(leftIndex))
+	rightPageNum := btree.InternalNodeChild(parent, uint32(leftIndex+1))
+
+	left, err := table.Pager.getPageForWrite(leftPageNum)
+	if err != nil {
+		return false, nil, err
+	}
+	defer table.Pager.unpinPage(leftPageNum)
+
+	right, err := table.Pager.getPageForWrite(rightPageNum)
+	if err != nil {
+		return false, nil, err
+	}
+	defer table.Pager.unpinPage(rightPageNum)
+
+	leftChildren, leftKeys := internalNodeEntries(left)
+	rightChildren, rightKeys := internalNodeEntries(right)
+
+	children := append(leftChildren, rightChildren...)
+	keys := append(append(leftKeys, bytes.Clone(btree.InternalNodeKey(parent, uint32(leftIndex)))), rightKeys...)
+
+	merged := internalNodeSize(keys) <= btree.LEAF_NODE_SPACE_FOR_CELLS
+	splitIndex := len(children)
+	var separator []byte
+	if merged {
+		setInternalNodeEntries(left, children, keys)
+	} else {
+		// The key between the two halves moves up to become the separator
+		splitIndex = internalKeysSplitIndex(keys)
+		setInternalNodeEntries(left, children[:splitIndex+1], keys[:splitIndex])
+		setInternalNodeEntries(right, children[splitIndex+1:], keys[splitIndex+1:])
+		separator = keys[splitIndex]
+	}
+
+	for i, childPageNum := range children {
+		child, err := table.Pager.getPageForWrite(childPageNum)
+		if err != nil {
+			return false, nil, err
+		}
+
+		if i <= splitIndex {
+			setNodeParent(child, leftPageNum)
+		} else {
+			setNodeParent(child, rightPageNum)
+		}
+		table.Pager.unpinPage(childPageNum)
+	}
+
+	return merged, separator, nil
+}
+
+// shrinkRoot replaces an internal root that has a single child with that
+// child, reducing the height of the tree by one
+func shrinkRoot(table *Table) error {
+	oldRootPageNum := table.RootPageNum
+	root, err := table.Pager.getPage(oldRootPageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(oldRootPageNum)
+
+	childPageNum := btree.InternalNodeRightChild(root)
+	child, err := table.Pager.getPageForWrite(childPageNum)
+	if err != nil {
+		return err
+	}
+	defer table.Pager.unpinPage(childPageNum)
+
+	btree.SetNodeRoot(child, true)
+
+	err = setRootPage(table, childPageNum)
+	if err != nil {
+		return err
+	}
+
+	return freePage(table.Pager, oldRootPageNum)
+}
+
+// serializeRow encodes a row as the record stored as a leaf cell's value
+func serializeRow(schema *record.Schema, source *Row) ([]byte, error) {
+	return record.Encode(schema, source.Values)
+}
+
+func deserializeRow(schema *record.Schema, key []byte, source []byte) (*Row, error) {
+	values, err := record.Decode(schema, key, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Row{Key: key, Values: values}, nil
+}
+
+func formatValue(value record.Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		// Keep a decimal point so reals are told apart from integers
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+	case string:
+		return v
+	case []byte:
+		return fmt.Sprintf("x'%x'", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// printSchema prints the statements that define a table and its indexes.
+// The indexes of unique columns come with the table.
+func printSchema(table *Table) {
+	fmt.Println(table.Schema.SQL())
+	for _, index := range table.Indexes {
+		if !isAutoIndex(table, index) {
+			fmt.Println(indexSQL(table, index))
+		}
+	}
+}
+
+func printRow(row *Row) {
+	printValues(row.Values)
+}
+
+func printValues(values []record.Value) {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = formatValue(value)
+	}
+	fmt.Printf("(%s)\n", strings.Join(formatted, ", "))
+}
+
+func printPrompt() {
+	fmt.Print("db > ")
+}
+
+func (ib *InputBuffer) readInput(reader *bufio.Reader) error {
+	input, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Error reading input: %v", err)
+	}
+
+	// Remove the trailing newline
+	ib.buffer = strings.TrimRight(input, "\n\r")
+	return nil
+}
+
+func doMetaCommand(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	// .btree and .schema take an optional table name
+	command, tableName, hasTableName := strings.Cut(inputBuffer.buffer, " ")
+	if hasTableName && command != ".btree" && command != ".schema" {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+
+	switch command {
+	case ".exit":
+		err := dbClose(db)
+		if err != nil {
+			fmt.Printf("Error closing database: %v\n", err)
+		}
 		fmt.Println("Bye!")
 		os.Exit(0)
 		return META_COMMAND_UNRECOGNIZED_COMMAND
 	case ".btree":
+		if !hasTableName {
+			tableName = DEFAULT_TABLE_NAME
+		}
+
+		table, ok := db.Tables[tableName]
+		if !ok {
+			fmt.Printf("No such table '%s'.\n", tableName)
+			return META_COMMAND_SUCCESS
+		}
+
 		fmt.Println("Tree:")
-		err := printTree(table.Pager, 0, 0)
+		err := printTree(db.Pager, table.RootPageNum, 0)
+		if err != nil {
+			fmt.Printf("Error printing tree: %v\n", err)
+		}
+		return META_COMMAND_SUCCESS
+	case ".tables":
+		for _, name := range tableNames(db) {
+			fmt.Println(name)
+		}
+		return META_COMMAND_SUCCESS
+	case ".schema":
+		if !hasTableName {
+			for _, name := range tableNames(db) {
+				printSchema(db.Tables[name])
+			}
+			return META_COMMAND_SUCCESS
+		}
+
+		table, ok := db.Tables[tableName]
+		if !ok {
+			fmt.Printf("No such table '%s'.\n", tableName)
+			return META_COMMAND_SUCCESS
+		}
+		printSchema(table)
+		return META_COMMAND_SUCCESS
+	case ".sync":
+		err := db.Pager.Sync()
+		if err != nil {
+			fmt.Printf("Error syncing database: %v\n", err)
+		}
+		return META_COMMAND_SUCCESS
+	case ".dbinfo":
+		err := printDbInfo(db.Pager)
+		if err != nil {
+			fmt.Printf("Error reading header: %v\n", err)
+		}
+		return META_COMMAND_SUCCESS
+	case ".check":
+		printIntegrityReport(db)
+		return META_COMMAND_SUCCESS
+	case ".constants":
+		fmt.Println("Constants:")
+		printConstants()
+		return META_COMMAND_SUCCESS
+	default:
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+}
+
+func executeInsert(statement *Statement, table *Table) ExecuteResult {
+	rowToInsert := &statement.RowToInsert
+
+	result, err := upsertRow(table, rowToInsert, statement.OnConflict, &statement.RowToUpdate, statement.ColumnsToSet)
+	if result == EXECUTE_UNIQUE_VIOLATION {
+		statement.Violation = err
+		return result
+	}
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	return result
+}
+
+// insertRow adds a row to the table and its indexes unless its key is
+// already there, or its value for a unique index is. The latter fails with
+// EXECUTE_UNIQUE_VIOLATION and a *ConstraintError.
+func insertRow(table *Table, row *Row) (ExecuteResult, error) {
+	return upsertRow(table, row, CONFLICT_ABORT, nil, nil)
+}
+
+// upsertRow inserts a row as insertRow does, except that if its key is
+// taken it does what onConflict says to the row that has it, which the
+// search for the new row's place has already found. CONFLICT_UPDATE sets
+// the given columns from update, and CONFLICT_REPLACE sets every column
+// from row after deleting any other rows that share a unique value with it.
+// CONFLICT_IGNORE skips the row if its key or any unique value is taken.
+func upsertRow(table *Table, row *Row, onConflict ConflictAction, update *Row, columns []int) (ExecuteResult, error) {
+	if onConflict == CONFLICT_REPLACE {
+		err := deleteUniqueConflicts(table, row)
+		if err != nil {
+			return EXECUTE_FAILED, err
+		}
+	}
+
+	cursor, err := tableFind(table, row.Key)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	isDuplicate, err := cursorHasKey(cursor, row.Key)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+	if isDuplicate {
+		switch onConflict {
+		case CONFLICT_NOTHING, CONFLICT_IGNORE:
+			return EXECUTE_SUCCESS, nil
+		case CONFLICT_UPDATE:
+			return updateRowAt(cursor, update, columns)
+		case CONFLICT_REPLACE:
+			var allColumns []int
+			for column := range row.Values {
+				if !table.Schema.IsPrimaryKey(column) {
+					allColumns = append(allColumns, column)
+				}
+			}
+			return updateRowAt(cursor, row, allColumns)
+		default:
+			return EXECUTE_DUPLICATE_KEY, nil
+		}
+	}
+
+	conflict, _, err := uniqueConflict(table, row)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+	if conflict != nil && onConflict == CONFLICT_IGNORE {
+		return EXECUTE_SUCCESS, nil
+	}
+	if conflict != nil {
+		return EXECUTE_UNIQUE_VIOLATION, constraintError(table, conflict)
+	}
+
+	err = leafNodeInsert(cursor, row.Key, row)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	err = insertIndexKeys(table, row)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	return EXECUTE_SUCCESS, nil
+}
+
+// executeSelect prints the rows that meet the where clause, or a row for
+// each group of them. Rows in key order, forward or reverse, are printed as
+// the scan reaches them and the scan stops once LIMIT is reached; any other
+// order is sorted in memory.
+func executeSelect(statement *Statement, table *Table) ExecuteResult {
+	if statement.Limit == 0 {
+		return EXECUTE_SUCCESS
+	}
+
+	// emit prints a row unless OFFSET skips it, and reports whether LIMIT
+	// leaves room for more
+	skipped, printed := int64(0), int64(0)
+	emit := func(row *Row) bool {
+		if skipped < statement.Offset {
+			skipped++
+			return true
+		}
+
+		printSelected(statement, table.Schema, row)
+		printed++
+		return statement.Limit < 0 || printed < statement.Limit
+	}
+
+	// selectRows calls visit with each row to print, before sorting
+	selectRows := func(visit func(row *Row) bool) error {
+		if statement.Grouped {
+			return groupRows(statement, table, visit)
+		}
+		return scanWhere(statement, table, statement.Descending, visit)
+	}
+
+	if statement.OrderBy == nil {
+		err := selectRows(emit)
+		if err != nil {
+			statement.Failure = err
+			return EXECUTE_FAILED
+		}
+		return EXECUTE_SUCCESS
+	}
+
+	var rows []sortedRow
+	err := selectRows(func(row *Row) bool {
+		keys := make([]record.Value, len(statement.OrderBy))
+		for i, term := range statement.OrderBy {
+			keys[i] = evalExpr(term.Expr, table.Schema, row)
+		}
+		rows = append(rows, sortedRow{row: row, keys: keys})
+		return true
+	})
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	sortRows(rows, statement.OrderBy)
+	for _, row := range rows {
+		if !emit(row.row) {
+			break
+		}
+	}
+
+	return EXECUTE_SUCCESS
+}
+
+// sortedRow is a row with the values of the ORDER BY terms it sorts by
+type sortedRow struct {
+	row  *Row
+	keys []record.Value
+}
+
+// sortRows sorts rows by their ORDER BY values, NULL first in ascending
+// order. Rows that tie stay in the order they were found.
+func sortRows(rows []sortedRow, orderBy []OrderTerm) {
+	slices.SortStableFunc(rows, func(a, b sortedRow) int {
+		for i, term := range orderBy {
+			c := compareValues(a.keys[i], b.keys[i])
+			if term.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+// group is a group of rows in a grouped select: the first of them, whose
+// columns are printed where the select names them outside an aggregate, as
+// in SQLite, and the aggregates worked out over all of them
+type group struct {
+	row          *Row
+	accumulators []accumulator
+}
+
+func newGroup(statement *Statement, row *Row) *group {
+	return &group{row: row, accumulators: make([]accumulator, len(statement.Aggregates))}
+}
+
+// groupRows calls visit with a row for each group that meets the HAVING
+// clause, holding the columns of the group's first row followed by the
+// values of its aggregates
+func groupRows(statement *Statement, table *Table, visit func(row *Row) bool) error {
+	groups, err := fastAggregates(statement, table)
+	if err != nil {
+		return err
+	}
+
+	if groups == nil {
+		groups, err = scanGroups(statement, table)
 		if err != nil {
-			fmt.Printf("Error printing tree: %v\n", err)
+			return err
 		}
-		return META_COMMAND_SUCCESS
-	case ".constants":
-		fmt.Println("Constants:")
-		printConstants()
-		return META_COMMAND_SUCCESS
-	default:
-		return META_COMMAND_UNRECOGNIZED_COMMAND
 	}
-}
 
-func prepareInsert(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
-	statement.Type = STATEMENT_INSERT
+	for _, group := range groups {
+		row := &Row{Key: group.row.Key, Values: slices.Clone(group.row.Values)}
+		for i, function := range statement.Aggregates {
+			row.Values = append(row.Values, group.accumulators[i].result(function))
+		}
 
-	tokens := strings.Fields(inputBuffer.buffer)
+		if statement.Having != nil && !isTrue(evalExpr(statement.Having, table.Schema, row)) {
+			continue
+		}
 
-	if len(tokens) < 4 {
-		return PREPARE_SYNTAX_ERROR
+		if !visit(row) {
+			return nil
+		}
 	}
 
-	var id int
+	return nil
+}
+
+// scanGroups sorts the rows that meet the where clause into groups by
+// their GROUP BY values, using a hash table, and works out the aggregates
+// of each group as it goes. Groups are returned in the order their first
+// rows were found. Without GROUP BY all the rows form one group, even if
+// there are none.
+func scanGroups(statement *Statement, table *Table) ([]*group, error) {
+	var groups []*group
+	groupsByKey := map[string]*group{}
+	values := make([]record.Value, len(statement.GroupBy))
+
+	err := scanWhere(statement, table, false, func(row *Row) bool {
+		for i, expr := range statement.GroupBy {
+			values[i] = evalExpr(expr, table.Schema, row)
+		}
 
-	_, err := fmt.Sscanf(tokens[1], "%d", &id)
+		key := groupKey(values)
+		g, ok := groupsByKey[key]
+		if !ok {
+			g = newGroup(statement, row)
+			groupsByKey[key] = g
+			groups = append(groups, g)
+		}
 
+		for i, function := range statement.Aggregates {
+			var value record.Value
+			if function.Arg != nil {
+				value = evalExpr(function.Arg, table.Schema, row)
+			}
+			g.accumulators[i].add(function, value)
+		}
+		return true
+	})
 	if err != nil {
-		return PREPARE_SYNTAX_ERROR
+		return nil, err
+	}
+
+	if len(groups) == 0 && statement.GroupBy == nil {
+		groups = append(groups, newGroup(statement, &Row{Values: make([]record.Value, len(table.Schema.Columns))}))
 	}
 
-	if id < 0 {
-		return PREPARE_NEGATIVE_ID
+	return groups, nil
+}
+
+// groupKey encodes the GROUP BY values of a row as a string that is the
+// same for every row of its group. Numbers that are equal go in the same
+// group whether they are integers or reals, and NULLs go together.
+func groupKey(values []record.Value) string {
+	var key strings.Builder
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			key.WriteString("n;")
+		case int64:
+			fmt.Fprintf(&key, "i%d;", value)
+		case float64:
+			if value == math.Trunc(value) && math.Abs(value) < math.MaxInt64 {
+				fmt.Fprintf(&key, "i%d;", int64(value))
+			} else {
+				fmt.Fprintf(&key, "r%v;", value)
+			}
+		case string:
+			fmt.Fprintf(&key, "t%d:%s", len(value), value)
+		case []byte:
+			fmt.Fprintf(&key, "b%d:%s", len(value), value)
+		}
 	}
+	return key.String()
+}
 
-	statement.RowToInsert.ID = uint32(id)
+// fastAggregates works out count(*), and min and max of the first primary
+// key column, over a whole table without reading every row: count(*) adds
+// up the number of cells of each leaf along the chain of leaves, and min
+// and max come from the first key of the leftmost leaf and the last key of
+// the rightmost one. It returns nil for a select that needs anything else.
+func fastAggregates(statement *Statement, table *Table) ([]*group, error) {
+	if statement.Where != nil || statement.GroupBy != nil {
+		return nil, nil
+	}
 
-	username := tokens[2]
+	keyColumn := table.Schema.PrimaryKey[0]
+	needsCount := false
+	for _, function := range statement.Aggregates {
+		column, ok := function.Arg.(*parser.ColumnRef)
+		switch {
+		case function.Name == "count" && function.Arg == nil:
+			needsCount = true
+		case (function.Name == "min" || function.Name == "max") && ok && column.Name == table.Schema.Columns[keyColumn].Name:
+		default:
+			return nil, nil
+		}
+	}
 
-	if len(username) > constants.COLUMN_USERNAME_SIZE {
-		return PREPARE_STRING_TOO_LONG
+	first, err := endRow(table, false)
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		return []*group{newGroup(statement, &Row{Values: make([]record.Value, len(table.Schema.Columns))})}, nil
 	}
 
-	copy(statement.RowToInsert.Username[:], username)
+	last, err := endRow(table, true)
+	if err != nil {
+		return nil, err
+	}
 
-	email := tokens[3]
+	count := int64(0)
+	if needsCount {
+		count, err = countRows(table)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if len(email) > constants.COLUMN_EMAIL_SIZE {
-		return PREPARE_STRING_TOO_LONG
+	g := newGroup(statement, first)
+	for i, function := range statement.Aggregates {
+		switch function.Name {
+		case "count":
+			g.accumulators[i] = accumulator{count: count}
+		case "min":
+			g.accumulators[i] = accumulator{count: 1, value: first.Values[keyColumn]}
+		default:
+			g.accumulators[i] = accumulator{count: 1, value: last.Values[keyColumn]}
+		}
 	}
 
-	copy(statement.RowToInsert.Email[:], email)
+	return []*group{g}, nil
+}
 
-	return PREPARE_SUCCESS
+// endRow returns the row with the lowest key, or the highest if last is
+// set, or nil if the table is empty
+func endRow(table *Table, last bool) (*Row, error) {
+	var row *Row
+	err := scanRows(table, KeyRange{}, nil, last, func(found *Row) bool {
+		row = found
+		return false
+	})
+	return row, err
 }
 
-func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
-	tokens := strings.Fields(inputBuffer.buffer)
+// countRows counts the rows of a table by following the chain of leaves
+// from the leftmost one, without reading the rows themselves
+func countRows(table *Table) (int64, error) {
+	cursor, err := tableStart(table)
+	if err != nil {
+		return 0, err
+	}
+
+	count := int64(0)
+	pageNum := cursor.PageNum
+	for {
+		node, err := table.Pager.getPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
+
+		count += int64(btree.LeafNodeNumCells(node))
+		nextLeaf := btree.LeafNodeNextLeaf(node)
+		table.Pager.unpinPage(pageNum)
+
+		// Page 0 is the file header and never a tree page, so a next leaf of 0
+		// marks the end of the chain
+		if nextLeaf == 0 {
+			return count, nil
+		}
+		pageNum = nextLeaf
+	}
+}
 
-	if len(tokens) == 0 {
-		return PREPARE_UNRECOGNIZED_STATEMENT
+// printSelected prints the values a select asks for from a row
+func printSelected(statement *Statement, schema *record.Schema, row *Row) {
+	if statement.Projection == nil {
+		printRow(row)
+		return
 	}
 
-	switch tokens[0] {
-	case "insert":
-		return prepareInsert(inputBuffer, statement)
-	case "select":
-		statement.Type = STATEMENT_SELECT
-		return PREPARE_SUCCESS
-	default:
-		return PREPARE_UNRECOGNIZED_STATEMENT
+	values := make([]record.Value, len(statement.Projection))
+	for i, expr := range statement.Projection {
+		values[i] = evalExpr(expr, schema, row)
 	}
+	printValues(values)
 }
 
-func executeInsert(statement *Statement, table *Table) ExecuteResult {
-	node, err := table.Pager.getPage(table.RootPageNum)
+// tableKeysInRange returns copies of the keys in the table that fall
+// within keyRange
+func tableKeysInRange(table *Table, keyRange KeyRange) ([][]byte, error) {
+	var keys [][]byte
+	cursor, err := tableFind(table, keyRange.Low)
 	if err != nil {
-		fmt.Printf("Error getting root page: %v\n", err)
-		return EXECUTE_TABLE_FULL
+		return nil, err
 	}
 
-	numCells := btree.LeafNodeNumCells(node)
+	for {
+		node, err := table.Pager.getPage(cursor.PageNum)
+		if err != nil {
+			return nil, err
+		}
 
-	rowToInsert := &statement.RowToInsert
-	keyToInsert := rowToInsert.ID
+		numCells := btree.LeafNodeNumCells(node)
+		nextLeaf := btree.LeafNodeNextLeaf(node)
+		var key []byte
+		if cursor.CellNum < numCells {
+			key = bytes.Clone(btree.LeafNodeKey(node, cursor.CellNum))
+		}
+		table.Pager.unpinPage(cursor.PageNum)
+
+		if cursor.CellNum >= numCells {
+			if nextLeaf == 0 {
+				return keys, nil
+			}
+			cursor.PageNum = nextLeaf
+			cursor.CellNum = 0
+			continue
+		}
+
+		if keyRange.isAbove(key) {
+			return keys, nil
+		}
+
+		keys = append(keys, key)
+		cursor.CellNum++
+	}
+}
+
+// scanRows calls visit with each row whose key is within keyRange and
+// which meets the where condition, in key order or, if reverse is set,
+// from the highest key down. The scan starts with a lookup of the first
+// key in the range, or of the first key past it when going back, and stops
+// past the last one, or when visit returns false, so a range of one key
+// reads a single row.
+func scanRows(table *Table, keyRange KeyRange, where parser.Expr, reverse bool, visit func(row *Row) bool) error {
+	start := keyRange.Low
+	if reverse {
+		start = keyAfterPrefix(keyRange.High)
+	}
 
-	cursor, err := tableFind(table, keyToInsert)
+	cursor, err := tableFind(table, start)
 	if err != nil {
-		fmt.Printf("Error finding key: %v\n", err)
-		return EXECUTE_TABLE_FULL
+		return err
+	}
+
+	node, err := table.Pager.getPage(cursor.PageNum)
+	if err != nil {
+		return err
+	}
+	numCells := btree.LeafNodeNumCells(node)
+	nextLeaf := btree.LeafNodeNextLeaf(node)
+	table.Pager.unpinPage(cursor.PageNum)
+
+	// The cursor is where start would be inserted. Going forward, a key past
+	// the last cell of its leaf starts the scan at the next leaf; going
+	// back, start is past the range, so the scan starts at the row before.
+	switch {
+	case numCells == 0:
+		return nil
+	case reverse:
+		err = cursorRetreat(cursor)
+		if err != nil {
+			return err
+		}
+	case cursor.CellNum >= numCells:
+		if nextLeaf == 0 {
+			return nil
+		}
+		cursor.PageNum = nextLeaf
+		cursor.CellNum = 0
 	}
 
-	if cursor.CellNum < numCells {
-		keyAtIndex := btree.LeafNodeKey(node, cursor.CellNum)
-		if keyAtIndex == keyToInsert {
-			return EXECUTE_DUPLICATE_KEY
+	for !cursor.EndOfTable {
+		row, err := cursorRow(cursor)
+		if err != nil {
+			return err
+		}
+
+		if (!reverse && keyRange.isAbove(row.Key)) || (reverse && keyRange.isBelow(row.Key)) {
+			return nil
 		}
+
+		if where == nil || isTrue(evalExpr(where, table.Schema, row)) {
+			if !visit(row) {
+				return nil
+			}
+		}
+
+		if reverse {
+			err = cursorRetreat(cursor)
+		} else {
+			err = cursorAdvance(cursor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanWhere calls visit with each row that meets the where condition of a
+// select or delete, found through the index prepareWhere chose or else by
+// scanning the range of keys it worked out
+func scanWhere(statement *Statement, table *Table, reverse bool, visit func(row *Row) bool) error {
+	if statement.IndexToScan != nil {
+		return scanIndexRows(table, statement.IndexToScan, statement.Where, reverse, visit)
 	}
+	return scanRows(table, statement.KeysToScan, statement.Where, reverse, visit)
+}
 
-	err = leafNodeInsert(cursor, rowToInsert.ID, rowToInsert)
+func executeDelete(statement *Statement, table *Table) ExecuteResult {
+	var rows []*Row
+	err := scanWhere(statement, table, false, func(row *Row) bool {
+		rows = append(rows, row)
+		return true
+	})
 	if err != nil {
-		fmt.Printf("Error inserting: %v\n", err)
-		return EXECUTE_TABLE_FULL
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	for _, row := range rows {
+		err = deleteRow(table, row)
+		if err != nil {
+			statement.Failure = err
+			return EXECUTE_FAILED
+		}
 	}
 
 	return EXECUTE_SUCCESS
 }
 
-func executeSelect(statement *Statement, table *Table) ExecuteResult {
-	cursor, err := tableStart(table)
+// deleteRow removes a row from the table and its indexes. Deleting
+// rebalances the tree, so the row's key is looked up afresh rather than
+// through a cursor the caller already has.
+func deleteRow(table *Table, row *Row) error {
+	err := deleteIndexKeys(table, row)
 	if err != nil {
-		fmt.Printf("Error getting cursor: %v\n", err)
-		return EXECUTE_SUCCESS
+		return err
 	}
 
-	var row Row
-	for !cursor.EndOfTable {
-		slot, err := cursorValue(cursor)
-		if err != nil {
-			fmt.Printf("Error getting cursor value: %v\n", err)
-			cursor.EndOfTable = true
-			continue
+	cursor, err := tableFind(table, row.Key)
+	if err != nil {
+		return err
+	}
+
+	return leafNodeDelete(cursor)
+}
+
+// deleteUniqueConflicts deletes every row other than the one with row's key
+// that has one of row's values for a unique index, so that INSERT OR
+// REPLACE can write row without breaking a constraint
+func deleteUniqueConflicts(table *Table, row *Row) error {
+	for {
+		conflict, key, err := uniqueConflict(table, row)
+		if err != nil || conflict == nil {
+			return err
 		}
 
-		deserializeRow(slot, &row)
-		printRow(&row)
+		existing, err := findRow(table, key)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("Index %s points to row %s, which does not exist", conflict.Name, formatKey(key))
+		}
 
-		err = cursorAdvance(cursor)
+		err = deleteRow(table, existing)
 		if err != nil {
-			fmt.Printf("Error advancing cursor: %v\n", err)
-			cursor.EndOfTable = true
+			return err
+		}
+	}
+}
+
+// executeUpdate rewrites the columns of an existing row in place
+func executeUpdate(statement *Statement, table *Table) ExecuteResult {
+	result, err := updateRow(table, &statement.RowToUpdate, statement.ColumnsToSet)
+	if result == EXECUTE_UNIQUE_VIOLATION {
+		statement.Violation = err
+		return result
+	}
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	return result
+}
+
+// updateRow sets the given columns of the row with update's key to the
+// values in update. The row keeps its place in the leaf unless it has grown
+// too large for it, in which case the leaf is split. Its overflow pages, if
+// any, are replaced, and so are its keys in indexes on columns that changed.
+// It fails with EXECUTE_ROW_NOT_FOUND only if no row has the key, and with
+// EXECUTE_FAILED and the error if the tree cannot be read or written.
+// Like insertRow, it fails with EXECUTE_UNIQUE_VIOLATION and a
+// *ConstraintError, leaving the row as it was, if the new values clash with
+// another row's in a unique index.
+func updateRow(table *Table, update *Row, columns []int) (ExecuteResult, error) {
+	cursor, err := tableFind(table, update.Key)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	return updateRowAt(cursor, update, columns)
+}
+
+// updateRowAt is updateRow for a cursor tableFind returned for the key of
+// update
+func updateRowAt(cursor *Cursor, update *Row, columns []int) (ExecuteResult, error) {
+	table := cursor.Table
+	node, err := table.Pager.getPageForWrite(cursor.PageNum)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+	defer table.Pager.unpinPage(cursor.PageNum)
+
+	if cursor.CellNum >= btree.LeafNodeNumCells(node) || !bytes.Equal(btree.LeafNodeKey(node, cursor.CellNum), update.Key) {
+		return EXECUTE_ROW_NOT_FOUND, nil
+	}
+
+	row, err := cursorRow(cursor)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	old := &Row{Key: row.Key, Values: slices.Clone(row.Values)}
+	for _, column := range columns {
+		row.Values[column] = update.Values[column]
+	}
+
+	conflict, _, err := uniqueConflict(table, row)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+	if conflict != nil {
+		return EXECUTE_UNIQUE_VIOLATION, constraintError(table, conflict)
+	}
+
+	err = freeOverflowPages(table.Pager, btree.LeafNodeOverflowPage(node, cursor.CellNum))
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	btree.LeafNodeRemoveCell(node, cursor.CellNum)
+	err = leafNodeInsert(cursor, row.Key, row)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	err = updateIndexKeys(table, old, row)
+	if err != nil {
+		return EXECUTE_FAILED, err
+	}
+
+	return EXECUTE_SUCCESS, nil
+}
+
+// executeCreateTable adds a new, empty table to the catalog. The names of
+// the indexes made for its unique columns must not be taken, which they can
+// be by another table's, as a_b.c and a.b_c share one.
+func executeCreateTable(statement *Statement, db *Database) ExecuteResult {
+	schema := statement.SchemaToCreate
+
+	_, exists := db.Tables[schema.TableName]
+	if exists || schema.TableName == CATALOG_TABLE_NAME {
+		return EXECUTE_TABLE_EXISTS
+	}
+
+	for i, column := range schema.Columns {
+		if column.Unique && findIndex(db, autoIndexName(schema, i)) != nil {
+			return EXECUTE_INDEX_EXISTS
 		}
 	}
 
+	err := createTable(db, schema)
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	return EXECUTE_SUCCESS
+}
+
+// executeCreateIndex adds an index on a column of a table and fills it.
+// Index names are unique across all tables.
+func executeCreateIndex(statement *Statement, db *Database) ExecuteResult {
+	if findIndex(db, statement.IndexToCreate.Name) != nil {
+		return EXECUTE_INDEX_EXISTS
+	}
+
+	err := createIndex(db, db.Tables[statement.TableName], statement.IndexToCreate)
+	if violation, ok := err.(*ConstraintError); ok {
+		statement.Violation = violation
+		return EXECUTE_UNIQUE_VIOLATION
+	}
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	return EXECUTE_SUCCESS
+}
+
+// executeBegin opens an explicit transaction. Statements no longer commit on
+// their own until it is committed or rolled back.
+func executeBegin(db *Database) ExecuteResult {
+	if db.Pager.InTransaction {
+		return EXECUTE_TRANSACTION_OPEN
+	}
+
+	db.Pager.InTransaction = true
+	return EXECUTE_SUCCESS
+}
+
+// executeCommit makes every change since BEGIN durable. A commit that fails
+// leaves the transaction open, so it can be committed again or rolled back.
+func executeCommit(statement *Statement, db *Database) ExecuteResult {
+	if !db.Pager.InTransaction {
+		return EXECUTE_NO_TRANSACTION
+	}
+
+	err := db.Pager.commit()
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	db.Pager.InTransaction = false
+	return EXECUTE_SUCCESS
+}
+
+// executeRollback discards every change made since BEGIN. The transaction
+// may have created tables or moved roots, so the catalog is loaded again.
+func executeRollback(statement *Statement, db *Database) ExecuteResult {
+	if !db.Pager.InTransaction {
+		return EXECUTE_NO_TRANSACTION
+	}
+
+	err := db.Pager.rollback()
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
+	err = loadCatalog(db)
+	if err != nil {
+		statement.Failure = err
+		return EXECUTE_FAILED
+	}
+
 	return EXECUTE_SUCCESS
 }
 
-func executeStatement(statement *Statement, table *Table) ExecuteResult {
+// executeStatement runs a statement. Outside an explicit transaction it
+// commits on its own if it succeeds. A statement that fails part way leaves
+// no trace: outside a transaction its changes are rolled back, and inside
+// one they are rolled back to a savepoint taken before it, keeping the
+// changes of the statements before it.
+func executeStatement(statement *Statement, db *Database) ExecuteResult {
+	switch statement.Type {
+	case STATEMENT_BEGIN:
+		return executeBegin(db)
+	case STATEMENT_COMMIT:
+		return executeCommit(statement, db)
+	case STATEMENT_ROLLBACK:
+		return executeRollback(statement, db)
+	}
+
+	table := db.Tables[statement.TableName]
+
+	var savepoint *Savepoint
+	if db.Pager.InTransaction && statement.Type != STATEMENT_SELECT {
+		var err error
+		savepoint, err = db.Pager.savepoint()
+		if err != nil {
+			statement.Failure = err
+			return EXECUTE_FAILED
+		}
+	}
+
+	var result ExecuteResult
 	switch statement.Type {
 	case STATEMENT_INSERT:
-		return executeInsert(statement, table)
+		result = executeInsert(statement, table)
 	case STATEMENT_SELECT:
-		return executeSelect(statement, table)
+		result = executeSelect(statement, table)
+	case STATEMENT_DELETE:
+		result = executeDelete(statement, table)
+	case STATEMENT_UPDATE:
+		result = executeUpdate(statement, table)
+	case STATEMENT_CREATE_TABLE:
+		result = executeCreateTable(statement, db)
+	case STATEMENT_CREATE_INDEX:
+		result = executeCreateIndex(statement, db)
 	default:
 		return EXECUTE_SUCCESS
 	}
+
+	if result == EXECUTE_SUCCESS && !db.Pager.InTransaction {
+		err := db.Pager.commit()
+		if err != nil {
+			statement.Failure = err
+			result = EXECUTE_FAILED
+		}
+	}
+
+	if result != EXECUTE_SUCCESS && statement.Type != STATEMENT_SELECT {
+		err := undoStatement(db, savepoint)
+		if err != nil {
+			fmt.Printf("Error rolling back: %v\n", err)
+		}
+	}
+
+	return result
+}
+
+// undoStatement discards the changes of a statement that failed, back to
+// savepoint inside an explicit transaction or to the last commit outside
+// one. The statement may have created tables or moved roots, so the catalog
+// is loaded again.
+func undoStatement(db *Database, savepoint *Savepoint) error {
+	var err error
+	if savepoint != nil {
+		err = db.Pager.rollbackTo(savepoint)
+	} else {
+		err = db.Pager.rollback()
+	}
+	if err != nil {
+		return err
+	}
+
+	return loadCatalog(db)
 }
 
 // =========
 // DEBUG
 // =========
 func printConstants() {
-	fmt.Printf("ROW_SIZE: %d\n", constants.ROW_SIZE)
 	fmt.Printf("COMMON_NODE_HEADER_SIZE: %d\n", btree.COMMON_NODE_HEADER_SIZE)
 	fmt.Printf("LEAF_NODE_HEADER_SIZE: %d\n", btree.LEAF_NODE_HEADER_SIZE)
-	fmt.Printf("LEAF_NODE_CELL_SIZE: %d\n", btree.LEAF_NODE_CELL_SIZE)
+	fmt.Printf("LEAF_NODE_CELL_HEADER_SIZE: %d\n", btree.LEAF_NODE_CELL_HEADER_SIZE)
 	fmt.Printf("LEAF_NODE_SPACE_FOR_CELLS: %d\n", btree.LEAF_NODE_SPACE_FOR_CELLS)
 	fmt.Printf("LEAF_NODE_MAX_CELLS: %d\n", btree.LEAF_NODE_MAX_CELLS)
+	fmt.Printf("LEAF_NODE_MAX_LOCAL_SIZE: %d\n", btree.LEAF_NODE_MAX_LOCAL_SIZE)
+	fmt.Printf("TABLE_MAX_KEY_SIZE: %d\n", btree.TABLE_MAX_KEY_SIZE)
+	fmt.Printf("OVERFLOW_PAGE_DATA_SIZE: %d\n", btree.OVERFLOW_PAGE_DATA_SIZE)
+}
+
+func printDbInfo(pager *Pager) error {
+	headerPage, err := pager.getPage(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	defer pager.unpinPage(header.HEADER_PAGE_NUM)
+
+	fmt.Printf("format version: %d\n", header.Version(headerPage))
+	fmt.Printf("page size: %d\n", header.PageSize(headerPage))
+	fmt.Printf("catalog root page: %d\n", header.RootPage(headerPage))
+	fmt.Printf("free list head: %d\n", header.FreeListHead(headerPage))
+	fmt.Printf("page count: %d\n", header.PageCount(headerPage))
+
+	return nil
 }
 
 func indent(level uint32) {
@@ -786,6 +2351,7 @@ func printTree(pager *Pager, pageNum uint32, indentationLevel uint32) error {
 	if err != nil {
 		return err
 	}
+	defer pager.unpinPage(pageNum)
 
 	switch btree.GetNodeType(node) {
 	case btree.NODE_LEAF:
@@ -794,7 +2360,7 @@ func printTree(pager *Pager, pageNum uint32, indentationLevel uint32) error {
 		fmt.Printf("- leaf (size %d)\n", numCells)
 		for i := uint32(0); i < numCells; i++ {
 			indent(indentationLevel + 1)
-			fmt.Printf("  - key %d\n", btree.LeafNodeKey(node, i))
+			fmt.Printf("  - key %s\n", formatKey(btree.LeafNodeKey(node, i)))
 		}
 
 	case btree.NODE_INTERNAL:
@@ -809,7 +2375,7 @@ func printTree(pager *Pager, pageNum uint32, indentationLevel uint32) error {
 			}
 
 			indent(indentationLevel + 1)
-			fmt.Printf("- key %d\n", btree.InternalNodeKey(node, i))
+			fmt.Printf("- key %s\n", formatKey(btree.InternalNodeKey(node, i)))
 		}
 
 		rightChild := btree.InternalNodeRightChild(node)
@@ -823,13 +2389,28 @@ func printTree(pager *Pager, pageNum uint32, indentationLevel uint32) error {
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	cachePages := flag.Int("cache-pages", constants.DEFAULT_CACHE_PAGES, "number of pages kept in the buffer pool")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		fmt.Println("Must supply a database filename.")
 		os.Exit(1)
 	}
 
-	filename := os.Args[1]
-	table, err := dbOpen(filename)
+	if flag.Arg(0) == "check" {
+		if flag.NArg() != 2 {
+			fmt.Println("Usage: toydb check <database file>")
+			os.Exit(1)
+		}
+
+		if !checkFile(flag.Arg(1), *cachePages) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	filename := flag.Arg(0)
+	db, err := dbOpen(filename, *cachePages)
 	if err != nil {
 		fmt.Printf("Error opening database: %v\n", err)
 		os.Exit(1)
@@ -849,7 +2430,7 @@ func main() {
 
 		// Check if it's a meta-command
 		if strings.HasPrefix(inputBuffer.buffer, ".") {
-			switch doMetaCommand(inputBuffer, table) {
+			switch doMetaCommand(inputBuffer, db) {
 			case META_COMMAND_SUCCESS:
 				continue
 			case META_COMMAND_UNRECOGNIZED_COMMAND:
@@ -860,7 +2441,7 @@ func main() {
 
 		// Otherwise, it's a SQL statement
 		var statement Statement
-		switch prepareStatement(inputBuffer, &statement) {
+		switch prepareStatement(inputBuffer, &statement, db) {
 		case PREPARE_SUCCESS:
 			// Statement prepared successfully
 		case PREPARE_STRING_TOO_LONG:
@@ -870,21 +2451,39 @@ func main() {
 			fmt.Println("ID must be positive.")
 			continue
 		case PREPARE_SYNTAX_ERROR:
-			fmt.Println("Syntax error. Could not parse statement.")
+			fmt.Printf("Syntax error at %v.\n", statement.SyntaxError)
+			continue
+		case PREPARE_BAD_PRIMARY_KEY:
+			fmt.Println("A table without a primary key must start with an integer column.")
+			continue
+		case PREPARE_NO_SUCH_TABLE:
+			fmt.Printf("No such table '%s'.\n", statement.TableName)
 			continue
 		case PREPARE_UNRECOGNIZED_STATEMENT:
 			fmt.Printf("Unrecognized keyword at start of '%s'.\n", inputBuffer.buffer)
 			continue
 		}
 
-		result := executeStatement(&statement, table)
+		result := executeStatement(&statement, db)
 		switch result {
 		case EXECUTE_SUCCESS:
 			fmt.Println("Executed.")
 		case EXECUTE_DUPLICATE_KEY:
 			fmt.Println("Error: Duplicate key.")
-		case EXECUTE_TABLE_FULL:
-			fmt.Println("Error: Table full.")
+		case EXECUTE_UNIQUE_VIOLATION:
+			fmt.Printf("Error: %v.\n", statement.Violation)
+		case EXECUTE_ROW_NOT_FOUND:
+			fmt.Println("Error: Row not found.")
+		case EXECUTE_TRANSACTION_OPEN:
+			fmt.Println("Error: Transaction already open.")
+		case EXECUTE_NO_TRANSACTION:
+			fmt.Println("Error: No transaction is open.")
+		case EXECUTE_TABLE_EXISTS:
+			fmt.Println("Error: Table already exists.")
+		case EXECUTE_INDEX_EXISTS:
+			fmt.Println("Error: Index already exists.")
+		case EXECUTE_FAILED:
+			fmt.Printf("Error: %v.\n", statement.Failure)
 		}
 	}
 }
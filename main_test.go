@@ -1,26 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
+	"toydb/btree"
+	"toydb/parser"
+	"toydb/record"
 )
 
 // runScript executes the database with a series of commands and returns the output
 func runScript(commands []string) ([]string, error) {
+	defer os.Remove("test.db") // Clean up database file
+
+	return runScriptOnFile("test.db", commands)
+}
+
+// runScriptOnFile is runScript against a database file that is left in place,
+// so later scripts can reopen it. args are passed before the filename.
+func runScriptOnFile(filename string, commands []string, args ...string) ([]string, error) {
 	// Build the executable
-	buildCmd := exec.Command("go", "build", "-o", "testdb", "main.go")
+	buildCmd := exec.Command("go", "build", "-o", "testdb", ".")
 	if err := buildCmd.Run(); err != nil {
 		return nil, err
 	}
-	defer os.Remove("testdb")  // Clean up after test
-	defer os.Remove("test.db") // Clean up database file
+	defer os.Remove("testdb") // Clean up after test
 
-	// Run the database with a temporary filename
-	cmd := exec.Command("./testdb", "test.db")
+	// Run the database with the given filename
+	cmd := exec.Command("./testdb", append(args, filename)...)
 
 	// Create pipes for stdin and stdout
 	stdin, err := cmd.StdinPipe()
@@ -38,11 +53,14 @@ func runScript(commands []string) ([]string, error) {
 		return nil, err
 	}
 
-	// Send commands
-	for _, command := range commands {
-		io.WriteString(stdin, command+"\n")
-	}
-	stdin.Close()
+	// Send commands while the output is read, so that neither pipe fills up
+	// and blocks the other
+	go func() {
+		for _, command := range commands {
+			io.WriteString(stdin, command+"\n")
+		}
+		stdin.Close()
+	}()
 
 	// Read output
 	output, err := io.ReadAll(stdout)
@@ -65,6 +83,51 @@ func runScript(commands []string) ([]string, error) {
 	return result, nil
 }
 
+// runScriptAndKill is runScriptOnFile, except that the process is killed as
+// soon as it has answered the last command instead of being allowed to exit
+func runScriptAndKill(filename string, commands []string) error {
+	buildCmd := exec.Command("go", "build", "-o", "testdb", ".")
+	if err := buildCmd.Run(); err != nil {
+		return err
+	}
+	defer os.Remove("testdb")
+
+	cmd := exec.Command("./testdb", filename)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	for _, command := range commands {
+		io.WriteString(stdin, command+"\n")
+	}
+
+	// The prompt after the last command means every command has run
+	var output strings.Builder
+	buffer := make([]byte, 4096)
+	for strings.Count(output.String(), "db > ") <= len(commands) {
+		n, err := stdout.Read(buffer)
+		if err != nil {
+			return fmt.Errorf("Process exited before running every command: %v", err)
+		}
+		output.Write(buffer[:n])
+	}
+
+	return nil
+}
+
 func TestInsertAndRetrieveRow(t *testing.T) {
 	commands := []string{
 		"insert 1 user1 person1@example.com",
@@ -111,36 +174,45 @@ func TestNegativeID(t *testing.T) {
 	}
 }
 
-func TestTableFull(t *testing.T) {
+func TestTableLargerThanBufferPool(t *testing.T) {
+	defer os.Remove("test.db")
+
 	var commands []string
 
-	// Insert enough rows to trigger table full condition
-	// With B-tree structure, we need to fill all TABLE_MAX_PAGES (100 pages)
-	// Each leaf node holds about 13 rows, but we also need internal nodes
-	// Insert 1200 rows which should be enough to use up all pages
-	for i := 1; i <= 1200; i++ {
+	// 3000 rows need far more pages than the eight the buffer pool may hold,
+	// so pages are evicted and read back throughout
+	for i := 1; i <= 3000; i++ {
+		id := (i * 7919) % 3001
 		commands = append(commands,
-			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+			fmt.Sprintf("insert %d user%d person%d@example.com", id, id, id))
 	}
 	commands = append(commands, ".exit")
 
-	result, err := runScript(commands)
+	result, err := runScriptOnFile("test.db", commands, "-cache-pages", "8")
 	if err != nil {
 		t.Fatalf("Failed to run script: %v", err)
 	}
 
-	// Check that the last insert failed with table full error
-	// Look for "Error: Table full." in the output
-	foundTableFull := false
 	for _, line := range result {
-		if strings.Contains(line, "Error: Table full.") {
-			foundTableFull = true
-			break
+		if strings.Contains(line, "Error") {
+			t.Fatalf("Expected every insert to succeed, got '%s'", line)
 		}
 	}
 
-	if !foundTableFull {
-		t.Errorf("Expected to find 'Error: Table full.' in output, but got: %v", result)
+	result, err = runScriptOnFile("test.db", []string{"select", ".exit"}, "-cache-pages", "8")
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	if len(result) != 3002 {
+		t.Fatalf("Expected 3000 rows, got %d lines", len(result))
+	}
+
+	for i := 1; i <= 3000; i++ {
+		row := fmt.Sprintf("(%d, user%d, person%d@example.com)", i, i, i)
+		if !strings.HasSuffix(result[i-1], row) {
+			t.Fatalf("Expected row %d to be '%s', got '%s'", i, row, result[i-1])
+		}
 	}
 }
 
@@ -171,15 +243,3146 @@ func TestMaxLengthStrings(t *testing.T) {
 	}
 }
 
-// Helper function to compare slices
-func equalSlices(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
+func TestInsertsAcrossMultipleLeaves(t *testing.T) {
+	var commands []string
+
+	// Insert keys out of order so splits happen in leaves that are not the root
+	for i := 1; i <= 1000; i++ {
+		id := (i * 37) % 1001
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", id, id, id))
 	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
+	commands = append(commands, "select", ".exit")
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	var expected []string
+	for i := 1; i <= 1000; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	for i := 1; i <= 1000; i++ {
+		row := fmt.Sprintf("(%d, user%d, person%d@example.com)", i, i, i)
+		if i == 1 {
+			row = "db > " + row
 		}
+		expected = append(expected, row)
+	}
+	expected = append(expected, "Executed.", "db > Bye!")
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestInternalNodeSplits(t *testing.T) {
+	commands := []string{"create table docs (id integer, body text)"}
+
+	// Rows of about a thousand bytes put three in a leaf, so a thousand of
+	// them need more leaves than one internal node can point to
+	for i := 1; i <= 1000; i++ {
+		id := (i * 37) % 1001
+		commands = append(commands,
+			fmt.Sprintf("insert into docs values (%d, '%s')", id, strings.Repeat("x", 1000)))
+	}
+	commands = append(commands, ".btree docs", ".check", ".exit")
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	for _, line := range result[:1001] {
+		if line != "db > Executed." {
+			t.Fatalf("Expected every insert to succeed, got '%s'", line)
+		}
+	}
+
+	// The root has split, so its children are internal nodes too
+	if result[1001] != "db > Tree:" || !strings.HasPrefix(result[1002], "- internal") ||
+		!strings.HasPrefix(result[1003], "  - internal") {
+		t.Errorf("Expected a tree of three levels, got %v", result[1001:1004])
+	}
+
+	check := result[len(result)-2]
+	if !strings.HasPrefix(check, "db > ok: ") {
+		t.Errorf("Expected a clean check, got '%s'", check)
+	}
+}
+
+func TestDeleteRows(t *testing.T) {
+	var commands []string
+	for i := 1; i <= 500; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands,
+		"delete where id = 1",
+		"delete where id between 3 and 498",
+		"delete where id > 499",
+		"select",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (2, user2, person2@example.com)",
+		"(499, user499, person499@example.com)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[500:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[500:])
+	}
+}
+
+func TestDeleteAllRowsShrinksTree(t *testing.T) {
+	var commands []string
+	for i := 1; i <= 400; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands,
+		"delete where id <= 400",
+		".btree",
+		"insert 7 user7 person7@example.com",
+		"select",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Tree:",
+		"- leaf (size 0)",
+		"db > Executed.",
+		"db > (7, user7, person7@example.com)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[400:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[400:])
+	}
+}
+
+func TestUpdateRow(t *testing.T) {
+	commands := []string{
+		"insert 1 user1 person1@example.com",
+		"insert 2 user2 person2@example.com",
+		"update 2 set username=bob, email=bob@example.com",
+		"update 1 set email=first@example.com",
+		"update 3 set username=nobody",
+		"select",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Row not found.",
+		"db > (1, user1, first@example.com)",
+		"(2, bob, bob@example.com)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestFreedPagesAreReused(t *testing.T) {
+	defer os.Remove("test.db")
+
+	var commands []string
+
+	// Each round needs about 65 pages, which deletes hand back for the next
+	// round to reuse
+	for round := 0; round < 5; round++ {
+		for i := 1; i <= 3000; i++ {
+			commands = append(commands,
+				fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+		}
+		commands = append(commands, "delete where id >= 1")
+	}
+	commands = append(commands, "select", ".exit")
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	for _, line := range result {
+		if strings.Contains(line, "Error") {
+			t.Fatalf("Expected every statement to succeed, got '%s'", line)
+		}
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[len(result)-2:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[len(result)-2:])
+	}
+
+	fileInfo, err := os.Stat("test.db")
+	if err != nil {
+		t.Fatalf("Failed to stat database: %v", err)
+	}
+
+	if numPages := fileInfo.Size() / 4096; numPages > 80 {
+		t.Errorf("Expected freed pages to be reused, but the file grew to %d pages", numPages)
+	}
+}
+
+func TestRowsPersistAfterReopen(t *testing.T) {
+	defer os.Remove("test.db")
+
+	var commands []string
+	for i := 1; i <= 20; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, ".exit")
+
+	_, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	result, err := runScriptOnFile("test.db", []string{"select", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	if len(result) != 22 || result[0] != "db > (1, user1, person1@example.com)" ||
+		result[19] != "(20, user20, person20@example.com)" {
+		t.Errorf("Expected 20 rows after reopening, got %v", result)
+	}
+}
+
+func TestDbInfoTracksCatalogRootPage(t *testing.T) {
+	// Long definitions fill the catalog leaf with few tables
+	var columns []string
+	for i := 0; i < 10; i++ {
+		columns = append(columns, fmt.Sprintf("column_with_a_long_name_%d text(255)", i))
+	}
+
+	commands := []string{".dbinfo"}
+	for i := 1; i <= 150; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, ".dbinfo", "delete where id >= 1", ".dbinfo")
+	for i := 1; i <= 10; i++ {
+		commands = append(commands,
+			fmt.Sprintf("create table t%d (id integer, %s)", i, strings.Join(columns, ", ")))
+	}
+	commands = append(commands, ".dbinfo", ".exit")
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// A new database has the catalog on page 1 and the users table on page 2
+	expected := []string{
+		"db > format version: 8",
+		"page size: 4096",
+		"catalog root page: 1",
+		"free list head: 0",
+		"page count: 3",
+	}
+	if !equalSlices(result[:5], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[:5])
+	}
+
+	// Splitting the users table moves its root, which is recorded in the
+	// catalog rather than the header
+	expected = []string{
+		"db > format version: 8",
+		"page size: 4096",
+		"catalog root page: 1",
+		"free list head: 0",
+		"page count: 6",
+	}
+	if !equalSlices(result[155:160], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[155:160])
+	}
+
+	// Deleting everything shrinks the users tree back to its original leaf
+	// and puts the other three pages on the free list
+	expected = []string{
+		"db > Executed.",
+		"db > format version: 8",
+		"page size: 4096",
+		"catalog root page: 1",
+		"free list head: 3",
+		"page count: 6",
+	}
+	if !equalSlices(result[160:166], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[160:166])
+	}
+
+	// The tenth table splits the catalog leaf, moving the catalog root
+	expected = []string{
+		"db > format version: 8",
+		"page size: 4096",
+		"catalog root page: 14",
+		"free list head: 0",
+		"page count: 15",
+		"db > Bye!",
+	}
+	if !equalSlices(result[176:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[176:])
+	}
+}
+
+func TestRefusesUnrecognisedFile(t *testing.T) {
+	defer os.Remove("test.db")
+
+	err := os.WriteFile("test.db", []byte(strings.Repeat("x", 4096)), 0666)
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	result, err := runScriptOnFile("test.db", []string{".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{"Error opening database: File is not a toydb database"}
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestReadOnlySessionDoesNotWriteFile(t *testing.T) {
+	defer os.Remove("test.db")
+
+	var commands []string
+	for i := 1; i <= 50; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, ".exit")
+
+	_, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// Backdate the file so any write shows up as a new modification time
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes("test.db", past, past)
+	if err != nil {
+		t.Fatalf("Failed to set file times: %v", err)
+	}
+
+	_, err = runScriptOnFile("test.db", []string{"select", ".btree", ".dbinfo", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	fileInfo, err := os.Stat("test.db")
+	if err != nil {
+		t.Fatalf("Failed to stat database: %v", err)
+	}
+
+	if !fileInfo.ModTime().Equal(past) {
+		t.Errorf("Expected a read-only session to leave the file untouched, modified at %v", fileInfo.ModTime())
+	}
+}
+
+func TestSyncWritesDirtyPagesWithoutClosing(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	for i := 1; i <= 40; i++ {
+		inputBuffer := &InputBuffer{buffer: fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i)}
+		var statement Statement
+		if prepareStatement(inputBuffer, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", inputBuffer.buffer)
+		}
+		if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s'", inputBuffer.buffer)
+		}
+	}
+
+	err = db.Pager.Sync()
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+
+	for pageNum, frame := range db.Pager.Frames {
+		if frame.Dirty {
+			t.Errorf("Expected page %d to be clean after Sync", pageNum)
+		}
+	}
+
+	// A second connection sees every row while the first is still open
+	reader, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database again: %v", err)
+	}
+	defer reader.Pager.pagerClose()
+
+	keys, err := tableKeysInRange(reader.Tables["users"], KeyRange{})
+	if err != nil {
+		t.Fatalf("Failed to scan table: %v", err)
+	}
+
+	if len(keys) != 40 {
+		t.Errorf("Expected 40 rows on disk after Sync, got %d", len(keys))
+	}
+
+	err = dbClose(db)
+	if err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+}
+
+func TestCommittedRowsSurviveCrash(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db-wal")
+
+	var commands []string
+	for i := 1; i <= 300; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, "delete where id > 250", "update 3 set username=changed")
+
+	err := runScriptAndKill("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// A frame torn by the crash must be ignored
+	log, err := os.OpenFile("test.db-wal", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("Expected a write-ahead log after the crash: %v", err)
+	}
+	log.Write([]byte(strings.Repeat("torn", 100)))
+	log.Close()
+
+	result, err := runScriptOnFile("test.db", []string{"select", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	var expected []string
+	for i := 1; i <= 250; i++ {
+		username := fmt.Sprintf("user%d", i)
+		if i == 3 {
+			username = "changed"
+		}
+		expected = append(expected, fmt.Sprintf("(%d, %s, person%d@example.com)", i, username, i))
+	}
+	expected[0] = "db > " + expected[0]
+	expected = append(expected, "Executed.", "db > Bye!")
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	if _, err := os.Stat("test.db-wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected the write-ahead log to be removed on a clean exit")
+	}
+}
+
+func TestCrashAfterSyncLeavesDatabaseFileComplete(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db-wal")
+
+	var commands []string
+	for i := 1; i <= 20; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, ".sync", "insert 21 user21 person21@example.com")
+
+	err := runScriptAndKill("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// Without its log the database file holds exactly what was synced
+	err = os.Remove("test.db-wal")
+	if err != nil {
+		t.Fatalf("Expected a write-ahead log after the crash: %v", err)
+	}
+
+	result, err := runScriptOnFile("test.db", []string{"select", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	if len(result) != 22 || result[19] != "(20, user20, person20@example.com)" {
+		t.Errorf("Expected the 20 synced rows, got %v", result)
+	}
+}
+
+func TestTransactionCommitAndRollback(t *testing.T) {
+	commands := []string{
+		"insert 1 user1 person1@example.com",
+		"begin",
+		"begin",
+		"insert 2 user2 person2@example.com",
+		"update 1 set username=changed",
+		"select",
+		"rollback",
+		"select",
+		"begin",
+		"insert 3 user3 person3@example.com",
+		"commit",
+		"commit",
+		"rollback",
+		"select",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Transaction already open.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (1, changed, person1@example.com)",
+		"(2, user2, person2@example.com)",
+		"Executed.",
+		"db > Executed.",
+		"db > (1, user1, person1@example.com)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: No transaction is open.",
+		"db > Error: No transaction is open.",
+		"db > (1, user1, person1@example.com)",
+		"(3, user3, person3@example.com)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestRollbackRestoresRestructuredTree(t *testing.T) {
+	defer os.Remove("test.db")
+
+	var commands []string
+	for i := 1; i <= 300; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, ".dbinfo", "begin", "delete where id >= 1")
+	for i := 1000; i <= 3000; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, "rollback", ".dbinfo", "select", ".exit")
+
+	// A small pool forces the transaction's pages out to the log before the
+	// rollback
+	result, err := runScriptOnFile("test.db", commands, "-cache-pages", "4")
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	var headers [][]string
+	var rows int
+	for i, line := range result {
+		if strings.Contains(line, "format version:") {
+			headers = append(headers, result[i+1:i+5])
+		}
+		if strings.Contains(line, "@example.com)") {
+			rows++
+		}
+	}
+
+	if len(headers) != 2 || !equalSlices(headers[0], headers[1]) {
+		t.Errorf("Expected the rollback to restore the header, got %v", headers)
+	}
+
+	if rows != 300 {
+		t.Errorf("Expected the 300 committed rows after the rollback, got %d", rows)
+	}
+}
+
+func TestUncommittedTransactionIsLostOnCrashAndExit(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db-wal")
+
+	commands := []string{"insert 1 user1 person1@example.com", "begin"}
+	for i := 2; i <= 40; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+
+	err := runScriptAndKill("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	result, err := runScriptOnFile("test.db", []string{
+		"select",
+		"begin",
+		"insert 2 user2 person2@example.com",
+		".exit",
+	})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > (1, user1, person1@example.com)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	result, err = runScriptOnFile("test.db", []string{"select", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > (1, user1, person1@example.com)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCorruptPageIsReported(t *testing.T) {
+	defer os.Remove("test.db")
+
+	var commands []string
+	for i := 1; i <= 40; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, ".exit")
+
+	_, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// Flip a byte in the middle of the leaf on page 2
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open database file: %v", err)
+	}
+	b := make([]byte, 1)
+	file.ReadAt(b, 2*4096+1000)
+	b[0] ^= 0xff
+	file.WriteAt(b, 2*4096+1000)
+	file.Close()
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	_, err = db.Pager.getPage(2)
+	var corrupt *CorruptPageError
+	if !errors.As(err, &corrupt) || corrupt.PageNum != 2 {
+		t.Errorf("Expected a corruption error for page 2, got %v", err)
+	}
+
+	_, err = tableKeysInRange(db.Tables["users"], KeyRange{})
+	if !errors.As(err, &corrupt) || corrupt.PageNum != 2 {
+		t.Errorf("Expected the scan to stop at corrupt page 2, got %v", err)
+	}
+
+	err = dbClose(db)
+	if err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	// A select fails with the reason, sorted or not, and is not followed
+	// by "Executed."
+	result, err := runScriptOnFile("test.db", []string{"select", "select * from users order by username", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Error: Page 2 is corrupt: checksum mismatch.",
+		"db > Error: Page 2 is corrupt: checksum mismatch.",
+		"db > Bye!",
+	}
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// An insert, delete or update that cannot read the rows it should change
+	// fails with the reason rather than reporting success, a missing row or a
+	// full table
+	result, err = runScriptOnFile("test.db", []string{"insert 41 user41 person41@example.com", "delete from users where id > 0", "update 1 set username=bob", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > Error: Page 2 is corrupt: checksum mismatch.",
+		"db > Error: Page 2 is corrupt: checksum mismatch.",
+		"db > Error: Page 2 is corrupt: checksum mismatch.",
+		"db > Bye!",
+	}
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestPointerPastEndOfFileIsCorrupt(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	// Point the only leaf of users at the page after the last one
+	users := db.Tables["users"]
+	numPages := db.Pager.NumPages
+	leaf, err := db.Pager.getPageForWrite(users.RootPageNum)
+	if err != nil {
+		t.Fatalf("Failed to read the root: %v", err)
+	}
+	btree.SetLeafNodeNextLeaf(leaf, numPages)
+	db.Pager.unpinPage(users.RootPageNum)
+
+	_, err = tableKeysInRange(users, KeyRange{})
+	var corrupt *CorruptPageError
+	if !errors.As(err, &corrupt) || corrupt.PageNum != numPages {
+		t.Errorf("Expected page %d to be reported corrupt, got %v", numPages, err)
+	}
+	if db.Pager.NumPages != numPages {
+		t.Errorf("Expected reading past the end to leave %d pages, got %d", numPages, db.Pager.NumPages)
+	}
+}
+
+func TestFailedCommitKeepsTransactionOpen(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	run := func(command string) (ExecuteResult, error) {
+		var statement Statement
+		if prepareStatement(&InputBuffer{buffer: command}, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", command)
+		}
+		return executeStatement(&statement, db), statement.Failure
+	}
+
+	// Swap the log for a handle that cannot be written, so that writing
+	// the commit record or cutting the log fails
+	log := db.Pager.Wal.FileDescriptor
+	readOnly, err := os.Open(log.Name())
+	if err != nil {
+		t.Fatalf("Failed to open the log: %v", err)
+	}
+	defer readOnly.Close()
+
+	run("begin")
+	run("insert 1 alice alice@example.com")
+	db.Pager.Wal.FileDescriptor = readOnly
+	result, failure := run("commit")
+	if result != EXECUTE_FAILED || failure == nil {
+		t.Errorf("Expected the commit to fail, got %d, %v", result, failure)
+	}
+	if !db.Pager.InTransaction {
+		t.Errorf("Expected the transaction to stay open after a failed commit")
+	}
+
+	db.Pager.Wal.FileDescriptor = log
+	result, failure = run("commit")
+	if result != EXECUTE_SUCCESS || db.Pager.InTransaction {
+		t.Fatalf("Expected the commit to succeed on a second try, got %d, %v", result, failure)
+	}
+
+	run("begin")
+	run("insert 2 bob bob@example.com")
+	db.Pager.Wal.FileDescriptor = readOnly
+	result, failure = run("rollback")
+	if result != EXECUTE_FAILED || failure == nil {
+		t.Errorf("Expected the rollback to fail, got %d, %v", result, failure)
+	}
+
+	db.Pager.Wal.FileDescriptor = log
+	result, failure = run("rollback")
+	if result != EXECUTE_SUCCESS || db.Pager.InTransaction {
+		t.Fatalf("Expected the rollback to succeed on a second try, got %d, %v", result, failure)
+	}
+
+	for id, expected := range map[int64]bool{1: true, 2: false} {
+		row, err := findRow(db.Tables["users"], integerKey(id))
+		if err != nil || (row != nil) != expected {
+			t.Errorf("Expected row %d to exist: %v, got %v, %v", id, expected, row, err)
+		}
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected a clean check, got %v, %v", problems, err)
+	}
+}
+
+func TestFailedStatementIsRolledBack(t *testing.T) {
+	defer os.Remove("test.db")
+
+	commands := []string{
+		"create table t (id integer, name text)",
+		"create index t_name on t (name)",
+	}
+	for i := 1; i <= 600; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert into t values (%d, 'name%04d%s')", i, i, strings.Repeat("x", 100)))
+	}
+	commands = append(commands, ".exit")
+
+	_, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// Find the last leaf of the index, which holds the names of the rows a
+	// delete removes last
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	pageNum := db.Tables["t"].Indexes[0].RootPageNum
+	for {
+		node, err := db.Pager.getPage(pageNum)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageNum, err)
+		}
+		isLeaf := btree.GetNodeType(node) == btree.NODE_INDEX_LEAF
+		rightChild := btree.InternalNodeRightChild(node)
+		db.Pager.unpinPage(pageNum)
+
+		if isLeaf {
+			break
+		}
+		pageNum = rightChild
+	}
+	err = dbClose(db)
+	if err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("Failed to open database file: %v", err)
+	}
+	b := make([]byte, 1)
+	file.ReadAt(b, int64(pageNum)*4096+1000)
+	b[0] ^= 0xff
+	file.WriteAt(b, int64(pageNum)*4096+1000)
+	file.Close()
+
+	// The delete removes hundreds of rows before it reaches the corrupt
+	// page, and none of them stay removed, whether the delete runs on its
+	// own or in a transaction that goes on to commit the statements before
+	// and after it
+	result, err := runScriptOnFile("test.db", []string{
+		"delete from t where id > 0",
+		"select count(*) from t",
+		"begin",
+		"insert into t values (601, 'a')",
+		"insert into t values (601, 'b')",
+		"delete from t where id > 0",
+		"insert into t values (602, 'b')",
+		"commit",
+		"select count(*) from t",
+		"select * from t where id > 600",
+		".exit",
+	})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	corrupt := fmt.Sprintf("db > Error: Page %d is corrupt: checksum mismatch.", pageNum)
+	expected := []string{
+		corrupt,
+		"db > (600)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Duplicate key.",
+		corrupt,
+		"db > Executed.",
+		"db > Executed.",
+		"db > (602)",
+		"Executed.",
+		"db > (601, a)",
+		"(602, b)",
+		"Executed.",
+		"db > Bye!",
+	}
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCheckPassesAfterInsertsAndDeletes(t *testing.T) {
+	var commands []string
+	for i := 1; i <= 3000; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands, "delete where id between 500 and 2000", ".check", ".exit")
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > ok: 73 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[len(result)-2:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[len(result)-2:])
+	}
+}
+
+func TestCheckReportsBrokenTree(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	for i := 1; i <= 400; i++ {
+		inputBuffer := &InputBuffer{buffer: fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i)}
+		var statement Statement
+		if prepareStatement(inputBuffer, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", inputBuffer.buffer)
+		}
+		if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s'", inputBuffer.buffer)
+		}
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Expected a clean check, got %v, %v", problems, err)
+	}
+
+	// Cut the leaf chain short and point the first separator at the wrong key
+	users := db.Tables["users"]
+	root, err := db.Pager.getPageForWrite(users.RootPageNum)
+	if err != nil {
+		t.Fatalf("Failed to get root: %v", err)
+	}
+	children, keys := internalNodeEntries(root)
+	separator, _, err := record.DecodeKey(keys[0])
+	if err != nil {
+		t.Fatalf("Failed to decode separator: %v", err)
+	}
+	keys[0] = integerKey(separator.(int64) + 1)
+	setInternalNodeEntries(root, children, keys)
+	firstLeafPageNum := children[0]
+	db.Pager.unpinPage(users.RootPageNum)
+
+	leaf, err := db.Pager.getPageForWrite(firstLeafPageNum)
+	if err != nil {
+		t.Fatalf("Failed to get leaf: %v", err)
+	}
+	btree.SetLeafNodeNextLeaf(leaf, 0)
+	db.Pager.unpinPage(firstLeafPageNum)
+
+	err = dbClose(db)
+	if err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	result, err := runScriptOnFile("test.db", nil, "check")
+	if err != nil {
+		t.Fatalf("Failed to run check: %v", err)
+	}
+
+	expected := []string{
+		"Page 4 has separator key 47 for child 2, whose largest key is 46",
+		"Page 3 has key 47 outside the range above 47 up to 92 allowed by its parent",
+		"Leaf page 2 links to next leaf 0, expected 3",
+		"3 problems found",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCheckDoesNotWriteFile(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db-wal")
+
+	var commands []string
+	for i := 1; i <= 100; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+
+	// Killing the shell leaves the committed rows in the write-ahead log
+	// rather than checkpointed into the database file
+	err := runScriptAndKill("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	for _, withLog := range []bool{true, false} {
+		if !withLog {
+			_, err = runScriptOnFile("test.db", []string{".exit"})
+			if err != nil {
+				t.Fatalf("Failed to run script: %v", err)
+			}
+		}
+
+		before, err := os.ReadFile("test.db")
+		if err != nil {
+			t.Fatalf("Failed to read database file: %v", err)
+		}
+		logBefore, err := os.ReadFile("test.db-wal")
+		if withLog != (err == nil) {
+			t.Fatalf("Expected the write-ahead log to exist: %v, got %v", withLog, err)
+		}
+
+		result, err := runScriptOnFile("test.db", nil, "check")
+		if err != nil {
+			t.Fatalf("Failed to run check: %v", err)
+		}
+		if len(result) != 1 || !strings.HasPrefix(result[0], "ok: ") {
+			t.Errorf("Expected a clean check, got %v", result)
+		}
+
+		after, err := os.ReadFile("test.db")
+		if err != nil {
+			t.Fatalf("Failed to read database file: %v", err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Errorf("Expected check to leave the database file as it was")
+		}
+
+		logAfter, err := os.ReadFile("test.db-wal")
+		if withLog != (err == nil) || !bytes.Equal(logBefore, logAfter) {
+			t.Errorf("Expected check to leave the write-ahead log as it was, got %v", err)
+		}
+	}
+}
+
+func TestCheckReportsBrokenOverflowChain(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// A 10000 byte body spills onto three overflow pages, 4 to 6
+	commands := []string{
+		"create table docs (id integer, body text)",
+		"insert into docs 1 " + strings.Repeat("a", 10000),
+	}
+	for _, command := range commands {
+		inputBuffer := &InputBuffer{buffer: command}
+		var statement Statement
+		if prepareStatement(inputBuffer, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", command)
+		}
+		if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s'", command)
+		}
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Expected a clean check, got %v, %v", problems, err)
+	}
+
+	// Cut the chain after its first page
+	docs := db.Tables["docs"]
+	leaf, err := db.Pager.getPage(docs.RootPageNum)
+	if err != nil {
+		t.Fatalf("Failed to get leaf: %v", err)
+	}
+	firstOverflowPageNum := btree.LeafNodeOverflowPage(leaf, 0)
+	db.Pager.unpinPage(docs.RootPageNum)
+
+	overflowPage, err := db.Pager.getPageForWrite(firstOverflowPageNum)
+	if err != nil {
+		t.Fatalf("Failed to get overflow page: %v", err)
+	}
+	btree.SetOverflowPageNext(overflowPage, 0)
+	db.Pager.unpinPage(firstOverflowPageNum)
+
+	err = dbClose(db)
+	if err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	result, err := runScriptOnFile("test.db", nil, "check")
+	if err != nil {
+		t.Fatalf("Failed to run check: %v", err)
+	}
+
+	expected := []string{
+		"Key 1 in leaf page 3 has 1 overflow pages, expected 3",
+		"Page 4 is leaked: it is neither in the tree nor on the free list",
+		"Page 5 is leaked: it is neither in the tree nor on the free list",
+		"3 problems found",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCreateTableWithTypedColumns(t *testing.T) {
+	defer os.Remove("test.db")
+
+	commands := []string{
+		"create table pets (id integer, name text(8), weight real, photo blob, age integer)",
+		"insert into pets 1 rex 12.5 x'cafe' 3",
+		"insert into pets 2 tom 4 x'' null",
+		"insert into pets 3 felix heavy x'00' 1",
+		"insert into pets 4 mr_whiskers 1.5 x'00' 1",
+		"insert into pets 5 kitty 1.5 cafe 1",
+		"update pets 2 set age=5, weight=null",
+		"delete from pets where id = 1",
+		"create table pets (id integer)",
+		".exit",
+	}
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 26: cannot store heavy in real column weight.",
+		"db > String is too long.",
+		"db > Syntax error at line 1, column 30: cannot store cafe in blob column photo.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Table already exists.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// The schema is stored in the file
+	result, err = runScriptOnFile("test.db", []string{"insert into pets 6 rex 2e3 x'0A0b' -7", "select * from pets", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > Executed.",
+		"db > (2, tom, NULL, x'', 5)",
+		"(6, rex, 2000.0, x'0a0b', -7)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCreateTableRules(t *testing.T) {
+	commands := []string{
+		"create table t (name text, id integer)",
+		"create table t (id integer, size varchar)",
+		"create table t (id integer, id text)",
+		"create table t id integer",
+		"begin",
+		"create table docs (id integer, body text)",
+		"rollback",
+		"insert into docs 1 hello",
+		"create table docs (id integer, body text)",
+		"create table docs (id integer)",
+		"create table users (id integer)",
+		"create table toydb_master (id integer)",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > A table without a primary key must start with an integer column.",
+		"db > Syntax error at line 1, column 34: unknown column type varchar.",
+		"db > Syntax error at line 1, column 29: column id is defined twice.",
+		"db > Syntax error at line 1, column 16: expected '(', found 'id'.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > No such table 'docs'.",
+		"db > Executed.",
+		"db > Error: Table already exists.",
+		"db > Error: Table already exists.",
+		"db > Error: Table already exists.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestShortRowsShareOneLeaf(t *testing.T) {
+	var commands []string
+
+	// Fixed-size cells fit only 13 rows in a leaf however short they were
+	for i := 1; i <= 100; i++ {
+		commands = append(commands, fmt.Sprintf("insert %d u%d e%d", i, i, i))
+	}
+	commands = append(commands, ".btree", ".check", ".exit")
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Tree:",
+		"- leaf (size 100)",
+	}
+	if !equalSlices(result[100:102], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[100:102])
+	}
+
+	if result[len(result)-2] != "db > ok: 3 pages checked" {
+		t.Errorf("Expected a clean check, got '%s'", result[len(result)-2])
+	}
+}
+
+func TestInsertDefragmentsLeaf(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	run := func(command string) {
+		var statement Statement
+		if prepareStatement(&InputBuffer{buffer: command}, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", command)
+		}
+		if result := executeStatement(&statement, db); result != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s': %v", command, result)
+		}
+	}
+
+	// Eleven rows of about 330 bytes nearly fill the root leaf, and
+	// deleting every other one leaves holes between the rest
+	run("create table docs (id integer, body text)")
+	for i := 1; i <= 11; i++ {
+		run(fmt.Sprintf("insert into docs values (%d, '%s')", i, strings.Repeat("a", 300)))
+	}
+	for i := 2; i <= 10; i += 2 {
+		run(fmt.Sprintf("delete from docs where id = %d", i))
+	}
+
+	docs := db.Tables["docs"]
+	leaf, err := db.Pager.getPage(docs.RootPageNum)
+	if err != nil {
+		t.Fatalf("Failed to get leaf: %v", err)
+	}
+	isLeaf := btree.GetNodeType(leaf) == btree.NODE_LEAF
+	pointersEnd := btree.LEAF_NODE_HEADER_SIZE + (btree.LeafNodeNumCells(leaf)+1)*btree.LEAF_NODE_CELL_POINTER_SIZE
+	gap := btree.LeafNodeContentStart(leaf) - pointersEnd
+	freeSpace := btree.LeafNodeFreeSpace(leaf)
+	db.Pager.unpinPage(docs.RootPageNum)
+
+	// A row of about 930 bytes fits in the free space, but not in the gap
+	// between the cell pointers and the cells, nor in any one hole
+	if !isLeaf || gap >= 930 || freeSpace <= 1000 {
+		t.Fatalf("Expected a fragmented root leaf, got a gap of %d and %d free bytes", gap, freeSpace)
+	}
+
+	body := strings.Repeat("b", 900)
+	run(fmt.Sprintf("insert into docs values (12, '%s')", body))
+
+	leaf, err = db.Pager.getPage(docs.RootPageNum)
+	if err != nil {
+		t.Fatalf("Failed to get leaf: %v", err)
+	}
+	isLeaf = btree.GetNodeType(leaf) == btree.NODE_LEAF
+	numCells := btree.LeafNodeNumCells(leaf)
+	fragmentedBytes := btree.LeafNodeFragmentedBytes(leaf)
+	overflowPageNum := btree.LeafNodeOverflowPage(leaf, numCells-1)
+	db.Pager.unpinPage(docs.RootPageNum)
+
+	// The row went into the same leaf, whole, once the cells were packed
+	if !isLeaf || numCells != 7 || fragmentedBytes != 0 || overflowPageNum != 0 {
+		t.Errorf("Expected 7 cells in a defragmented root leaf, got %d cells, %d fragmented bytes and overflow page %d",
+			numCells, fragmentedBytes, overflowPageNum)
+	}
+
+	row, err := findRow(docs, integerKey(12))
+	if err != nil || row == nil || row.Values[1] != body {
+		t.Errorf("Expected row 12 to be readable, got %v, %v", row, err)
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected a clean check, got %v, %v", problems, err)
+	}
+}
+
+func TestRowsLargerThanPageUseOverflowPages(t *testing.T) {
+	defer os.Remove("test.db")
+
+	long := strings.Repeat("a", 10000)
+	photo := strings.Repeat("cafe", 3000)
+	commands := []string{
+		"create table docs (id integer, body text, photo blob)",
+		"insert into docs 1 " + long + " x'" + photo + "'",
+		"insert into docs 2 short x'00'",
+		"update docs 2 set body=" + long,
+		".check",
+		".exit",
+	}
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	// Row 1 takes four overflow pages and row 2 three once it is updated
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > ok: 11 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// Shrinking and deleting the rows puts their overflow pages on the free
+	// list, and reading the file back sees every byte
+	commands = []string{
+		"select * from docs",
+		"update docs 1 set body=tiny",
+		"delete from docs where id = 2",
+		".check",
+		"select * from docs",
+		".exit",
+	}
+
+	result, err = runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > (1, " + long + ", x'" + photo + "')",
+		"(2, " + long + ", x'00')",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > ok: 11 pages checked",
+		"db > (1, tiny, x'" + photo + "')",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCatalogListsTables(t *testing.T) {
+	defer os.Remove("test.db")
+
+	commands := []string{
+		"create table pets (id integer, name text(16))",
+		"create table notes (id integer, body text, score real)",
+		"insert into pets 1 rex",
+		"insert into notes 1 hello 2.5",
+		"insert 1 user1 person1@example.com",
+		"insert into nope 1",
+		"update pets 1 set name=felix",
+		"update 1 set username=admin",
+		".tables",
+		".schema",
+		".schema pets",
+		".schema nope",
+		".exit",
+	}
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > No such table 'nope'.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > notes",
+		"pets",
+		"users",
+		"db > create table notes (id integer, body text, score real)",
+		"create table pets (id integer, name text(16))",
+		"create table users (id integer, username text(32), email text(255))",
+		"db > create table pets (id integer, name text(16))",
+		"db > No such table 'nope'.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// Every table keeps its own rows across a reopen
+	commands = []string{
+		"select",
+		"select * from pets",
+		"select * from notes",
+		"delete from notes where id = 1",
+		"select * from notes",
+		"select * from",
+		".exit",
+	}
+
+	result, err = runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > (1, admin, person1@example.com)",
+		"Executed.",
+		"db > (1, felix)",
+		"Executed.",
+		"db > (1, hello, 2.5)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 14: expected a table name, found end of input.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestTablesGrowIndependently(t *testing.T) {
+	defer os.Remove("test.db")
+
+	// Interleave inserts so that the roots of both tables move while pages
+	// of the other are being allocated
+	commands := []string{"create table pets (id integer, name text)"}
+	for i := 1; i <= 500; i++ {
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i),
+			fmt.Sprintf("insert into pets %d pet%d", 1000-i, i))
+	}
+	commands = append(commands, "delete from pets where id < 900", ".exit")
+
+	_, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected a clean check, got %v, %v", problems, err)
+	}
+
+	users, err := tableKeysInRange(db.Tables["users"], KeyRange{})
+	if err != nil || len(users) != 500 || !bytes.Equal(users[0], integerKey(1)) || !bytes.Equal(users[499], integerKey(500)) {
+		t.Errorf("Expected users 1 to 500, got %v, %v", users, err)
+	}
+
+	pets, err := tableKeysInRange(db.Tables["pets"], KeyRange{})
+	if err != nil || len(pets) != 100 || !bytes.Equal(pets[0], integerKey(900)) || !bytes.Equal(pets[99], integerKey(999)) {
+		t.Errorf("Expected pets 900 to 999, got %v, %v", pets, err)
+	}
+
+	if db.Tables["users"].RootPageNum == 2 {
+		t.Errorf("Expected the users root to have moved off page 2")
+	}
+
+	err = dbClose(db)
+	if err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+}
+
+func TestQuotedStringsAndSQLStatements(t *testing.T) {
+	commands := []string{
+		"insert 1 'john smith' 'a, b (c)@example.com'",
+		"insert into users (id, username) values (2, 'it''s me');",
+		"INSERT INTO users VALUES (3, 'x', 'y') -- the third user",
+		"update users set email = 'new@example.com', username = 'z' where id = 3",
+		"/* all of them */ Select * From users",
+		"delete from users where id between 2 and 2",
+		"select",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (1, john smith, a, b (c)@example.com)",
+		"(2, it's me, NULL)",
+		"(3, z, new@example.com)",
+		"Executed.",
+		"db > Executed.",
+		"db > (1, john smith, a, b (c)@example.com)",
+		"(3, z, new@example.com)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestSyntaxErrorsShowPosition(t *testing.T) {
+	commands := []string{
+		"insert 1 'unterminated",
+		"insert 1 a b extra",
+		"insert into users (id) values (1, 'a')",
+		"insert into users (username) values ('a')",
+		"insert into users values (1, 2, 'b')",
+		"update users set id = 5 where id = 1",
+		"update users set email = 'x'",
+		"update users set nope = 1 where id = 1",
+		"delete from users where email = 5",
+		"select * from users where",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Syntax error at line 1, column 10: unterminated string.",
+		"db > Syntax error at line 1, column 1: table users has 3 columns but 4 values were given.",
+		"db > Syntax error at line 1, column 1: the number of values does not match the number of columns.",
+		"db > Syntax error at line 1, column 1: no value for the primary key id.",
+		"db > Syntax error at line 1, column 30: cannot store 2 in text column username.",
+		"db > Syntax error at line 1, column 18: the primary key id cannot be changed.",
+		"db > Syntax error at line 1, column 1: UPDATE needs WHERE id = <key>.",
+		"db > Syntax error at line 1, column 18: table users has no column nope.",
+		"db > Syntax error at line 1, column 25: cannot compare text with integer.",
+		"db > Syntax error at line 1, column 26: expected a value, found end of input.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// Positions count lines and columns across a statement of several lines
+	_, err = parser.Parse("create table pets (\n  id integer,\n  name text(0)\n)")
+	if err == nil || err.Error() != "line 3, column 13: expected a length of at least 1, found '0'" {
+		t.Errorf("Expected an error at line 3, column 13, got %v", err)
+	}
+
+	_, err = parser.Parse("select /* a comment\nthat never ends")
+	if err == nil || err.Error() != "line 1, column 8: unterminated comment" {
+		t.Errorf("Expected an unterminated comment, got %v", err)
+	}
+}
+
+func TestWhereClauseFiltersRows(t *testing.T) {
+	commands := []string{
+		"create table pets (id integer, name text(16), weight real, age integer)",
+		"insert into pets values (1, 'Rex', 12.5, 3)",
+		"insert into pets values (2, 'tom', 4, null)",
+		"insert into pets values (3, 'Felix', 5.5, 1)",
+		"insert into pets values (4, 'rover', 30, 10)",
+		"insert into pets values (5, null, 2, 2)",
+		"select * from pets where id = 3",
+		"select * from pets where id >= 2 and id < 4",
+		"select * from pets where weight * 2 > 20 or age is null",
+		"select * from pets where name like 'r%' and not age between 4 and 9",
+		"select * from pets where id in (5, 1, 9) and name is not null",
+		"select * from pets where age % 2 = 1 and id <> 1",
+		"select * from pets where name || '!' = 'tom!' or -age < -5",
+		"select * from pets where age not in (1, 2, 3)",
+		"select * from pets where weight / 0 is null and id between 5 and 1",
+		"delete from pets where weight < 5 or name like '%x'",
+		"select * from pets",
+		"select * from pets where name = 1",
+		"select * from pets where name",
+		"select * from pets where size > 1",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (3, Felix, 5.5, 1)",
+		"Executed.",
+		"db > (2, tom, 4.0, NULL)",
+		"(3, Felix, 5.5, 1)",
+		"Executed.",
+		"db > (1, Rex, 12.5, 3)",
+		"(2, tom, 4.0, NULL)",
+		"(4, rover, 30.0, 10)",
+		"Executed.",
+		"db > (1, Rex, 12.5, 3)",
+		"(4, rover, 30.0, 10)",
+		"Executed.",
+		"db > (1, Rex, 12.5, 3)",
+		"Executed.",
+		"db > (3, Felix, 5.5, 1)",
+		"Executed.",
+		"db > (2, tom, 4.0, NULL)",
+		"(4, rover, 30.0, 10)",
+		"Executed.",
+		"db > (4, rover, 30.0, 10)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (4, rover, 30.0, 10)",
+		"Executed.",
+		"db > Syntax error at line 1, column 26: cannot compare text with integer.",
+		"db > Syntax error at line 1, column 26: WHERE needs a condition, not a text value.",
+		"db > Syntax error at line 1, column 26: table pets has no column size.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestWhereClauseNarrowsKeyRange(t *testing.T) {
+	key := integerKey
+	none := KeyRange{Low: key(1), High: key(0)}
+	tests := []struct {
+		where    string
+		expected KeyRange
+	}{
+		{"id = 7", KeyRange{Low: key(7), High: key(7)}},
+		{"id >= 10 and id < 20 and username like 'a%'", KeyRange{Low: key(10), High: key(19)}},
+		{"5 < id and id <= 4294967295", KeyRange{Low: key(6), High: key(math.MaxUint32)}},
+		{"id between 3 and 8 and id > 5", KeyRange{Low: key(6), High: key(8)}},
+		{"id in (9, 4, 12)", KeyRange{Low: key(4), High: key(12)}},
+		{"id > 9223372036854775806", KeyRange{Low: key(math.MaxInt64)}},
+		{"id > 9223372036854775807", none},
+		{"id = -1", none},
+		{"id < 0", none},
+		{"id > -3", KeyRange{}},
+		{"id = 3 or id = 4", KeyRange{}},
+		{"not id = 3", KeyRange{}},
+		{"email = 'a' and id not between 1 and 5", KeyRange{}},
+	}
+
+	for _, test := range tests {
+		parsed, err := parser.Parse("select * from users where " + test.where)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", test.where, err)
+		}
+
+		keys := whereKeyRange(parsed.(*parser.SelectStatement).Where, defaultSchema())
+		if !equalKeyRanges(keys, test.expected) {
+			t.Errorf("Expected %x for %q, got %x", test.expected, test.where, keys)
+		}
+	}
+}
+
+// equalKeyRanges reports whether two key ranges have the same ends, where
+// nil ends are open
+func equalKeyRanges(a, b KeyRange) bool {
+	return (a.Low == nil) == (b.Low == nil) && bytes.Equal(a.Low, b.Low) &&
+		(a.High == nil) == (b.High == nil) && bytes.Equal(a.High, b.High)
+}
+
+func TestSelectListProjectsColumns(t *testing.T) {
+	commands := []string{
+		"insert 1 user1 a@gmail.com",
+		"insert 2 bob b@example.com",
+		"insert 3 eve null",
+		"select email, id * 2 as x from users",
+		"select id k, username || '!' from users where k >= 2",
+		"select *, id from users where id = 3",
+		"select id as email from users where email like 'b%'",
+		"select 1.5 + id, null, email is null from users where id between 1 and 3 and x > 2",
+		"select email as from users",
+		"select * from users",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (a@gmail.com, 2)",
+		"(b@example.com, 4)",
+		"(NULL, 6)",
+		"Executed.",
+		"db > (2, bob!)",
+		"(3, eve!)",
+		"Executed.",
+		"db > (3, eve, NULL, 3)",
+		"Executed.",
+		"db > (2)",
+		"Executed.",
+		"db > Syntax error at line 1, column 78: table users has no column x.",
+		"db > Syntax error at line 1, column 17: expected an alias, found 'from'.",
+		"db > (1, user1, a@gmail.com)",
+		"(2, bob, b@example.com)",
+		"(3, eve, NULL)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestOrderByLimitAndOffset(t *testing.T) {
+	commands := []string{
+		"create table pets (id integer, name text(20), age integer)",
+		"insert into pets values (3, 'rex', 5)",
+		"insert into pets values (1, 'ada', null)",
+		"insert into pets values (2, 'bob', 2)",
+		"insert into pets values (4, 'cy', 5)",
+		"select * from pets order by id desc",
+		"select name, age from pets order by age desc, name",
+		"select * from pets order by age",
+		"select name as n from pets order by n limit 2 offset 1",
+		"select * from pets order by 2 desc limit 1",
+		"select * from pets where id < 4 order by id desc limit 2",
+		"select * from pets limit 0",
+		"select * from pets order by 4",
+		"select * from pets limit -1",
+		"select * from pets limit 1 offset 'a'",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (4, cy, 5)",
+		"(3, rex, 5)",
+		"(2, bob, 2)",
+		"(1, ada, NULL)",
+		"Executed.",
+		"db > (cy, 5)",
+		"(rex, 5)",
+		"(bob, 2)",
+		"(ada, NULL)",
+		"Executed.",
+		"db > (1, ada, NULL)",
+		"(2, bob, 2)",
+		"(3, rex, 5)",
+		"(4, cy, 5)",
+		"Executed.",
+		"db > (bob)",
+		"(cy)",
+		"Executed.",
+		"db > (3, rex, 5)",
+		"Executed.",
+		"db > (3, rex, 5)",
+		"(2, bob, 2)",
+		"Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 29: ORDER BY term 4 is not between 1 and 3.",
+		"db > Syntax error at line 1, column 26: LIMIT needs a whole number of at least 0.",
+		"db > Syntax error at line 1, column 35: OFFSET needs a whole number of at least 0.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestOrderByKeyDescendingAcrossLeaves(t *testing.T) {
+	var commands []string
+	for i := 1; i <= 500; i++ {
+		commands = append(commands, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands,
+		"select id from users order by id desc",
+		"select id from users where id between 100 and 300 order by id desc limit 5 offset 10",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	var expected []string
+	for i := 500; i >= 1; i-- {
+		expected = append(expected, fmt.Sprintf("(%d)", i))
+	}
+	expected = append(expected, "Executed.")
+	for i := 290; i > 285; i-- {
+		expected = append(expected, fmt.Sprintf("(%d)", i))
+	}
+	expected = append(expected, "Executed.")
+
+	got := result[500:]
+	got[0] = strings.TrimPrefix(got[0], "db > ")
+	got[501] = strings.TrimPrefix(got[501], "db > ")
+	if !equalSlices(got[:len(expected)], expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestAggregatesAndGroupBy(t *testing.T) {
+	commands := []string{
+		"create table pets (id integer, name text(20), kind text, age integer, weight real)",
+		"select count(*), min(id), max(id), sum(age), avg(age) from pets",
+		"insert into pets values (3, 'rex', 'dog', 5, 20.5)",
+		"insert into pets values (1, 'ada', 'cat', null, 4.0)",
+		"insert into pets values (2, 'bob', 'dog', 2, 12.0)",
+		"insert into pets values (4, 'cy', 'cat', 5, 3.5)",
+		"insert into pets values (5, 'dot', null, 1, null)",
+		"select count(*), min(id), max(id), sum(age), avg(age) from pets",
+		"select count(age), count(kind), sum(weight), min(name), max(name) from pets",
+		"select kind, count(*), sum(weight) from pets group by kind",
+		"select kind, count(*) as n from pets group by kind having n > 1 order by n desc, kind",
+		"select kind, max(age) from pets where id > 1 group by 1 order by 2",
+		"select count(*) from pets having count(*) > 10",
+		"select count(*) from pets where count(*) > 1",
+		"select sum(name) from pets",
+		"select count(id, name) from pets",
+		"select max(min(id)) from pets",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > (0, NULL, NULL, NULL, NULL)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (5, 1, 5, 13, 3.25)",
+		"Executed.",
+		"db > (4, 4, 40.0, ada, rex)",
+		"Executed.",
+		"db > (cat, 2, 7.5)",
+		"(dog, 2, 32.5)",
+		"(NULL, 1, NULL)",
+		"Executed.",
+		"db > (cat, 2)",
+		"(dog, 2)",
+		"Executed.",
+		"db > (NULL, 1)",
+		"(dog, 5)",
+		"(cat, 5)",
+		"Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 33: count() cannot be used here.",
+		"db > Syntax error at line 1, column 12: sum() adds up numbers, not text values.",
+		"db > Syntax error at line 1, column 8: count() takes 1 argument.",
+		"db > Syntax error at line 1, column 12: min() cannot be used here.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCountAndKeyBoundsAcrossLeaves(t *testing.T) {
+	var commands []string
+	for i := 1; i <= 500; i++ {
+		commands = append(commands, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	commands = append(commands,
+		"delete from users where id < 20 or id > 490 or id % 10 = 0",
+		"select count(*), min(id), max(id) from users",
+		"select count(*), min(id), max(id) from users where id between 100 and 199",
+		"select id % 3, count(*) from users group by id % 3",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > (423, 21, 489)",
+		"Executed.",
+		"db > (90, 101, 199)",
+		"Executed.",
+		"db > (0, 141)",
+		"(1, 141)",
+		"(2, 141)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[500:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[500:])
+	}
+}
+
+func TestScalarFunctions(t *testing.T) {
+	commands := []string{
+		"insert 1 Alice alice@gmail.com",
+		"insert 2 bob bob@example.com",
+		"insert 3 carol carol@gmail.com",
+		"select substr(email, instr(email, '@') + 1) as domain, count(*) from users group by domain",
+		"select upper(username), lower(username), length(email) from users where id = 1",
+		"select foo(id) from users",
+		"select lower(id) from users",
+		"select substr(email) from users",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (gmail.com, 2)",
+		"(example.com, 1)",
+		"Executed.",
+		"db > (ALICE, alice, 15)",
+		"Executed.",
+		"db > Syntax error at line 1, column 8: no such function foo().",
+		"db > Syntax error at line 1, column 14: argument 1 of lower() must be text, not integer.",
+		"db > Syntax error at line 1, column 8: substr() takes 2 or 3 arguments.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	substrTests := []struct {
+		text          string
+		start, length int64
+		expected      string
+	}{
+		{"hello", 2, 3, "ell"},
+		{"hello", 2, math.MaxInt64, "ello"},
+		{"hello", -3, 2, "ll"},
+		{"hello", 0, 2, "h"},
+		{"hello", 4, -2, "el"},
+		{"hello", 9, 2, ""},
+		{"hello", -9, 6, "he"},
+		{"héllo", 2, 2, "él"},
+	}
+
+	for _, test := range substrTests {
+		if got := substr(test.text, test.start, test.length); got != test.expected {
+			t.Errorf("substr(%q, %d, %d) = %q, expected %q", test.text, test.start, test.length, got, test.expected)
+		}
+	}
+}
+
+func TestCreateIndexMaintainsLookups(t *testing.T) {
+	defer os.Remove("test.db")
+
+	commands := []string{
+		"insert 1 alice alice@example.com",
+		"insert 2 bob bob@example.com",
+		"insert 3 carol carol@example.com",
+		"insert 4 dave null",
+		"create index users_email on users (email)",
+		"insert 5 erin bob@example.com",
+		"select * from users where email = 'bob@example.com'",
+		"update users set email = 'zed@example.com' where id = 2",
+		"select id from users where email = 'bob@example.com'",
+		"select id from users where email >= 'c' order by id desc",
+		"select id from users where email is null",
+		"delete from users where email < 'b'",
+		"select id, email from users where email > 'a'",
+		"create index users_email on users (username)",
+		"create index by_name on users (nickname)",
+		"create index by_name on pets (name)",
+		".schema users",
+		".check",
+		".exit",
+	}
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (2, bob, bob@example.com)",
+		"(5, erin, bob@example.com)",
+		"Executed.",
+		"db > Executed.",
+		"db > (5)",
+		"Executed.",
+		"db > (3)",
+		"(2)",
+		"Executed.",
+		"db > (4)",
+		"Executed.",
+		"db > Executed.",
+		"db > (2, zed@example.com)",
+		"(3, carol@example.com)",
+		"(5, bob@example.com)",
+		"Executed.",
+		"db > Error: Index already exists.",
+		"db > Syntax error at line 1, column 32: table users has no column nickname.",
+		"db > No such table 'pets'.",
+		"db > create table users (id integer, username text(32), email text(255))",
+		"create index users_email on users (email)",
+		"db > ok: 4 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// The index is in the catalog, so it is still used after reopening
+	result, err = runScriptOnFile("test.db", []string{
+		"select id from users where email = 'carol@example.com'",
+		"insert 6 frank carol@example.com",
+		"select id from users where email = 'carol@example.com'",
+		".exit",
+	})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > (3)",
+		"Executed.",
+		"db > Executed.",
+		"db > (3)",
+		"(6)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestIndexOverManyRows(t *testing.T) {
+	title := func(i int) string {
+		return fmt.Sprintf("%c%s%05d", 'a'+i%4, strings.Repeat("x", 300), i)
+	}
+
+	commands := []string{
+		"create table docs (id integer, title text)",
+		"create index docs_title on docs (title)",
+	}
+	for i := 1; i <= 1500; i++ {
+		commands = append(commands, fmt.Sprintf("insert into docs values (%d, '%s')", i, title(i)))
+	}
+	commands = append(commands,
+		"select count(*) from docs where title > 'b' and title < 'c'",
+		fmt.Sprintf("select id from docs where title = '%s'", title(777)),
+		"delete from docs where id % 3 <> 0",
+		"select count(*) from docs where title >= 'c'",
+		"delete from docs where title >= 'b'",
+		"select count(*), min(id), max(id) from docs",
+		".check",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > (375)",
+		"Executed.",
+		"db > (777)",
+		"Executed.",
+		"db > Executed.",
+		"db > (250)",
+		"Executed.",
+		"db > Executed.",
+		"db > (125, 12, 1500)",
+		"Executed.",
+		"db > ok: 466 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[1502:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[1502:])
+	}
+}
+
+func TestWhereClauseChoosesIndex(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	for _, sql := range []string{
+		"create index users_email on users (email)",
+		"create index users_username on users (username)",
+	} {
+		inputBuffer := &InputBuffer{buffer: sql}
+		var statement Statement
+		if prepareStatement(inputBuffer, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", sql)
+		}
+		if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s'", sql)
+		}
+	}
+
+	tests := []struct {
+		where    string
+		expected string // Name of the index used, empty for none
+	}{
+		{"email = 'a@example.com'", "users_email"},
+		{"'a' <= username", "users_username"},
+		{"username > 'a' and email = 'b@example.com'", "users_email"},
+		{"email between 'a' and 'b' and id % 2 = 0", "users_email"},
+		{"email in ('a', 'b')", "users_email"},
+		{"username is null", "users_username"},
+		{"id = 3 and email = 'a@example.com'", ""},
+		{"email = 'a' or username = 'b'", ""},
+		{"email like 'a%'", ""},
+		{"lower(email) = 'a'", ""},
+	}
+
+	for _, test := range tests {
+		inputBuffer := &InputBuffer{buffer: "select * from users where " + test.where}
+		var statement Statement
+		if prepareStatement(inputBuffer, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare %q: %v", test.where, statement.SyntaxError)
+		}
+
+		name := ""
+		if statement.IndexToScan != nil {
+			name = statement.IndexToScan.Index.Name
+		}
+		if name != test.expected {
+			t.Errorf("Expected index %q for %q, got %q", test.expected, test.where, name)
+		}
+	}
+}
+
+func TestCheckReportsBrokenIndex(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	commands := []string{"create index users_email on users (email)"}
+	for i := 1; i <= 50; i++ {
+		commands = append(commands, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	for _, sql := range commands {
+		inputBuffer := &InputBuffer{buffer: sql}
+		var statement Statement
+		if prepareStatement(inputBuffer, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", sql)
+		}
+		if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s'", sql)
+		}
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Expected a clean check, got %v, %v", problems, err)
+	}
+
+	// Drop the entries of rows 7 and 8, and point the entry of row 8 at row
+	// 99 instead, which does not exist
+	users := db.Tables["users"]
+	index := users.Indexes[0]
+	var row *Row
+	for _, id := range []int64{7, 8} {
+		row, err = findRow(users, integerKey(id))
+		if err != nil {
+			t.Fatalf("Failed to find row %d: %v", id, err)
+		}
+		key, err := indexKey(index, row)
+		if err != nil {
+			t.Fatalf("Failed to build index key: %v", err)
+		}
+		err = indexDelete(db.Pager, index, key)
+		if err != nil {
+			t.Fatalf("Failed to delete index key: %v", err)
+		}
+	}
+
+	key, err := indexKey(index, &Row{Key: integerKey(99), Values: row.Values})
+	if err != nil {
+		t.Fatalf("Failed to build index key: %v", err)
+	}
+	err = indexInsert(db.Pager, index, key)
+	if err != nil {
+		t.Fatalf("Failed to insert index key: %v", err)
+	}
+
+	problems, err = checkIntegrity(db)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+
+	expected := []string{
+		"Index users_email has an entry for row 99 that does not match the row",
+		"Index users_email has no entry for row 7",
+		"Index users_email has no entry for row 8",
+	}
+
+	if !equalSlices(problems, expected) {
+		t.Errorf("Expected %v, got %v", expected, problems)
+	}
+}
+
+// Helper function to compare slices
+func equalSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	defer os.Remove("test.db")
+
+	commands := []string{
+		"create table people (id integer, email text unique, nick text(8))",
+		"insert into people values (1, 'amy@example.com', 'amy')",
+		"insert into people values (2, 'amy@example.com', 'bo')",
+		"insert into people values (2, null, 'bo')",
+		"insert into people values (3, null, 'bo')",
+		"update people set email = 'amy@example.com' where id = 3",
+		"update people set email = 'amy@example.com' where id = 1",
+		"create unique index people_nick on people (nick)",
+		"update people set nick = 'cy' where id = 3",
+		"create unique index people_nick on people (nick)",
+		"begin",
+		"insert into people values (4, 'dee@example.com', 'dee')",
+		"insert into people values (5, 'eve@example.com', 'cy')",
+		"commit",
+		"select * from people",
+		".schema people",
+		".check",
+		".exit",
+	}
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: UNIQUE constraint toydb_autoindex_people_email failed on people.email.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: UNIQUE constraint toydb_autoindex_people_email failed on people.email.",
+		"db > Executed.",
+		"db > Error: UNIQUE constraint people_nick failed on people.nick.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: UNIQUE constraint people_nick failed on people.nick.",
+		"db > Executed.",
+		"db > (1, amy@example.com, amy)",
+		"(2, NULL, bo)",
+		"(3, NULL, cy)",
+		"(4, dee@example.com, dee)",
+		"Executed.",
+		"db > create table people (id integer, email text unique, nick text(8))",
+		"create unique index people_nick on people (nick)",
+		"db > ok: 6 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// Both constraints are still enforced after reopening
+	result, err = runScriptOnFile("test.db", []string{
+		"insert into people values (6, 'dee@example.com', 'fay')",
+		"insert into people values (6, 'fay@example.com', 'dee')",
+		"insert into people values (6, 'fay@example.com', 'fay')",
+		".exit",
+	})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > Error: UNIQUE constraint toydb_autoindex_people_email failed on people.email.",
+		"db > Error: UNIQUE constraint people_nick failed on people.nick.",
+		"db > Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestUniqueViolationNamesConstraint(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	for _, sql := range []string{"create unique index users_email on users (email)", "insert 1 alice alice@example.com"} {
+		var statement Statement
+		if prepareStatement(&InputBuffer{buffer: sql}, &statement, db) != PREPARE_SUCCESS {
+			t.Fatalf("Failed to prepare '%s'", sql)
+		}
+		if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to execute '%s'", sql)
+		}
+	}
+
+	var statement Statement
+	if prepareStatement(&InputBuffer{buffer: "insert 2 bob alice@example.com"}, &statement, db) != PREPARE_SUCCESS {
+		t.Fatalf("Failed to prepare insert")
+	}
+
+	result := executeStatement(&statement, db)
+	if result != EXECUTE_UNIQUE_VIOLATION {
+		t.Fatalf("Expected EXECUTE_UNIQUE_VIOLATION, got %d", result)
+	}
+
+	var violation *ConstraintError
+	if !errors.As(statement.Violation, &violation) {
+		t.Fatalf("Expected a *ConstraintError, got %v", statement.Violation)
+	}
+	if violation.Index != "users_email" || violation.Table != "users" || violation.Column != "email" {
+		t.Errorf("Expected the constraint users_email on users.email, got %+v", violation)
+	}
+
+	row, err := findRow(db.Tables["users"], integerKey(2))
+	if err != nil || row != nil {
+		t.Errorf("Expected row 2 not to be inserted, got %v, %v", row, err)
+	}
+}
+
+func TestAutoIndexNameTaken(t *testing.T) {
+	defer os.Remove("test.db")
+
+	// a_b.c and a.b_c would both have the index toydb_autoindex_a_b_c, and
+	// so would b.c once a user index has its name
+	result, err := runScriptOnFile("test.db", []string{
+		"create table a_b (id integer, c text unique)",
+		"create table a (id integer, b_c text unique)",
+		"create index toydb_autoindex_b_c on a_b (c)",
+		"create table b (id integer, c text unique)",
+		"create table a (id integer, b_c text)",
+		".exit",
+	})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Error: Index already exists.",
+		"db > Executed.",
+		"db > Error: Index already exists.",
+		"db > Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	result, err = runScriptOnFile("test.db", []string{".tables", ".check", ".exit"})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > a",
+		"a_b",
+		"users",
+		"db > ok: 7 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestDuplicateKeyInMultiLevelTree(t *testing.T) {
+	var commands []string
+	for i := 1; i <= 1000; i++ {
+		id := (i * 37) % 1001
+		commands = append(commands,
+			fmt.Sprintf("insert %d user%d person%d@example.com", id, id, id))
+	}
+
+	// The first, last and some middle keys, none of which are in the root
+	for _, id := range []int{1, 500, 999, 1000} {
+		commands = append(commands, fmt.Sprintf("insert %d other other@example.com", id))
+	}
+	commands = append(commands, "select * from users where id = 500", ".check", ".exit")
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Error: Duplicate key.",
+		"db > Error: Duplicate key.",
+		"db > Error: Duplicate key.",
+		"db > Error: Duplicate key.",
+		"db > (500, user500, person500@example.com)",
+		"Executed.",
+		"db > ok: 19 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[1000:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[1000:])
+	}
+}
+
+// treeHeight returns the number of levels of a table's B-tree
+func treeHeight(t *testing.T, table *Table) int {
+	height := 1
+	pageNum := table.RootPageNum
+	for {
+		node, err := table.Pager.getPage(pageNum)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageNum, err)
+		}
+		isLeaf := btree.GetNodeType(node) == btree.NODE_LEAF
+		child := btree.InternalNodeChild(node, 0)
+		table.Pager.unpinPage(pageNum)
+
+		if isLeaf {
+			return height
+		}
+		height++
+		pageNum = child
+	}
+}
+
+func TestDuplicateKeysAcrossTreeHeights(t *testing.T) {
+	defer os.Remove("test.db")
+
+	db, err := dbOpen("test.db", 16)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbClose(db)
+
+	var statement Statement
+	if prepareStatement(&InputBuffer{buffer: "create table docs (id integer, body text)"}, &statement, db) != PREPARE_SUCCESS {
+		t.Fatalf("Failed to prepare create table")
+	}
+	if executeStatement(&statement, db) != EXECUTE_SUCCESS {
+		t.Fatalf("Failed to create table")
+	}
+	docs := db.Tables["docs"]
+
+	// Rows of about a thousand bytes put a few in each leaf, so a few
+	// thousand of them in random order grow the tree to three levels
+	body := func(key int64, version string) string {
+		return fmt.Sprintf("%s %d %s", version, key, strings.Repeat("x", 900))
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var inserted []int64
+	duplicatesAtHeight := make(map[int]int)
+	for _, n := range rng.Perm(3000) {
+		key := int64(n + 1)
+		result, err := insertRow(docs, &Row{Key: integerKey(key), Values: []record.Value{key, body(key, "first")}})
+		if err != nil || result != EXECUTE_SUCCESS {
+			t.Fatalf("Failed to insert row %d: %v, %v", key, result, err)
+		}
+		inserted = append(inserted, key)
+
+		// Insert the new key again and a random earlier one, which can be
+		// in any leaf
+		height := treeHeight(t, docs)
+		for _, duplicate := range []int64{key, inserted[rng.Intn(len(inserted))]} {
+			result, err := insertRow(docs, &Row{Key: integerKey(duplicate), Values: []record.Value{duplicate, body(duplicate, "second")}})
+			if err != nil || result != EXECUTE_DUPLICATE_KEY {
+				t.Fatalf("Expected row %d to be a duplicate at height %d, got %v, %v", duplicate, height, result, err)
+			}
+			duplicatesAtHeight[height]++
+		}
+	}
+
+	for height := 1; height <= 3; height++ {
+		if duplicatesAtHeight[height] == 0 {
+			t.Errorf("Expected duplicates to be tried at height %d, got %v", height, duplicatesAtHeight)
+		}
+	}
+
+	keys, err := tableKeysInRange(docs, KeyRange{})
+	if err != nil {
+		t.Fatalf("Failed to scan table: %v", err)
+	}
+	if len(keys) != 3000 {
+		t.Errorf("Expected 3000 rows, got %d", len(keys))
+	}
+
+	// No duplicate replaced the row it clashed with
+	for _, key := range []int64{1, 2, 1500, 2999, 3000} {
+		row, err := findRow(docs, integerKey(key))
+		if err != nil || row == nil || row.Values[1] != body(key, "first") {
+			t.Errorf("Expected row %d to keep its first body, got %v, %v", key, row, err)
+		}
+	}
+
+	problems, err := checkIntegrity(db)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected a clean check, got %v, %v", problems, err)
+	}
+}
+
+func TestInsertOnConflict(t *testing.T) {
+	commands := []string{
+		"create table people (id integer, email text unique, nick text(8))",
+		"create index people_nick on people (nick)",
+		"insert into people values (1, 'amy@example.com', 'amy')",
+		"insert into people values (1, 'bo@example.com', 'bo')",
+		"insert into people values (1, 'bo@example.com', 'bo') on conflict do nothing",
+		"insert into people values (1, 'bo@example.com', 'bo') on conflict (id) do update set email = excluded.email",
+		"insert into people (id, nick) values (2, 'cy') on conflict (id) do update set nick = 'zed'",
+		"insert into people (id, nick) values (2, 'dee') on conflict (id) do update set nick = excluded.nick, email = 'dee@example.com'",
+		"insert or replace into people values (2, 'bo@example.com', 'eve')",
+		"insert or replace into people values (3, 'eve@example.com', 'eve')",
+		"insert or replace into people values (1, null, null)",
+		"insert into people values (4, 'fay@example.com', 'fay') on conflict (email) do nothing",
+		"insert or replace into people values (4, 'fay@example.com', 'fay') on conflict do nothing",
+		"insert into people values (4, 'fay@example.com', 'fay') on conflict (id) do update set id = 5",
+		"insert into people values (4, 'fay@example.com', 'fay') on conflict (id) do update set nick = other.nick",
+		"select * from people",
+		"select id from people where nick = 'eve'",
+		".check",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Duplicate key.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 70: ON CONFLICT can only name the primary key id.",
+		"db > Syntax error at line 1, column 68: INSERT OR REPLACE cannot have an ON CONFLICT clause.",
+		"db > Syntax error at line 1, column 88: the primary key id cannot be changed.",
+		"db > Syntax error at line 1, column 95: expected a value for column nick.",
+		"db > (1, NULL, NULL)",
+		"(2, bo@example.com, eve)",
+		"(3, eve@example.com, eve)",
+		"Executed.",
+		"db > (2)",
+		"(3)",
+		"Executed.",
+		"db > ok: 6 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestConflictsInUniqueIndexes(t *testing.T) {
+	commands := []string{
+		"create table people (id integer, email text unique, phone text unique)",
+		"insert into people values (1, 'amy@example.com', '555-0101')",
+		"insert into people values (2, 'bo@example.com', '555-0102')",
+		"insert into people values (3, 'cy@example.com', '555-0103')",
+		"insert into people values (4, 'amy@example.com', '555-0104')",
+		"insert into people values (4, 'amy@example.com', '555-0104') on conflict (id) do nothing",
+		"insert into people values (4, 'amy@example.com', '555-0104') on conflict do nothing",
+		"insert into people values (2, 'dee@example.com', '555-0104') on conflict do nothing",
+		"select count(*) from people",
+		"insert or replace into people values (4, 'amy@example.com', '555-0102')",
+		"select * from people",
+		"insert or replace into people values (3, 'amy@example.com', '555-0103')",
+		"select * from people",
+		".check",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: UNIQUE constraint toydb_autoindex_people_email failed on people.email.",
+		"db > Error: UNIQUE constraint toydb_autoindex_people_email failed on people.email.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (3)",
+		"Executed.",
+		"db > Executed.",
+		"db > (3, cy@example.com, 555-0103)",
+		"(4, amy@example.com, 555-0102)",
+		"Executed.",
+		"db > Executed.",
+		"db > (3, amy@example.com, 555-0103)",
+		"Executed.",
+		"db > ok: 6 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestInsertOrReplaceAcrossLeaves(t *testing.T) {
+	commands := []string{"create index users_email on users (email)"}
+	for i := 1; i <= 300; i++ {
+		id := (i * 37) % 301
+		commands = append(commands, fmt.Sprintf("insert %d user%d person%d@example.com", id, id, id))
+	}
+
+	// Replay the batch with new emails, along with some new rows
+	for i := 1; i <= 400; i++ {
+		commands = append(commands, fmt.Sprintf("insert or replace %d user%d new%d@example.com", i, i, i))
+	}
+	commands = append(commands,
+		"select count(*), min(id), max(id) from users where email >= 'new'",
+		"select * from users where email = 'new150@example.com'",
+		"select count(*) from users where email > 'p'",
+		".check",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > (400, 1, 400)",
+		"Executed.",
+		"db > (150, user150, new150@example.com)",
+		"Executed.",
+		"db > (0)",
+		"Executed.",
+		"db > ok: 17 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[701:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[701:])
+	}
+}
+
+func TestTextPrimaryKey(t *testing.T) {
+	commands := []string{
+		"create table tags (name text primary key, hits integer)",
+		"insert into tags values ('go', 3)",
+		"insert into tags values ('alpha', 1)",
+		"insert into tags values ('zeta', 9)",
+		"insert into tags values ('go', 4)",
+		"insert into tags values (null, 4)",
+		"insert into tags (hits) values (4)",
+		"select * from tags",
+		"select * from tags where name >= 'b' order by name desc",
+		"update tags set hits = 10 where name = 'go'",
+		"update tags set name = 'ruby' where name = 'go'",
+		"delete from tags where name < 'h'",
+		"select * from tags",
+		".schema tags",
+		".check",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Duplicate key.",
+		"db > Syntax error at line 1, column 26: the primary key name cannot be NULL.",
+		"db > Syntax error at line 1, column 1: no value for the primary key name.",
+		"db > (alpha, 1)",
+		"(go, 3)",
+		"(zeta, 9)",
+		"Executed.",
+		"db > (zeta, 9)",
+		"(go, 3)",
+		"Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 17: the primary key name cannot be changed.",
+		"db > Executed.",
+		"db > (zeta, 9)",
+		"Executed.",
+		"db > create table tags (name text primary key, hits integer)",
+		"db > ok: 4 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestNegativePrimaryKeys(t *testing.T) {
+	commands := []string{
+		"create table temps (day integer primary key, celsius real)",
+		"insert into temps values (5, 21.5)",
+		"insert into temps values (-3, -4.0)",
+		"insert into temps values (0, 1.5)",
+		"insert into temps values (-9223372036854775808, -40.0)",
+		"insert into temps values (-10, -8.5)",
+		"select day from temps",
+		"select day from temps where day < 0 order by day desc",
+		"select day from temps where day between -10 and 0",
+		"delete from temps where day = -3",
+		"select count(*), min(day), max(day) from temps",
+		"create table offsets (zone text, minutes integer, primary key (zone, minutes))",
+		"insert into offsets values ('a', 30)",
+		"insert into offsets values ('a', -90)",
+		"insert into offsets values ('a', -30)",
+		"select * from offsets",
+		"insert -1 cstack foo@bar.com",
+		".schema temps",
+		".check",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (-9223372036854775808)",
+		"(-10)",
+		"(-3)",
+		"(0)",
+		"(5)",
+		"Executed.",
+		"db > (-3)",
+		"(-10)",
+		"(-9223372036854775808)",
+		"Executed.",
+		"db > (-10)",
+		"(-3)",
+		"(0)",
+		"Executed.",
+		"db > Executed.",
+		"db > (4, -9223372036854775808, 5)",
+		"Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (a, -90)",
+		"(a, -30)",
+		"(a, 30)",
+		"Executed.",
+		"db > ID must be positive.",
+		"db > create table temps (day integer primary key, celsius real)",
+		"db > ok: 5 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCompositePrimaryKey(t *testing.T) {
+	defer os.Remove("test.db")
+
+	commands := []string{
+		"create table members (tenant integer, user integer, role text, primary key (tenant, user))",
+		"insert into members values (2, 1, 'admin')",
+		"insert into members values (1, 7, 'owner')",
+		"insert into members values (1, 3, 'guest')",
+		"insert into members values (2, 1, 'again')",
+		"insert into members (tenant, role) values (3, 'none')",
+		"insert into members values (1, -3, 'negative')",
+		"select * from members where tenant = 1",
+		"update members set role = 'editor' where user = 3 and tenant = 1",
+		"update members set role = 'editor' where tenant = 1",
+		"update members 1 set role = editor",
+		"insert into members values (1, 7, 'x') on conflict (user, tenant) do update set role = 'boss'",
+		"insert into members values (1, 7, 'x') on conflict (user) do nothing",
+		".exit",
+	}
+
+	result, err := runScriptOnFile("test.db", commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: Duplicate key.",
+		"db > Syntax error at line 1, column 1: no value for the primary key user.",
+		"db > Executed.",
+		"db > (1, -3, negative)",
+		"(1, 3, guest)",
+		"(1, 7, owner)",
+		"Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 1: UPDATE needs WHERE tenant = <key> AND user = <key>.",
+		"db > Syntax error at line 1, column 1: UPDATE needs WHERE tenant = <key> AND user = <key>.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 53: ON CONFLICT can only name the primary key (tenant, user).",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// The key survives reopening the file, where the schema is parsed back
+	// from the catalog
+	result, err = runScriptOnFile("test.db", []string{
+		"select * from members",
+		".schema members",
+		".btree members",
+		"create index members_role on members (role)",
+		"select * from members where role = 'boss'",
+		"delete from members where role = 'editor'",
+		".check",
+		".exit",
+	})
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected = []string{
+		"db > (1, -3, negative)",
+		"(1, 3, editor)",
+		"(1, 7, boss)",
+		"(2, 1, admin)",
+		"Executed.",
+		"db > create table members (tenant integer, user integer, role text, primary key (tenant, user))",
+		"db > Tree:",
+		"- leaf (size 4)",
+		"    - key (1, -3)",
+		"    - key (1, 3)",
+		"    - key (1, 7)",
+		"    - key (2, 1)",
+		"db > Executed.",
+		"db > (1, 7, boss)",
+		"Executed.",
+		"db > Executed.",
+		"db > ok: 5 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestCreateTablePrimaryKeyErrors(t *testing.T) {
+	commands := []string{
+		"create table a (x text)",
+		"create table b (x integer primary key, y text primary key)",
+		"create table c (x integer primary key, y text, primary key (y))",
+		"create table d (x integer, y text, primary key (y, nope))",
+		"create table e (x integer, primary key (x, x))",
+		"create table primary (primary integer, key text, primary key (key))",
+		"insert into primary values (1, 'k')",
+		"select * from primary where key = 'k'",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > A table without a primary key must start with an integer column.",
+		"db > Syntax error at line 1, column 40: table b has more than one primary key.",
+		"db > Syntax error at line 1, column 48: table c has more than one primary key.",
+		"db > Syntax error at line 1, column 36: table d has no column nope.",
+		"db > Syntax error at line 1, column 28: column x is named twice.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (1, k)",
+		"Executed.",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestSixtyFourBitIntegerKeys(t *testing.T) {
+	commands := []string{
+		"insert 9223372036854775807 big big@example.com",
+		"insert 4294967296 mid mid@example.com",
+		"insert 7 small small@example.com",
+		"insert 9223372036854775808 over over@example.com",
+		"select id from users where id > 4294967295",
+		"select id from users order by id desc",
+		".btree",
+		".exit",
+	}
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Syntax error at line 1, column 8: 9223372036854775808 is not a valid key.",
+		"db > (4294967296)",
+		"(9223372036854775807)",
+		"Executed.",
+		"db > (9223372036854775807)",
+		"(4294967296)",
+		"(7)",
+		"Executed.",
+		"db > Tree:",
+		"- leaf (size 3)",
+		"    - key 7",
+		"    - key 4294967296",
+		"    - key 9223372036854775807",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestLongTextKeysAcrossLevels(t *testing.T) {
+	// Keys of a few hundred bytes fill internal nodes quickly, so the tree
+	// grows and shrinks through several levels
+	var commands []string
+	commands = append(commands, "create table pages (path text primary key, size integer)")
+	for i := 1; i <= 600; i++ {
+		n := (i * 263) % 601
+		commands = append(commands, fmt.Sprintf("insert into pages values ('/%s/%04d', %d)", strings.Repeat("d", n%400), n, n))
+	}
+	// A text key takes three bytes more than its text
+	commands = append(commands,
+		fmt.Sprintf("insert into pages values ('%s', 0)", strings.Repeat("x", btree.TABLE_MAX_KEY_SIZE-3)),
+		fmt.Sprintf("insert into pages values ('%s', 0)", strings.Repeat("y", btree.TABLE_MAX_KEY_SIZE-2)),
+		".check",
+		"delete from pages where size % 3 > 0",
+		"select count(*), min(size), max(size) from pages",
+		".check",
+		"delete from pages where size > 10",
+		"select size from pages order by path desc limit 3",
+		".check",
+		".exit",
+	)
+
+	result, err := runScript(commands)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+
+	expected := []string{
+		"db > Executed.",
+		"db > String is too long.",
+		"db > ok: 51 pages checked",
+		"db > Executed.",
+		"db > (201, 0, 600)",
+		"Executed.",
+		"db > ok: 51 pages checked",
+		"db > Executed.",
+		"db > (0)",
+		"(9)",
+		"(6)",
+		"Executed.",
+		"db > ok: 51 pages checked",
+		"db > Bye!",
+	}
+
+	if !equalSlices(result[601:], expected) {
+		t.Errorf("Expected %v, got %v", expected, result[601:])
 	}
-	return true
 }
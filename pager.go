@@ -0,0 +1,609 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"toydb/btree"
+	"toydb/constants"
+	"toydb/header"
+	"toydb/wal"
+)
+
+// Frame is a slot in the buffer pool holding one page
+type Frame struct {
+	PageNum  uint32
+	Page     []byte
+	PinCount int  // Number of callers currently using the page
+	Dirty    bool // Page differs from its newest copy on disk
+
+	lruElement *list.Element // Position in the LRU list while unpinned
+}
+
+// Pager handles reading/writing pages to disk. Pages are cached in a buffer
+// pool of bounded size; the least recently used unpinned page is evicted when
+// the pool is full. Modified pages are written to the write-ahead log and
+// only reach the database file when the log is checkpointed.
+type Pager struct {
+	FileDescriptor *os.File
+	FileLength     int64
+	NumPages       uint32
+	Capacity       int               // Number of pages the pool holds before evicting
+	Frames         map[uint32]*Frame // Pages currently in the pool
+	Wal            *WriteAheadLog    // Committed pages not yet checkpointed
+	InTransaction  bool              // An explicit transaction is open, so statements do not commit
+	ReadOnly       bool              // Neither the file nor the log is ever written
+
+	lru *list.List // Unpinned frames, least recently used first
+}
+
+// CorruptPageError reports a page whose stored contents cannot be trusted
+type CorruptPageError struct {
+	PageNum uint32
+	Reason  string
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("Page %d is corrupt: %s", e.PageNum, e.Reason)
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// pageChecksum covers everything in the page except the checksum trailer
+func pageChecksum(page []byte) uint32 {
+	return crc32.Checksum(page[:constants.PAGE_USABLE_SIZE], castagnoli)
+}
+
+// pagerOpen opens the database file and its write-ahead log and initializes
+// the pager. Transactions that were committed to the log but not yet copied
+// into the database file, because of a crash, are checkpointed first. A
+// read-only pager reads them from the log instead, and neither creates nor
+// changes either file.
+func pagerOpen(filename string, capacity int, readOnly bool) (*Pager, error) {
+	if capacity < 1 {
+		return nil, fmt.Errorf("Buffer pool needs room for at least one page, got %d", capacity)
+	}
+
+	// Open file with read/write permissions, create if doesn't exist
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open file: %v", err)
+	}
+
+	// Get file size
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to get file info: %v", err)
+	}
+
+	log, err := walOpen(filename+"-wal", readOnly)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	pager := &Pager{
+		FileDescriptor: file,
+		FileLength:     fileInfo.Size(),
+		Capacity:       capacity,
+		Frames:         make(map[uint32]*Frame),
+		Wal:            log,
+		ReadOnly:       readOnly,
+		lru:            list.New(),
+	}
+
+	pageCount, err := log.walRecover()
+	if err == nil && !readOnly {
+		err = pager.checkpoint()
+	}
+	if err == nil && !readOnly && int64(pageCount)*constants.PAGE_SIZE > pager.FileLength {
+		pager.FileLength = int64(pageCount) * constants.PAGE_SIZE
+		err = file.Truncate(pager.FileLength)
+	}
+	if err != nil {
+		pager.pagerClose()
+		return nil, err
+	}
+
+	if pager.FileLength%constants.PAGE_SIZE != 0 {
+		pager.pagerClose()
+		return nil, fmt.Errorf("Db file is not a whole number of pages. Corrupt file.")
+	}
+	pager.NumPages = uint32(pager.FileLength / constants.PAGE_SIZE)
+	if pageCount > pager.NumPages {
+		// The last pages exist only in the log
+		pager.NumPages = pageCount
+	}
+
+	return pager, nil
+}
+
+// pagerClose closes the database file and the write-ahead log. An empty log
+// is removed, so a cleanly closed database is a single file.
+func (p *Pager) pagerClose() error {
+	err := p.FileDescriptor.Close()
+	if err != nil {
+		p.Wal.FileDescriptor.Close()
+		return fmt.Errorf("Error closing db file: %v", err)
+	}
+
+	if p.Wal.FileDescriptor == nil {
+		// Opened read-only without a log
+		return nil
+	}
+
+	err = p.Wal.FileDescriptor.Close()
+	if err != nil {
+		return fmt.Errorf("Error closing write-ahead log: %v", err)
+	}
+
+	if p.Wal.NumFrames == 0 && !p.ReadOnly {
+		err = os.Remove(p.Wal.FileDescriptor.Name())
+		if err != nil {
+			return fmt.Errorf("Error removing write-ahead log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// getPage returns a page from the buffer pool for reading, loading it from
+// disk on a cache miss. The page is pinned so it cannot be evicted while in
+// use; every call must be matched by a call to unpinPage once the caller is
+// done with the returned slice. Callers that modify the page must use
+// getPageForWrite instead. Only allocatePage extends the file, so a page past
+// the end can only be reached through a corrupt pointer.
+func (p *Pager) getPage(pageNum uint32) ([]byte, error) {
+	if pageNum >= p.NumPages {
+		return nil, &CorruptPageError{PageNum: pageNum, Reason: fmt.Sprintf("past the end of the file, which has %d pages", p.NumPages)}
+	}
+
+	frame, ok := p.Frames[pageNum]
+	if !ok {
+		err := p.makeRoom()
+		if err != nil {
+			return nil, err
+		}
+
+		// Cache miss, Allocate memory and load from file
+		page := make([]byte, constants.PAGE_SIZE)
+
+		// The log holds a newer image of the page than the database file
+		frameNum, inLog := p.Wal.frameFor(pageNum)
+		if inLog {
+			err := p.Wal.readPage(pageNum, frameNum, page)
+			if err != nil {
+				return nil, err
+			}
+		} else if int64(pageNum)*constants.PAGE_SIZE < p.FileLength {
+			_, err := p.FileDescriptor.ReadAt(page, int64(pageNum)*constants.PAGE_SIZE)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, &CorruptPageError{PageNum: pageNum, Reason: "file ends part way through the page"}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Error reading file: %v", err)
+			}
+
+			if pageChecksum(page) != binary.LittleEndian.Uint32(page[constants.PAGE_USABLE_SIZE:]) {
+				return nil, &CorruptPageError{PageNum: pageNum, Reason: "checksum mismatch"}
+			}
+		}
+
+		// A page that is neither in the log nor in the file has never been
+		// written, so it must reach disk even if nobody modifies it
+		frame = &Frame{
+			PageNum: pageNum,
+			Page:    page,
+			Dirty:   !inLog && int64(pageNum)*constants.PAGE_SIZE >= p.FileLength,
+		}
+		p.Frames[pageNum] = frame
+	}
+
+	if frame.lruElement != nil {
+		p.lru.Remove(frame.lruElement)
+		frame.lruElement = nil
+	}
+	frame.PinCount++
+
+	return frame.Page, nil
+}
+
+// getPageForWrite is getPage for callers that intend to modify the page. The
+// page is marked dirty so it is written to the log on eviction or commit.
+func (p *Pager) getPageForWrite(pageNum uint32) ([]byte, error) {
+	if p.ReadOnly {
+		return nil, fmt.Errorf("Cannot modify page %d of a database opened read-only", pageNum)
+	}
+
+	page, err := p.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Frames[pageNum].Dirty = true
+	return page, nil
+}
+
+// allocatePage adds a zeroed page at the end of the file and returns its
+// number and the page, pinned for writing
+func (p *Pager) allocatePage() (uint32, []byte, error) {
+	pageNum := p.NumPages
+	p.NumPages++
+
+	page, err := p.getPageForWrite(pageNum)
+	if err != nil {
+		p.NumPages--
+		return 0, nil, err
+	}
+
+	return pageNum, page, nil
+}
+
+// unpinPage releases a page returned by getPage. Once every caller has
+// released it the page becomes a candidate for eviction.
+func (p *Pager) unpinPage(pageNum uint32) {
+	frame, ok := p.Frames[pageNum]
+	if !ok || frame.PinCount == 0 {
+		panic(fmt.Sprintf("Tried to unpin page %d which is not pinned", pageNum))
+	}
+
+	frame.PinCount--
+	if frame.PinCount == 0 {
+		frame.lruElement = p.lru.PushBack(frame)
+	}
+}
+
+// makeRoom evicts least recently used pages until the pool has space for one
+// more. Pinned pages cannot be evicted, so when every page is pinned the pool
+// grows past its capacity until some of them are released. Dirty pages are
+// appended to the log as part of the open transaction, never written to the
+// database file.
+func (p *Pager) makeRoom() error {
+	for len(p.Frames) >= p.Capacity && p.lru.Len() > 0 {
+		frame := p.lru.Front().Value.(*Frame)
+
+		if frame.Dirty {
+			err := p.Wal.appendFrame(frame.PageNum, frame.Page, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		p.lru.Remove(frame.lruElement)
+		delete(p.Frames, frame.PageNum)
+	}
+
+	return nil
+}
+
+// pagerFlush writes a page image to the database file, sealing it with a
+// checksum that getPage verifies when the page is read back
+func (p *Pager) pagerFlush(pageNum uint32, page []byte) error {
+	binary.LittleEndian.PutUint32(page[constants.PAGE_USABLE_SIZE:], pageChecksum(page))
+
+	// Seek to the correct position
+	offset := int64(pageNum) * constants.PAGE_SIZE
+	_, err := p.FileDescriptor.Seek(offset, 0)
+	if err != nil {
+		return fmt.Errorf("Error seeking: %v", err)
+	}
+
+	// Write the page
+	bytesWritten, err := p.FileDescriptor.Write(page)
+	if err != nil {
+		return fmt.Errorf("Error writing: %v", err)
+	}
+
+	if bytesWritten != len(page) {
+		return fmt.Errorf("Wrote %d bytes, expected %d", bytesWritten, len(page))
+	}
+
+	if offset+int64(len(page)) > p.FileLength {
+		p.FileLength = offset + int64(len(page))
+	}
+
+	return nil
+}
+
+// commit makes every change since the last commit durable. Dirty pages are
+// appended to the log, the last of them flagged as the commit record, and the
+// log is synced before returning. The log is checkpointed once it grows past
+// wal.AUTOCHECKPOINT_FRAMES.
+func (p *Pager) commit() error {
+	if len(p.Wal.Pending) > 0 && !p.hasDirtyPages() {
+		// Everything the transaction changed was evicted to the log
+		// already, but the commit record still needs a frame to carry it
+		_, err := p.getPageForWrite(header.HEADER_PAGE_NUM)
+		if err != nil {
+			return err
+		}
+		p.unpinPage(header.HEADER_PAGE_NUM)
+	}
+
+	pageNums := make([]uint32, 0, len(p.Frames))
+	for pageNum, frame := range p.Frames {
+		if frame.Dirty {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+	if len(pageNums) == 0 {
+		return nil
+	}
+	slices.Sort(pageNums)
+
+	for i, pageNum := range pageNums {
+		var commit uint32
+		if i == len(pageNums)-1 {
+			commit = p.NumPages
+		}
+
+		frame := p.Frames[pageNum]
+		err := p.Wal.appendFrame(pageNum, frame.Page, commit)
+		if err != nil {
+			return err
+		}
+		frame.Dirty = false
+	}
+
+	err := p.Wal.FileDescriptor.Sync()
+	if err != nil {
+		return fmt.Errorf("Error syncing write-ahead log: %v", err)
+	}
+	p.Wal.commitPending()
+
+	if p.Wal.NumFrames >= wal.AUTOCHECKPOINT_FRAMES {
+		return p.checkpoint()
+	}
+
+	return nil
+}
+
+func (p *Pager) hasDirtyPages() bool {
+	for _, frame := range p.Frames {
+		if frame.Dirty {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkpoint copies the newest committed image of every page in the log into
+// the database file, syncs it and empties the log. Uncommitted changes must
+// never reach the database file, so it refuses to run mid-transaction.
+func (p *Pager) checkpoint() error {
+	if len(p.Wal.Pending) > 0 {
+		return fmt.Errorf("Cannot checkpoint while a transaction has uncommitted changes")
+	}
+
+	if len(p.Wal.Committed) == 0 {
+		return nil
+	}
+
+	pageNums := make([]uint32, 0, len(p.Wal.Committed))
+	for pageNum := range p.Wal.Committed {
+		pageNums = append(pageNums, pageNum)
+	}
+	slices.Sort(pageNums)
+
+	page := make([]byte, constants.PAGE_SIZE)
+	for _, pageNum := range pageNums {
+		err := p.Wal.readPage(pageNum, p.Wal.Committed[pageNum], page)
+		if err != nil {
+			return err
+		}
+
+		err = p.pagerFlush(pageNum, page)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := p.FileDescriptor.Sync()
+	if err != nil {
+		return fmt.Errorf("Error syncing db file: %v", err)
+	}
+
+	return p.Wal.reset()
+}
+
+// rollback discards every change since the last commit. Pages that the
+// transaction modified are dropped from the buffer pool and its frames are
+// cut from the log, so the next read sees the committed image again.
+func (p *Pager) rollback() error {
+	for pageNum, frame := range p.Frames {
+		_, inTransaction := p.Wal.Pending[pageNum]
+		if !frame.Dirty && !inTransaction {
+			continue
+		}
+
+		if frame.PinCount > 0 {
+			return fmt.Errorf("Cannot roll back page %d while it is pinned", pageNum)
+		}
+
+		p.lru.Remove(frame.lruElement)
+		delete(p.Frames, pageNum)
+	}
+
+	err := p.Wal.rollbackPending()
+	if err != nil {
+		return err
+	}
+	p.InTransaction = false
+
+	// Pages allocated by the transaction no longer exist
+	headerPage, err := p.getPage(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	p.NumPages = header.PageCount(headerPage)
+	p.unpinPage(header.HEADER_PAGE_NUM)
+
+	return nil
+}
+
+// Savepoint is a point in the open transaction that it can be rolled back
+// to without losing the changes made before it
+type Savepoint struct {
+	NumFrames uint32            // Frames in the log when the savepoint was taken
+	Pending   map[uint32]uint32 // Latest frame of each page in the transaction at that point
+	NumPages  uint32
+}
+
+// savepoint appends the pages the open transaction has modified to the log,
+// so that their images as of now can be read back, and returns a savepoint
+// for rollbackTo to return to
+func (p *Pager) savepoint() (*Savepoint, error) {
+	pageNums := make([]uint32, 0, len(p.Frames))
+	for pageNum, frame := range p.Frames {
+		if frame.Dirty {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+	slices.Sort(pageNums)
+
+	for _, pageNum := range pageNums {
+		frame := p.Frames[pageNum]
+		err := p.Wal.appendFrame(pageNum, frame.Page, 0)
+		if err != nil {
+			return nil, err
+		}
+		frame.Dirty = false
+	}
+
+	return &Savepoint{
+		NumFrames: p.Wal.NumFrames,
+		Pending:   maps.Clone(p.Wal.Pending),
+		NumPages:  p.NumPages,
+	}, nil
+}
+
+// rollbackTo discards the changes made since a savepoint, keeping those made
+// before it and leaving the transaction open. Pages modified since then are
+// dropped from the buffer pool, and so are pages read from frames the log
+// gained since then, so the next read sees the image the savepoint kept.
+func (p *Pager) rollbackTo(savepoint *Savepoint) error {
+	for pageNum, frame := range p.Frames {
+		frameNum, inLog := p.Wal.Pending[pageNum]
+		if !frame.Dirty && (!inLog || frameNum < savepoint.NumFrames) {
+			continue
+		}
+
+		if frame.PinCount > 0 {
+			return fmt.Errorf("Cannot roll back page %d while it is pinned", pageNum)
+		}
+
+		p.lru.Remove(frame.lruElement)
+		delete(p.Frames, pageNum)
+	}
+
+	err := p.Wal.rollbackTo(savepoint.NumFrames, savepoint.Pending)
+	if err != nil {
+		return err
+	}
+	p.NumPages = savepoint.NumPages
+
+	return nil
+}
+
+// Sync commits outstanding changes and checkpoints the log, so that the
+// database file alone holds every change and has reached stable storage. It
+// cannot run while an explicit transaction is open.
+func (p *Pager) Sync() error {
+	if p.InTransaction {
+		return fmt.Errorf("Cannot sync while a transaction is open")
+	}
+
+	err := p.commit()
+	if err != nil {
+		return err
+	}
+
+	return p.checkpoint()
+}
+
+// getUnusedPageNum takes a page off the free list, or allocates a new page
+// at the end of the file when the free list is empty
+func getUnusedPageNum(pager *Pager) (uint32, error) {
+	headerPage, err := pager.getPageForWrite(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return 0, err
+	}
+	defer pager.unpinPage(header.HEADER_PAGE_NUM)
+
+	head := header.FreeListHead(headerPage)
+	if head == 0 {
+		pageNum, _, err := pager.allocatePage()
+		if err != nil {
+			return 0, err
+		}
+		pager.unpinPage(pageNum)
+
+		header.SetPageCount(headerPage, pager.NumPages)
+		return pageNum, nil
+	}
+
+	trunk, err := pager.getPageForWrite(head)
+	if err != nil {
+		return 0, err
+	}
+	defer pager.unpinPage(head)
+
+	numEntries := btree.FreeTrunkNumEntries(trunk)
+	if numEntries > 0 {
+		btree.SetFreeTrunkNumEntries(trunk, numEntries-1)
+		return btree.FreeTrunkEntry(trunk, numEntries-1), nil
+	}
+
+	// The trunk has no entries left, so hand out the trunk page itself
+	header.SetFreeListHead(headerPage, btree.FreeTrunkNext(trunk))
+	return head, nil
+}
+
+// freePage returns a page that is no longer in use to the free list
+func freePage(pager *Pager, pageNum uint32) error {
+	headerPage, err := pager.getPageForWrite(header.HEADER_PAGE_NUM)
+	if err != nil {
+		return err
+	}
+	defer pager.unpinPage(header.HEADER_PAGE_NUM)
+
+	head := header.FreeListHead(headerPage)
+	if head != 0 {
+		trunk, err := pager.getPageForWrite(head)
+		if err != nil {
+			return err
+		}
+		defer pager.unpinPage(head)
+
+		numEntries := btree.FreeTrunkNumEntries(trunk)
+		if numEntries < btree.FREE_TRUNK_MAX_ENTRIES {
+			btree.SetFreeTrunkEntry(trunk, numEntries, pageNum)
+			btree.SetFreeTrunkNumEntries(trunk, numEntries+1)
+			return nil
+		}
+	}
+
+	// No trunk with room, so the freed page becomes the new head trunk
+	page, err := pager.getPageForWrite(pageNum)
+	if err != nil {
+		return err
+	}
+	defer pager.unpinPage(pageNum)
+
+	btree.InitializeFreeTrunk(page)
+	btree.SetFreeTrunkNext(page, head)
+	header.SetFreeListHead(headerPage, pageNum)
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package parser
+
+// Statement is a parsed SQL statement, one of the *Statement types below
+type Statement interface {
+	Position() Pos
+}
+
+// Expr is a parsed expression, one of the expression types below
+type Expr interface {
+	Position() Pos
+}
+
+// CreateTableStatement is "create table <name> (<column> <type>, ...)"
+type CreateTableStatement struct {
+	Pos           Pos
+	Name          string
+	Columns       []ColumnDefinition
+	PrimaryKey    []string // Columns of a "primary key (<column>, ...)" after the columns, nil if there is none
+	PrimaryKeyPos Pos
+}
+
+// ColumnDefinition is one column of a CREATE TABLE, as in "name text(16)",
+// "email text unique" or "code text primary key"
+type ColumnDefinition struct {
+	Pos        Pos
+	Name       string
+	TypePos    Pos
+	TypeName   string // As written, for example "text"
+	MaxLength  int    // Length in parentheses after the type, 0 if there is none
+	Unique     bool
+	PrimaryKey bool
+}
+
+// CreateIndexStatement is "create [unique] index <name> on <table>
+// (<column>)"
+type CreateIndexStatement struct {
+	Pos       Pos
+	Unique    bool
+	Name      string
+	Table     string
+	Column    string
+	ColumnPos Pos
+}
+
+// InsertStatement is "insert [or replace] into <table> [(<column>, ...)]
+// values (...) [on conflict ...]", or the shorthand "insert [or replace]
+// [into <table>] <value> <value> ..."
+type InsertStatement struct {
+	Pos        Pos
+	OrReplace  bool
+	Table      string   // Empty if the statement names no table
+	Columns    []string // Columns the values are for, nil for every column in order
+	Values     []Expr
+	OnConflict *OnConflict // Nil without an ON CONFLICT clause
+}
+
+// OnConflict is "on conflict [(<column>)] do nothing" or "on conflict
+// [(<column>)] do update set <column> = <value>, ..." at the end of an
+// INSERT
+type OnConflict struct {
+	Pos         Pos
+	Target      []string // Columns named in parentheses, nil if there are none
+	TargetPos   Pos
+	DoNothing   bool
+	Assignments []Assignment // For DO UPDATE
+}
+
+// SelectStatement is "select <column>, ... from <table> [where <expr>]
+// [group by <expr>, ...] [having <expr>] [order by <term>, ...] [limit
+// <expr> [offset <expr>]]", or "select" on its own
+type SelectStatement struct {
+	Pos     Pos
+	Columns []ResultColumn // Nil for "select" on its own
+	Table   string         // Empty if the statement names no table
+	Where   Expr           // Nil without a WHERE clause
+	GroupBy []Expr
+	Having  Expr // Nil without a HAVING clause
+	OrderBy []OrderingTerm
+	Limit   Expr // Nil without a LIMIT clause
+	Offset  Expr // Nil without an OFFSET clause
+}
+
+// ResultColumn is one entry of the list after SELECT: "*", or an
+// expression optionally named with "[as] <alias>"
+type ResultColumn struct {
+	Pos   Pos
+	Expr  Expr // Nil for *
+	Alias string
+}
+
+// OrderingTerm is one "<expr> [asc|desc]" of an ORDER BY
+type OrderingTerm struct {
+	Pos        Pos
+	Expr       Expr
+	Descending bool
+}
+
+// UpdateStatement is "update <table> set <column> = <value>, ... where
+// <expr>", or the shorthand "update [<table>] <key> set <column>=<value>,
+// ..." where Key is set instead of Where
+type UpdateStatement struct {
+	Pos         Pos
+	Table       string // Empty if the statement names no table
+	Key         Expr
+	Assignments []Assignment
+	Where       Expr
+}
+
+// Assignment is one "<column> = <value>" of an UPDATE
+type Assignment struct {
+	Pos    Pos
+	Column string
+	Value  Expr
+}
+
+// DeleteStatement is "delete [from <table>] [where <expr>]"
+type DeleteStatement struct {
+	Pos   Pos
+	Table string // Empty if the statement names no table
+	Where Expr   // Nil without a WHERE clause
+}
+
+type BeginStatement struct {
+	Pos Pos
+}
+
+type CommitStatement struct {
+	Pos Pos
+}
+
+type RollbackStatement struct {
+	Pos Pos
+}
+
+// LiteralKind is the kind of a literal value
+type LiteralKind int
+
+const (
+	LITERAL_NULL LiteralKind = iota
+	LITERAL_INTEGER
+	LITERAL_REAL
+	LITERAL_STRING
+	LITERAL_BLOB // Text is the hex digits
+	LITERAL_WORD // An unquoted value of a shorthand statement, typed by its column
+)
+
+// Literal is a constant value, Text is the value as written without quotes
+type Literal struct {
+	Pos  Pos
+	Kind LiteralKind
+	Text string
+	Raw  string // The literal as written, for error messages
+}
+
+// ColumnRef names a column, as in "email" or "users.email"
+type ColumnRef struct {
+	Pos   Pos
+	Table string // Name before the dot, empty if there is none
+	Name  string
+}
+
+// UnaryExpr is "<op> <expr>", where Op is "-", "+" or "NOT"
+type UnaryExpr struct {
+	Pos  Pos
+	Op   string
+	Expr Expr
+}
+
+// BinaryExpr is "<left> <op> <right>". Op is a symbol such as "<=" or "||",
+// with "!=" written as "<>", or the keyword "AND" or "OR".
+type BinaryExpr struct {
+	Pos   Pos
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// BetweenExpr is "<expr> [not] between <low> and <high>"
+type BetweenExpr struct {
+	Pos  Pos
+	Expr Expr
+	Low  Expr
+	High Expr
+	Not  bool
+}
+
+// InExpr is "<expr> [not] in (<value>, ...)"
+type InExpr struct {
+	Pos    Pos
+	Expr   Expr
+	Values []Expr
+	Not    bool
+}
+
+// LikeExpr is "<expr> [not] like <pattern>"
+type LikeExpr struct {
+	Pos     Pos
+	Expr    Expr
+	Pattern Expr
+	Not     bool
+}
+
+// IsNullExpr is "<expr> is [not] null"
+type IsNullExpr struct {
+	Pos  Pos
+	Expr Expr
+	Not  bool
+}
+
+// FunctionCall is "<name>(<expr>, ...)", or "<name>(*)" as in count(*)
+type FunctionCall struct {
+	Pos  Pos
+	Name string // In lower case
+	Args []Expr
+	Star bool
+}
+
+func (s *CreateTableStatement) Position() Pos { return s.Pos }
+func (s *CreateIndexStatement) Position() Pos { return s.Pos }
+func (s *InsertStatement) Position() Pos      { return s.Pos }
+func (s *SelectStatement) Position() Pos      { return s.Pos }
+func (s *UpdateStatement) Position() Pos      { return s.Pos }
+func (s *DeleteStatement) Position() Pos      { return s.Pos }
+func (s *BeginStatement) Position() Pos       { return s.Pos }
+func (s *CommitStatement) Position() Pos      { return s.Pos }
+func (s *RollbackStatement) Position() Pos    { return s.Pos }
+
+func (e *Literal) Position() Pos      { return e.Pos }
+func (e *ColumnRef) Position() Pos    { return e.Pos }
+func (e *UnaryExpr) Position() Pos    { return e.Pos }
+func (e *BinaryExpr) Position() Pos   { return e.Pos }
+func (e *BetweenExpr) Position() Pos  { return e.Pos }
+func (e *InExpr) Position() Pos       { return e.Pos }
+func (e *LikeExpr) Position() Pos     { return e.Pos }
+func (e *IsNullExpr) Position() Pos   { return e.Pos }
+func (e *FunctionCall) Position() Pos { return e.Pos }
@@ -0,0 +1,939 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrUnrecognizedStatement is returned for input that does not start with
+// the keyword of a statement
+var ErrUnrecognizedStatement = errors.New("unrecognized statement")
+
+// Error is a syntax error at a position in the text of a statement
+type Error struct {
+	Pos     Pos
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %s", e.Pos, e.Message)
+}
+
+// parser is a recursive-descent parser that looks one token ahead.
+// Keywords are matched by name wherever the grammar expects them, so they
+// remain usable as table and column names.
+type parser struct {
+	lexer *Lexer
+	tok   Token // The token being looked at
+}
+
+// Parse parses a single statement, which may end with a semicolon
+func Parse(input string) (Statement, error) {
+	p := &parser{lexer: NewLexer(input)}
+	p.advance()
+
+	var statement Statement
+	var err error
+	switch {
+	case p.isKeyword("create"):
+		statement, err = p.parseCreate()
+	case p.isKeyword("insert"):
+		statement, err = p.parseInsert()
+	case p.isKeyword("select"):
+		statement, err = p.parseSelect()
+	case p.isKeyword("update"):
+		statement, err = p.parseUpdate()
+	case p.isKeyword("delete"):
+		statement, err = p.parseDelete()
+	case p.isKeyword("begin"):
+		statement, err = p.parseTransaction(&BeginStatement{Pos: p.tok.Pos})
+	case p.isKeyword("commit"):
+		statement, err = p.parseTransaction(&CommitStatement{Pos: p.tok.Pos})
+	case p.isKeyword("rollback"):
+		statement, err = p.parseTransaction(&RollbackStatement{Pos: p.tok.Pos})
+	default:
+		return nil, ErrUnrecognizedStatement
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isSymbol(";") {
+		p.advance()
+	}
+	if p.tok.Kind != TOKEN_EOF {
+		return nil, p.unexpected("end of statement")
+	}
+
+	return statement, nil
+}
+
+// parseCreate parses a create table or create index statement
+func (p *parser) parseCreate() (Statement, error) {
+	pos := p.tok.Pos
+	p.advance()
+
+	if p.isKeyword("unique") {
+		p.advance()
+		if !p.isKeyword("index") {
+			return nil, p.unexpected("INDEX")
+		}
+		return p.parseCreateIndex(pos, true)
+	}
+	if p.isKeyword("index") {
+		return p.parseCreateIndex(pos, false)
+	}
+
+	err := p.expectKeyword("table")
+	if err != nil {
+		return nil, err
+	}
+
+	return p.parseCreateTable(pos)
+}
+
+// parseCreateTable parses "create table <name> (<column> <type>, ...
+// [, primary key (<column>, ...)])" from the table name on
+func (p *parser) parseCreateTable(pos Pos) (Statement, error) {
+	statement := &CreateTableStatement{Pos: pos}
+
+	var err error
+	statement.Name, _, err = p.identifier("a table name")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		name, pos, err := p.identifier("a column name")
+		if err != nil {
+			return nil, err
+		}
+
+		// A column may be called primary, so a constraint is told apart by
+		// the KEY after it
+		if strings.EqualFold(name, "primary") && p.isKeyword("key") && len(statement.Columns) > 0 {
+			p.advance()
+			statement.PrimaryKeyPos = pos
+			statement.PrimaryKey, _, err = p.parseColumnNames()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		column, err := p.parseColumnDefinition(name, pos)
+		if err != nil {
+			return nil, err
+		}
+		statement.Columns = append(statement.Columns, column)
+
+		if !p.isSymbol(",") {
+			break
+		}
+		p.advance()
+	}
+
+	return statement, p.expectSymbol(")")
+}
+
+// parseCreateIndex parses "create [unique] index <name> on <table>
+// (<column>)" from INDEX on
+func (p *parser) parseCreateIndex(pos Pos, unique bool) (Statement, error) {
+	statement := &CreateIndexStatement{Pos: pos, Unique: unique}
+	p.advance()
+
+	var err error
+	statement.Name, _, err = p.identifier("an index name")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectKeyword("on")
+	if err != nil {
+		return nil, err
+	}
+
+	statement.Table, _, err = p.identifier("a table name")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+
+	statement.Column, statement.ColumnPos, err = p.identifier("a column name")
+	if err != nil {
+		return nil, err
+	}
+
+	return statement, p.expectSymbol(")")
+}
+
+// parseColumnDefinition parses "<type> [unique] [primary key]" after the
+// name of a column, where the type may be followed by a length in
+// parentheses as in text(16). The constraints may come in either order.
+func (p *parser) parseColumnDefinition(name string, pos Pos) (ColumnDefinition, error) {
+	column := ColumnDefinition{Name: name, Pos: pos}
+	var err error
+
+	column.TypeName, column.TypePos, err = p.identifier("a column type")
+	if err != nil {
+		return column, err
+	}
+
+	if p.isSymbol("(") {
+		p.advance()
+
+		length, err := strconv.Atoi(p.tok.Text)
+		if p.tok.Kind != TOKEN_INTEGER || err != nil || length < 1 {
+			return column, p.unexpected("a length of at least 1")
+		}
+		column.MaxLength = length
+		p.advance()
+
+		err = p.expectSymbol(")")
+		if err != nil {
+			return column, err
+		}
+	}
+
+	for {
+		switch {
+		case p.isKeyword("unique") && !column.Unique:
+			column.Unique = true
+			p.advance()
+		case p.isKeyword("primary") && !column.PrimaryKey:
+			p.advance()
+			err = p.expectKeyword("key")
+			if err != nil {
+				return column, err
+			}
+			column.PrimaryKey = true
+		default:
+			return column, nil
+		}
+	}
+}
+
+// parseColumnNames parses a list of column names in parentheses. It also
+// returns the position of the first name.
+func (p *parser) parseColumnNames() ([]string, Pos, error) {
+	err := p.expectSymbol("(")
+	if err != nil {
+		return nil, p.tok.Pos, err
+	}
+
+	pos := p.tok.Pos
+	var columns []string
+	for {
+		column, _, err := p.identifier("a column name")
+		if err != nil {
+			return nil, pos, err
+		}
+		columns = append(columns, column)
+
+		if !p.isSymbol(",") {
+			break
+		}
+		p.advance()
+	}
+
+	return columns, pos, p.expectSymbol(")")
+}
+
+// parseInsert parses "insert into <table> [(<column>, ...)] values
+// (<value>, ...)" and the shorthand "insert [into <table>] <value> ..."
+func (p *parser) parseInsert() (Statement, error) {
+	statement := &InsertStatement{Pos: p.tok.Pos}
+	p.advance()
+
+	var err error
+	if p.isKeyword("or") {
+		p.advance()
+		err = p.expectKeyword("replace")
+		if err != nil {
+			return nil, err
+		}
+		statement.OrReplace = true
+	}
+
+	if p.isKeyword("into") {
+		p.advance()
+		statement.Table, _, err = p.identifier("a table name")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isSymbol("(") {
+		statement.Columns, _, err = p.parseColumnNames()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.isKeyword("values") {
+			return nil, p.unexpected("VALUES")
+		}
+	}
+
+	if p.isKeyword("values") {
+		p.advance()
+		statement.Values, err = p.parseExprList()
+		if err != nil || !p.isKeyword("on") {
+			return statement, err
+		}
+
+		statement.OnConflict, err = p.parseOnConflict()
+		return statement, err
+	}
+
+	for {
+		p.rescanAsWord()
+		if p.tok.Kind != TOKEN_WORD && p.tok.Kind != TOKEN_STRING {
+			return statement, nil
+		}
+
+		statement.Values = append(statement.Values, p.literal(p.tok))
+		p.advance()
+	}
+}
+
+// parseOnConflict parses "on conflict [(<column>, ...)] do nothing" or
+// "on conflict [(<column>, ...)] do update set <column> = <value>, ..."
+func (p *parser) parseOnConflict() (*OnConflict, error) {
+	onConflict := &OnConflict{Pos: p.tok.Pos}
+	p.advance()
+
+	err := p.expectKeyword("conflict")
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isSymbol("(") {
+		onConflict.Target, onConflict.TargetPos, err = p.parseColumnNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.expectKeyword("do")
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("nothing") {
+		p.advance()
+		onConflict.DoNothing = true
+		return onConflict, nil
+	}
+
+	if !p.isKeyword("update") {
+		return nil, p.unexpected("NOTHING or UPDATE")
+	}
+	p.advance()
+
+	err = p.expectKeyword("set")
+	if err != nil {
+		return nil, err
+	}
+
+	onConflict.Assignments, err = p.parseAssignments(false)
+	return onConflict, err
+}
+
+// parseSelect parses "select <column>, ... from <table> [where <expr>]
+// [group by <expr>, ...] [having <expr>] [order by <term>, ...] [limit
+// <expr> [offset <expr>]]", or "select" on its own
+func (p *parser) parseSelect() (Statement, error) {
+	statement := &SelectStatement{Pos: p.tok.Pos}
+	p.advance()
+
+	if p.tok.Kind == TOKEN_EOF || p.isSymbol(";") {
+		return statement, nil
+	}
+
+	for {
+		column, err := p.parseResultColumn()
+		if err != nil {
+			return nil, err
+		}
+		statement.Columns = append(statement.Columns, column)
+
+		if !p.isSymbol(",") {
+			break
+		}
+		p.advance()
+	}
+
+	err := p.expectKeyword("from")
+	if err != nil {
+		return nil, err
+	}
+
+	statement.Table, _, err = p.identifier("a table name")
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("where") {
+		p.advance()
+		statement.Where, err = p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("group") {
+		p.advance()
+		err = p.expectKeyword("by")
+		if err != nil {
+			return nil, err
+		}
+
+		statement.GroupBy, err = p.parseExprs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("having") {
+		p.advance()
+		statement.Having, err = p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("order") {
+		p.advance()
+		err = p.expectKeyword("by")
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			term := OrderingTerm{Pos: p.tok.Pos}
+			term.Expr, err = p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			if p.isKeyword("asc") {
+				p.advance()
+			} else if p.isKeyword("desc") {
+				term.Descending = true
+				p.advance()
+			}
+			statement.OrderBy = append(statement.OrderBy, term)
+
+			if !p.isSymbol(",") {
+				break
+			}
+			p.advance()
+		}
+	}
+
+	if p.isKeyword("limit") {
+		p.advance()
+		statement.Limit, err = p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.isKeyword("offset") {
+			p.advance()
+			statement.Offset, err = p.parseExpr()
+		}
+	}
+
+	return statement, err
+}
+
+// parseResultColumn parses "*" or "<expr> [[as] <alias>]"
+func (p *parser) parseResultColumn() (ResultColumn, error) {
+	column := ResultColumn{Pos: p.tok.Pos}
+	if p.isSymbol("*") {
+		p.advance()
+		return column, nil
+	}
+
+	var err error
+	column.Expr, err = p.parseExpr()
+	if err != nil {
+		return column, err
+	}
+
+	switch {
+	case p.isKeyword("as"):
+		p.advance()
+		if p.isKeyword("from") {
+			return column, p.unexpected("an alias")
+		}
+		column.Alias, _, err = p.identifier("an alias")
+	case p.tok.Kind == TOKEN_IDENTIFIER && !p.isKeyword("from"):
+		column.Alias = p.tok.Text
+		p.advance()
+	}
+
+	return column, err
+}
+
+// parseUpdate parses "update <table> set <column> = <value>, ... [where
+// <expr>]" and the shorthand "update [<table>] <key> set
+// <column>=<value>, ..."
+func (p *parser) parseUpdate() (Statement, error) {
+	statement := &UpdateStatement{Pos: p.tok.Pos}
+	p.advance()
+
+	if p.tok.Kind == TOKEN_IDENTIFIER && !p.isKeyword("set") {
+		statement.Table = p.tok.Text
+		p.advance()
+	}
+
+	shorthand := !p.isKeyword("set")
+	if shorthand {
+		p.rescanAsWord()
+		if p.tok.Kind != TOKEN_WORD {
+			return nil, p.unexpected("SET or a key")
+		}
+		statement.Key = p.literal(p.tok)
+		p.advance()
+	}
+
+	err := p.expectKeyword("set")
+	if err != nil {
+		return nil, err
+	}
+
+	statement.Assignments, err = p.parseAssignments(shorthand)
+	if err != nil {
+		return nil, err
+	}
+
+	if !shorthand && p.isKeyword("where") {
+		p.advance()
+		statement.Where, err = p.parseExpr()
+	}
+
+	return statement, err
+}
+
+// parseAssignments parses the "<column> = <value>, ..." after SET. In the
+// shorthand form of UPDATE the values are unquoted words.
+func (p *parser) parseAssignments(shorthand bool) ([]Assignment, error) {
+	var assignments []Assignment
+	for {
+		var assignment Assignment
+		var err error
+		assignment.Column, assignment.Pos, err = p.identifier("a column name")
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expectSymbol("=")
+		if err != nil {
+			return nil, err
+		}
+
+		if shorthand {
+			p.rescanAsWord()
+			if p.tok.Kind != TOKEN_WORD && p.tok.Kind != TOKEN_STRING {
+				return nil, p.unexpected("a value")
+			}
+			assignment.Value = p.literal(p.tok)
+			p.advance()
+		} else {
+			assignment.Value, err = p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+		}
+		assignments = append(assignments, assignment)
+
+		if !p.isSymbol(",") {
+			return assignments, nil
+		}
+		p.advance()
+	}
+}
+
+// parseDelete parses "delete [from <table>] [where <expr>]"
+func (p *parser) parseDelete() (Statement, error) {
+	statement := &DeleteStatement{Pos: p.tok.Pos}
+	p.advance()
+
+	var err error
+	if p.isKeyword("from") {
+		p.advance()
+		statement.Table, _, err = p.identifier("a table name")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("where") {
+		p.advance()
+		statement.Where, err = p.parseExpr()
+	}
+
+	return statement, err
+}
+
+// parseTransaction parses begin, commit and rollback, each of which may be
+// followed by the word transaction
+func (p *parser) parseTransaction(statement Statement) (Statement, error) {
+	p.advance()
+
+	if p.isKeyword("transaction") {
+		p.advance()
+	}
+
+	return statement, nil
+}
+
+// parseExprList parses "(<expr>, ...)"
+func (p *parser) parseExprList() ([]Expr, error) {
+	err := p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+
+	exprs, err := p.parseExprs()
+	if err != nil {
+		return nil, err
+	}
+
+	return exprs, p.expectSymbol(")")
+}
+
+// parseExprs parses "<expr>, ..."
+func (p *parser) parseExprs() ([]Expr, error) {
+	var exprs []Expr
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+
+		if !p.isSymbol(",") {
+			return exprs, nil
+		}
+		p.advance()
+	}
+}
+
+// Expressions are parsed one level of precedence at a time, loosest first:
+// OR, AND, NOT, comparisons, + - ||, * / %, then unary - and +
+func (p *parser) parseExpr() (Expr, error) {
+	return p.parseBinary(p.parseAnd, "OR")
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	return p.parseBinary(p.parseNot, "AND")
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if !p.isKeyword("not") {
+		return p.parseComparison()
+	}
+
+	pos := p.tok.Pos
+	p.advance()
+
+	expr, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{Pos: pos, Op: "NOT", Expr: expr}, nil
+}
+
+// parseComparison parses an operand, optionally followed by a comparison,
+// BETWEEN, IN, LIKE or IS NULL
+func (p *parser) parseComparison() (Expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	if op := p.operator("=", "<>", "<", "<=", ">", ">="); op != "" {
+		p.advance()
+
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &BinaryExpr{Pos: left.Position(), Op: op, Left: left, Right: right}, nil
+	}
+
+	if p.isKeyword("is") {
+		p.advance()
+
+		isNull := &IsNullExpr{Pos: left.Position(), Expr: left}
+		if p.isKeyword("not") {
+			isNull.Not = true
+			p.advance()
+		}
+		return isNull, p.expectKeyword("null")
+	}
+
+	not := p.isKeyword("not")
+	if not {
+		p.advance()
+	}
+
+	switch {
+	case p.isKeyword("between"):
+		p.advance()
+
+		low, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expectKeyword("and")
+		if err != nil {
+			return nil, err
+		}
+
+		high, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &BetweenExpr{Pos: left.Position(), Expr: left, Low: low, High: high, Not: not}, nil
+	case p.isKeyword("in"):
+		p.advance()
+
+		values, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		return &InExpr{Pos: left.Position(), Expr: left, Values: values, Not: not}, nil
+	case p.isKeyword("like"):
+		p.advance()
+
+		pattern, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &LikeExpr{Pos: left.Position(), Expr: left, Pattern: pattern, Not: not}, nil
+	case not:
+		return nil, p.unexpected("BETWEEN, IN or LIKE")
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAdditive() (Expr, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-", "||")
+}
+
+func (p *parser) parseMultiplicative() (Expr, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+// parseUnary parses an operand with any number of signs in front. A minus
+// in front of a number is part of the literal, so that keys such as -1
+// are literals.
+func (p *parser) parseUnary() (Expr, error) {
+	if !p.isSymbol("-") && !p.isSymbol("+") {
+		return p.parseOperand()
+	}
+
+	sign := p.tok
+	p.advance()
+
+	if sign.Text == "-" && (p.tok.Kind == TOKEN_INTEGER || p.tok.Kind == TOKEN_REAL) {
+		number := p.literal(p.tok)
+		number.Pos = sign.Pos
+		number.Text = "-" + number.Text
+		number.Raw = p.lexer.input[sign.Pos.Offset : p.tok.Pos.Offset+len(p.tok.Raw)]
+		p.advance()
+		return number, nil
+	}
+
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{Pos: sign.Pos, Op: sign.Text, Expr: expr}, nil
+}
+
+// parseOperand parses a literal, a column name or an expression in
+// parentheses
+func (p *parser) parseOperand() (Expr, error) {
+	tok := p.tok
+	switch {
+	case tok.Kind == TOKEN_INTEGER || tok.Kind == TOKEN_REAL || tok.Kind == TOKEN_STRING || tok.Kind == TOKEN_BLOB:
+		p.advance()
+		return p.literal(tok), nil
+	case p.isKeyword("null"):
+		p.advance()
+		return &Literal{Pos: tok.Pos, Kind: LITERAL_NULL, Text: tok.Text, Raw: tok.Raw}, nil
+	case tok.Kind == TOKEN_IDENTIFIER:
+		p.advance()
+		if p.isSymbol("(") {
+			return p.parseFunctionCall(tok)
+		}
+		if !p.isSymbol(".") {
+			return &ColumnRef{Pos: tok.Pos, Name: tok.Text}, nil
+		}
+
+		p.advance()
+		name, _, err := p.identifier("a column name")
+		if err != nil {
+			return nil, err
+		}
+		return &ColumnRef{Pos: tok.Pos, Table: tok.Text, Name: name}, nil
+	case p.isSymbol("("):
+		p.advance()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expectSymbol(")")
+	default:
+		return nil, p.unexpected("a value")
+	}
+}
+
+// parseFunctionCall parses the arguments in parentheses after the name of
+// a function, which may be "*" alone
+func (p *parser) parseFunctionCall(name Token) (Expr, error) {
+	call := &FunctionCall{Pos: name.Pos, Name: strings.ToLower(name.Text)}
+	p.advance()
+
+	switch {
+	case p.isSymbol("*"):
+		call.Star = true
+		p.advance()
+	case !p.isSymbol(")"):
+		var err error
+		call.Args, err = p.parseExprs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return call, p.expectSymbol(")")
+}
+
+// parseBinary parses operands read by next, separated by any of the
+// operators in ops and grouped from the left
+func (p *parser) parseBinary(next func() (Expr, error), ops ...string) (Expr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.operator(ops...)
+		if op == "" {
+			return left, nil
+		}
+		p.advance()
+
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Pos: left.Position(), Op: op, Left: left, Right: right}
+	}
+}
+
+// operator returns which of ops the current token is, or "" if it is none
+// of them. Keyword operators are returned in upper case, and != is <>.
+func (p *parser) operator(ops ...string) string {
+	for _, op := range ops {
+		if p.isSymbol(op) || p.isKeyword(op) {
+			return strings.ToUpper(op)
+		}
+		if op == "<>" && p.isSymbol("!=") {
+			return op
+		}
+	}
+
+	return ""
+}
+
+// literal makes a literal of a value token
+func (p *parser) literal(tok Token) *Literal {
+	kinds := map[TokenKind]LiteralKind{
+		TOKEN_INTEGER: LITERAL_INTEGER,
+		TOKEN_REAL:    LITERAL_REAL,
+		TOKEN_STRING:  LITERAL_STRING,
+		TOKEN_BLOB:    LITERAL_BLOB,
+		TOKEN_WORD:    LITERAL_WORD,
+	}
+
+	return &Literal{Pos: tok.Pos, Kind: kinds[tok.Kind], Text: tok.Text, Raw: tok.Raw}
+}
+
+func (p *parser) advance() {
+	p.tok = p.lexer.Next()
+}
+
+// rescanAsWord reads the current token again as a value of a shorthand
+// statement, see Lexer.NextWord
+func (p *parser) rescanAsWord() {
+	p.lexer.Seek(p.tok.Pos)
+	p.tok = p.lexer.NextWord()
+}
+
+// isKeyword reports whether the current token is the given keyword, in any
+// case
+func (p *parser) isKeyword(keyword string) bool {
+	return p.tok.Kind == TOKEN_IDENTIFIER && strings.EqualFold(p.tok.Text, keyword)
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	return p.tok.Kind == TOKEN_SYMBOL && p.tok.Text == symbol
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return p.unexpected(strings.ToUpper(keyword))
+	}
+
+	p.advance()
+	return nil
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.isSymbol(symbol) {
+		return p.unexpected("'" + symbol + "'")
+	}
+
+	p.advance()
+	return nil
+}
+
+// identifier consumes a name, described as what in the error if the
+// current token is not one
+func (p *parser) identifier(what string) (string, Pos, error) {
+	tok := p.tok
+	if tok.Kind != TOKEN_IDENTIFIER {
+		return "", tok.Pos, p.unexpected(what)
+	}
+
+	p.advance()
+	return tok.Text, tok.Pos, nil
+}
+
+// unexpected returns an error saying what was expected at the current token
+func (p *parser) unexpected(expected string) error {
+	if p.tok.Kind == TOKEN_ILLEGAL {
+		return &Error{Pos: p.tok.Pos, Message: p.tok.Text}
+	}
+
+	return &Error{Pos: p.tok.Pos, Message: fmt.Sprintf("expected %s, found %s", expected, p.tok.describe())}
+}
@@ -0,0 +1,288 @@
+package parser
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Pos is a position in the text of a statement. Line and Column count from
+// 1, and Column counts bytes.
+type Pos struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// TokenKind is the kind of a token
+type TokenKind int
+
+const (
+	TOKEN_EOF        TokenKind = iota
+	TOKEN_IDENTIFIER           // A name or a keyword, keywords are not reserved
+	TOKEN_INTEGER
+	TOKEN_REAL
+	TOKEN_STRING  // A quoted string, Text is the string without quotes
+	TOKEN_BLOB    // A blob such as x'cafe', Text is the hex digits
+	TOKEN_SYMBOL  // An operator or punctuation
+	TOKEN_WORD    // An unquoted value read by NextWord, such as a@b.com
+	TOKEN_ILLEGAL // Text that is not a token, Text says what is wrong
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string // Value of the token, see TokenKind
+	Raw  string // The token as written
+	Pos  Pos
+}
+
+// describe names the token for error messages
+func (t Token) describe() string {
+	switch t.Kind {
+	case TOKEN_EOF:
+		return "end of input"
+	case TOKEN_STRING, TOKEN_BLOB:
+		return t.Raw
+	default:
+		return "'" + t.Raw + "'"
+	}
+}
+
+// symbols lists the operators and punctuation, longer ones first so that
+// "<=" is not read as "<" followed by "="
+var symbols = []string{"<>", "<=", ">=", "!=", "||", "(", ")", ",", ";", ".", "*", "/", "%", "+", "-", "=", "<", ">"}
+
+// Lexer splits the text of a statement into tokens
+type Lexer struct {
+	input string
+	pos   Pos
+}
+
+func NewLexer(input string) *Lexer {
+	return &Lexer{input: input, pos: Pos{Line: 1, Column: 1}}
+}
+
+// Seek moves the lexer back to pos, so the text there can be read again
+func (l *Lexer) Seek(pos Pos) {
+	l.pos = pos
+}
+
+// Next returns the next token, TOKEN_EOF at the end of the input or
+// TOKEN_ILLEGAL for text that is not a token
+func (l *Lexer) Next() Token {
+	illegal, ok := l.skipSpaceAndComments()
+	if !ok {
+		return illegal
+	}
+
+	start := l.pos
+	if start.Offset == len(l.input) {
+		return Token{Kind: TOKEN_EOF, Pos: start}
+	}
+
+	c := l.input[start.Offset]
+	switch {
+	case (c == 'x' || c == 'X') && l.peek(1) == '\'':
+		return l.blob()
+	case isIdentifierStart(c):
+		for l.pos.Offset < len(l.input) && isIdentifierPart(l.input[l.pos.Offset]) {
+			l.advance(1)
+		}
+		return l.token(TOKEN_IDENTIFIER, start, l.input[start.Offset:l.pos.Offset])
+	case isDigit(c) || (c == '.' && isDigit(l.peek(1))):
+		return l.number()
+	case c == '\'':
+		return l.string()
+	}
+
+	for _, symbol := range symbols {
+		if strings.HasPrefix(l.input[start.Offset:], symbol) {
+			l.advance(len(symbol))
+			return l.token(TOKEN_SYMBOL, start, symbol)
+		}
+	}
+
+	l.advance(1)
+	return l.token(TOKEN_ILLEGAL, start, fmt.Sprintf("unexpected character %q", c))
+}
+
+// NextWord returns the next value of a shorthand statement such as
+// "insert 1 user1 person1@example.com", where values are separated by
+// spaces. A word runs up to the next space, comma or semicolon; quoted
+// strings, commas and semicolons are returned as they are by Next.
+func (l *Lexer) NextWord() Token {
+	illegal, ok := l.skipSpaceAndComments()
+	if !ok {
+		return illegal
+	}
+
+	start := l.pos
+	if start.Offset == len(l.input) || strings.IndexByte("',;", l.input[start.Offset]) != -1 {
+		return l.Next()
+	}
+
+	for l.pos.Offset < len(l.input) && !isSpace(l.input[l.pos.Offset]) && strings.IndexByte(",;", l.input[l.pos.Offset]) == -1 {
+		l.advance(1)
+	}
+	return l.token(TOKEN_WORD, start, l.input[start.Offset:l.pos.Offset])
+}
+
+// skipSpaceAndComments moves past spaces, "-- line" comments and
+// "/* block */" comments. It returns false with a TOKEN_ILLEGAL if a block
+// comment is never closed.
+func (l *Lexer) skipSpaceAndComments() (Token, bool) {
+	for l.pos.Offset < len(l.input) {
+		rest := l.input[l.pos.Offset:]
+		switch {
+		case isSpace(rest[0]):
+			l.advance(1)
+		case strings.HasPrefix(rest, "--"):
+			end := strings.IndexByte(rest, '\n')
+			if end == -1 {
+				end = len(rest)
+			}
+			l.advance(end)
+		case strings.HasPrefix(rest, "/*"):
+			start := l.pos
+			end := strings.Index(rest[2:], "*/")
+			if end == -1 {
+				l.advance(len(rest))
+				return l.token(TOKEN_ILLEGAL, start, "unterminated comment"), false
+			}
+			l.advance(end + 4)
+		default:
+			return Token{}, true
+		}
+	}
+
+	return Token{}, true
+}
+
+// number reads an integer, or a real if it has a fraction or an exponent
+func (l *Lexer) number() Token {
+	start := l.pos
+	kind := TOKEN_INTEGER
+
+	l.skipDigits()
+	if l.peek(0) == '.' {
+		kind = TOKEN_REAL
+		l.advance(1)
+		l.skipDigits()
+	}
+
+	if c := l.peek(0); c == 'e' || c == 'E' {
+		exponent := 1
+		if sign := l.peek(1); sign == '+' || sign == '-' {
+			exponent = 2
+		}
+		if isDigit(l.peek(exponent)) {
+			kind = TOKEN_REAL
+			l.advance(exponent)
+			l.skipDigits()
+		}
+	}
+
+	text := l.input[start.Offset:l.pos.Offset]
+	if isIdentifierPart(l.peek(0)) {
+		for isIdentifierPart(l.peek(0)) {
+			l.advance(1)
+		}
+		return l.token(TOKEN_ILLEGAL, start, fmt.Sprintf("malformed number '%s'", l.input[start.Offset:l.pos.Offset]))
+	}
+
+	return l.token(kind, start, text)
+}
+
+// string reads a string in single quotes, where a quote inside the string
+// is written twice
+func (l *Lexer) string() Token {
+	start := l.pos
+	l.advance(1)
+
+	var text strings.Builder
+	for {
+		if l.pos.Offset == len(l.input) {
+			return l.token(TOKEN_ILLEGAL, start, "unterminated string")
+		}
+
+		c := l.input[l.pos.Offset]
+		l.advance(1)
+		if c == '\'' {
+			if l.peek(0) != '\'' {
+				break
+			}
+			l.advance(1)
+		}
+		text.WriteByte(c)
+	}
+
+	return l.token(TOKEN_STRING, start, text.String())
+}
+
+// blob reads a blob written in hex as x'cafe'
+func (l *Lexer) blob() Token {
+	start := l.pos
+	l.advance(1)
+
+	quoted := l.string()
+	if quoted.Kind != TOKEN_STRING {
+		return l.token(TOKEN_ILLEGAL, start, "unterminated blob")
+	}
+
+	if _, err := hex.DecodeString(quoted.Text); err != nil {
+		return l.token(TOKEN_ILLEGAL, start, fmt.Sprintf("blob %s is not an even number of hex digits", l.input[start.Offset:l.pos.Offset]))
+	}
+
+	return l.token(TOKEN_BLOB, start, quoted.Text)
+}
+
+func (l *Lexer) token(kind TokenKind, start Pos, text string) Token {
+	return Token{Kind: kind, Text: text, Raw: l.input[start.Offset:l.pos.Offset], Pos: start}
+}
+
+// peek returns the byte n bytes ahead, or 0 past the end of the input
+func (l *Lexer) peek(n int) byte {
+	if l.pos.Offset+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos.Offset+n]
+}
+
+// advance moves n bytes forward, keeping track of lines and columns
+func (l *Lexer) advance(n int) {
+	for i := 0; i < n; i++ {
+		if l.input[l.pos.Offset] == '\n' {
+			l.pos.Line++
+			l.pos.Column = 1
+		} else {
+			l.pos.Column++
+		}
+		l.pos.Offset++
+	}
+}
+
+func (l *Lexer) skipDigits() {
+	for isDigit(l.peek(0)) {
+		l.advance(1)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentifierPart(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
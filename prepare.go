@@ -0,0 +1,860 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"toydb/btree"
+	"toydb/parser"
+	"toydb/record"
+)
+
+// prepareStatement parses a statement and checks it against the schema of
+// the table it names. Statements that name no table work on the users table.
+func prepareStatement(inputBuffer *InputBuffer, statement *Statement, db *Database) PrepareResult {
+	parsed, err := parser.Parse(inputBuffer.buffer)
+	if errors.Is(err, parser.ErrUnrecognizedStatement) {
+		return PREPARE_UNRECOGNIZED_STATEMENT
+	}
+	if err != nil {
+		statement.SyntaxError = err
+		return PREPARE_SYNTAX_ERROR
+	}
+
+	var tableName string
+	switch parsed := parsed.(type) {
+	case *parser.CreateTableStatement:
+		return prepareCreateTable(parsed, statement)
+	case *parser.CreateIndexStatement:
+		return prepareCreateIndex(parsed, statement, db)
+	case *parser.BeginStatement:
+		statement.Type = STATEMENT_BEGIN
+		return PREPARE_SUCCESS
+	case *parser.CommitStatement:
+		statement.Type = STATEMENT_COMMIT
+		return PREPARE_SUCCESS
+	case *parser.RollbackStatement:
+		statement.Type = STATEMENT_ROLLBACK
+		return PREPARE_SUCCESS
+	case *parser.InsertStatement:
+		tableName = parsed.Table
+	case *parser.SelectStatement:
+		tableName = parsed.Table
+	case *parser.UpdateStatement:
+		tableName = parsed.Table
+	case *parser.DeleteStatement:
+		tableName = parsed.Table
+	}
+
+	statement.TableName = DEFAULT_TABLE_NAME
+	if tableName != "" {
+		statement.TableName = tableName
+	}
+
+	table, ok := db.Tables[statement.TableName]
+	if !ok {
+		return PREPARE_NO_SUCH_TABLE
+	}
+
+	switch parsed := parsed.(type) {
+	case *parser.InsertStatement:
+		result := prepareInsert(parsed, statement, table.Schema)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		result = checkIndexedValues(table, &statement.RowToInsert)
+		if result != PREPARE_SUCCESS || statement.OnConflict != CONFLICT_UPDATE {
+			return result
+		}
+		return checkIndexedValues(table, &statement.RowToUpdate)
+	case *parser.UpdateStatement:
+		result := prepareUpdate(parsed, statement, table.Schema)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		return checkIndexedValues(table, &statement.RowToUpdate)
+	case *parser.DeleteStatement:
+		statement.Type = STATEMENT_DELETE
+		return prepareWhere(parsed.Where, statement, table)
+	case *parser.SelectStatement:
+		return prepareSelect(parsed, statement, table)
+	default:
+		return PREPARE_UNRECOGNIZED_STATEMENT
+	}
+}
+
+// checkIndexedValues checks that the values an insert or update stores in
+// indexed columns fit in an index along with the key of the row, which
+// limits the length of TEXT and BLOB values
+func checkIndexedValues(table *Table, row *Row) PrepareResult {
+	for _, index := range table.Indexes {
+		if !indexValueFits(row.Values[index.Column], len(row.Key)) {
+			return PREPARE_STRING_TOO_LONG
+		}
+	}
+
+	return PREPARE_SUCCESS
+}
+
+// syntaxError records what is wrong with a statement and where
+func syntaxError(statement *Statement, pos parser.Pos, format string, args ...any) PrepareResult {
+	statement.SyntaxError = &parser.Error{Pos: pos, Message: fmt.Sprintf(format, args...)}
+	return PREPARE_SYNTAX_ERROR
+}
+
+// prepareInsert matches the values of an insert to the columns of the
+// table. Without a column list there must be one value per column, in the
+// order the columns were defined; columns left out of a list are NULL. It
+// also sets what the insert does if its key is taken.
+func prepareInsert(insert *parser.InsertStatement, statement *Statement, schema *record.Schema) PrepareResult {
+	statement.Type = STATEMENT_INSERT
+
+	values := make([]parser.Expr, len(schema.Columns))
+	if insert.Columns == nil {
+		if len(insert.Values) != len(schema.Columns) {
+			return syntaxError(statement, insert.Pos, "table %s has %d columns but %d values were given", schema.TableName, len(schema.Columns), len(insert.Values))
+		}
+		copy(values, insert.Values)
+	} else {
+		if len(insert.Values) != len(insert.Columns) {
+			return syntaxError(statement, insert.Pos, "the number of values does not match the number of columns")
+		}
+
+		for i, name := range insert.Columns {
+			columnIndex := schema.ColumnIndex(name)
+			if columnIndex == -1 {
+				return syntaxError(statement, insert.Pos, "table %s has no column %s", schema.TableName, name)
+			}
+			if values[columnIndex] != nil {
+				return syntaxError(statement, insert.Pos, "column %s is named twice", name)
+			}
+			values[columnIndex] = insert.Values[i]
+		}
+
+		for _, column := range schema.PrimaryKey {
+			if values[column] == nil {
+				return syntaxError(statement, insert.Pos, "no value for the primary key %s", schema.Columns[column].Name)
+			}
+		}
+	}
+
+	statement.RowToInsert.Values = make([]record.Value, len(schema.Columns))
+	for i, column := range schema.Columns {
+		var value record.Value
+		var result PrepareResult
+		switch {
+		case schema.IsPrimaryKey(i):
+			value, result = prepareKeyValue(statement, schema, i, values[i])
+		case values[i] != nil:
+			value, result = literalValue(statement, column, values[i])
+		}
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		statement.RowToInsert.Values[i] = value
+	}
+
+	key, result := prepareRowKey(schema, statement.RowToInsert.Values)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	statement.RowToInsert.Key = key
+
+	switch {
+	case insert.OrReplace && insert.OnConflict != nil:
+		return syntaxError(statement, insert.OnConflict.Pos, "INSERT OR REPLACE cannot have an ON CONFLICT clause")
+	case insert.OrReplace:
+		statement.OnConflict = CONFLICT_REPLACE
+	case insert.OnConflict != nil:
+		return prepareOnConflict(insert.OnConflict, statement, schema)
+	}
+
+	return PREPARE_SUCCESS
+}
+
+// prepareOnConflict sets what an insert does instead of failing when its
+// key is taken. The primary key is the only conflict target an insert
+// resolves, so its columns, in any order, are the only ones the clause may
+// name, and a clash in a unique index then still fails. DO NOTHING without
+// a target skips the row on a clash in the key or any unique index.
+func prepareOnConflict(onConflict *parser.OnConflict, statement *Statement, schema *record.Schema) PrepareResult {
+	if onConflict.Target != nil {
+		var target []int
+		for _, name := range onConflict.Target {
+			target = append(target, schema.ColumnIndex(name))
+		}
+		primaryKey := slices.Clone(schema.PrimaryKey)
+		slices.Sort(target)
+		slices.Sort(primaryKey)
+		if !slices.Equal(target, primaryKey) {
+			return syntaxError(statement, onConflict.TargetPos, "ON CONFLICT can only name the primary key %s", primaryKeyName(schema))
+		}
+	}
+
+	if onConflict.DoNothing && onConflict.Target == nil {
+		statement.OnConflict = CONFLICT_IGNORE
+		return PREPARE_SUCCESS
+	}
+	if onConflict.DoNothing {
+		statement.OnConflict = CONFLICT_NOTHING
+		return PREPARE_SUCCESS
+	}
+
+	statement.OnConflict = CONFLICT_UPDATE
+	statement.RowToUpdate.Key = statement.RowToInsert.Key
+	return prepareAssignments(onConflict.Assignments, statement, schema, statement.RowToInsert.Values)
+}
+
+// primaryKeyName names the primary key of a table in messages: the name of
+// its column, or the names of its columns in parentheses
+func primaryKeyName(schema *record.Schema) string {
+	var names []string
+	for _, column := range schema.PrimaryKey {
+		names = append(names, schema.Columns[column].Name)
+	}
+
+	if len(names) == 1 {
+		return names[0]
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// prepareKeyValue converts the value given for a column of the primary
+// key. The first column of a table without a PRIMARY KEY takes the integer
+// keys of prepareKey, which are not negative. Declared key columns take
+// literals of their type, which may not be NULL.
+func prepareKeyValue(statement *Statement, schema *record.Schema, columnIndex int, expr parser.Expr) (record.Value, PrepareResult) {
+	if schema.HasDefaultKey() {
+		return prepareKey(statement, expr)
+	}
+
+	column := schema.Columns[columnIndex]
+	value, result := literalValue(statement, column, expr)
+	if result != PREPARE_SUCCESS {
+		return nil, result
+	}
+
+	if value == nil {
+		return nil, syntaxError(statement, expr.Position(), "the primary key %s cannot be NULL", column.Name)
+	}
+
+	return value, PREPARE_SUCCESS
+}
+
+// prepareRowKey builds the key of a row from its values. Keys are kept
+// whole in table leaves, so long TEXT and BLOB key values are refused.
+func prepareRowKey(schema *record.Schema, values []record.Value) ([]byte, PrepareResult) {
+	key, err := schema.Key(values)
+	if err != nil || len(key) > btree.TABLE_MAX_KEY_SIZE {
+		return nil, PREPARE_STRING_TOO_LONG
+	}
+
+	return key, PREPARE_SUCCESS
+}
+
+// prepareKey checks that an expression is a literal primary key
+func prepareKey(statement *Statement, expr parser.Expr) (record.Value, PrepareResult) {
+	literal, ok := expr.(*parser.Literal)
+	if !ok || (literal.Kind != parser.LITERAL_INTEGER && literal.Kind != parser.LITERAL_WORD) {
+		return nil, syntaxError(statement, expr.Position(), "the key must be an integer")
+	}
+
+	id, result := parseKey(literal.Text)
+	if result == PREPARE_SYNTAX_ERROR {
+		return nil, syntaxError(statement, literal.Pos, "%s is not a valid key", literal.Raw)
+	}
+	if result != PREPARE_SUCCESS {
+		return nil, result
+	}
+
+	return id, PREPARE_SUCCESS
+}
+
+// parseKey parses a primary key literal
+func parseKey(literal string) (int64, PrepareResult) {
+	id, err := strconv.ParseInt(literal, 10, 64)
+	if err != nil {
+		return 0, PREPARE_SYNTAX_ERROR
+	}
+
+	if id < 0 {
+		return 0, PREPARE_NEGATIVE_ID
+	}
+
+	return id, PREPARE_SUCCESS
+}
+
+// literalValue converts a literal to a value of the column's type. Quoted
+// strings and blobs must match the type of the column, and integers are
+// accepted for real columns. The unquoted words of shorthand statements are
+// read as the column's type by parseValue.
+func literalValue(statement *Statement, column record.Column, expr parser.Expr) (record.Value, PrepareResult) {
+	literal, ok := expr.(*parser.Literal)
+	if !ok {
+		return nil, syntaxError(statement, expr.Position(), "expected a value for column %s", column.Name)
+	}
+
+	var value record.Value
+	var err error
+	switch literal.Kind {
+	case parser.LITERAL_NULL:
+		return nil, PREPARE_SUCCESS
+	case parser.LITERAL_WORD:
+		value, result := parseValue(column, literal.Text)
+		if result == PREPARE_SYNTAX_ERROR {
+			return nil, syntaxError(statement, literal.Pos, "cannot store %s in %v column %s", literal.Raw, column.Type, column.Name)
+		}
+		return value, result
+	case parser.LITERAL_INTEGER:
+		if column.Type == record.COLUMN_REAL {
+			value, err = strconv.ParseFloat(literal.Text, 64)
+		} else {
+			value, err = strconv.ParseInt(literal.Text, 10, 64)
+		}
+	case parser.LITERAL_REAL:
+		value, err = strconv.ParseFloat(literal.Text, 64)
+	case parser.LITERAL_STRING:
+		value = literal.Text
+	case parser.LITERAL_BLOB:
+		value, err = hex.DecodeString(literal.Text)
+	}
+
+	if err != nil {
+		return nil, syntaxError(statement, literal.Pos, "%s is out of range", literal.Raw)
+	}
+
+	length := 0
+	switch value := value.(type) {
+	case int64:
+		ok = column.Type == record.COLUMN_INTEGER
+	case float64:
+		ok = column.Type == record.COLUMN_REAL
+	case string:
+		ok = column.Type == record.COLUMN_TEXT
+		length = len(value)
+	case []byte:
+		ok = column.Type == record.COLUMN_BLOB
+		length = len(value)
+	}
+
+	if !ok {
+		return nil, syntaxError(statement, literal.Pos, "cannot store %s in %v column %s", literal.Raw, column.Type, column.Name)
+	}
+
+	if column.MaxLength > 0 && length > column.MaxLength {
+		return nil, PREPARE_STRING_TOO_LONG
+	}
+
+	return value, PREPARE_SUCCESS
+}
+
+// parseValue converts a word to a value of the column's type. BLOB
+// words are written in hex as x'cafe', and null is NULL for any column.
+func parseValue(column record.Column, literal string) (record.Value, PrepareResult) {
+	if literal == "null" {
+		return nil, PREPARE_SUCCESS
+	}
+
+	switch column.Type {
+	case record.COLUMN_INTEGER:
+		value, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+		return value, PREPARE_SUCCESS
+	case record.COLUMN_REAL:
+		value, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+		return value, PREPARE_SUCCESS
+	case record.COLUMN_TEXT:
+		if column.MaxLength > 0 && len(literal) > column.MaxLength {
+			return nil, PREPARE_STRING_TOO_LONG
+		}
+		return literal, PREPARE_SUCCESS
+	case record.COLUMN_BLOB:
+		digits, found := strings.CutPrefix(literal, "x'")
+		digits, closed := strings.CutSuffix(digits, "'")
+		if !found || !closed {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+
+		value, err := hex.DecodeString(digits)
+		if err != nil {
+			return nil, PREPARE_SYNTAX_ERROR
+		}
+
+		if column.MaxLength > 0 && len(value) > column.MaxLength {
+			return nil, PREPARE_STRING_TOO_LONG
+		}
+		return value, PREPARE_SUCCESS
+	default:
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+}
+
+// prepareSelect checks the columns a select returns and its clauses. The
+// other clauses can use the aliases of the result columns, as SQLite
+// allows, where they are not also columns of the table. A select with
+// aggregate functions, GROUP BY or HAVING prints a row for each group of
+// rows instead of each row.
+func prepareSelect(selection *parser.SelectStatement, statement *Statement, table *Table) PrepareResult {
+	statement.Type = STATEMENT_SELECT
+	schema := table.Schema
+
+	var columns []parser.Expr
+	aliases := map[string]parser.Expr{}
+	for _, column := range selection.Columns {
+		// * stands for every column of the table
+		if column.Expr == nil {
+			for _, tableColumn := range schema.Columns {
+				columns = append(columns, &parser.ColumnRef{Pos: column.Pos, Name: tableColumn.Name})
+			}
+			continue
+		}
+
+		columns = append(columns, column.Expr)
+		if column.Alias != "" {
+			aliases[column.Alias] = column.Expr
+		}
+	}
+
+	for _, column := range columns {
+		expr, _, result := checkSelectExpr(statement, column, schema)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		statement.Projection = append(statement.Projection, expr)
+	}
+
+	result := prepareWhere(replaceAliases(selection.Where, aliases, schema), statement, table)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	result = prepareGroupBy(selection, columns, aliases, statement, schema)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	result = prepareOrderBy(selection.OrderBy, aliases, statement, schema)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	statement.Grouped = statement.GroupBy != nil || statement.Having != nil || statement.Aggregates != nil
+
+	// Rows are printed as they are for "select *"
+	if len(selection.Columns) == 1 && selection.Columns[0].Expr == nil && !statement.Grouped {
+		statement.Projection = nil
+	}
+
+	// Rows come out of the table in key order, so ordering by a primary
+	// key of one column first needs no sort, only a scan in the right
+	// direction
+	if len(statement.OrderBy) > 0 && !statement.Grouped && len(schema.PrimaryKey) == 1 {
+		column, ok := statement.OrderBy[0].Expr.(*parser.ColumnRef)
+		if ok && column.Name == schema.Columns[schema.PrimaryKey[0]].Name {
+			statement.Descending = statement.OrderBy[0].Descending
+			statement.OrderBy = nil
+		}
+	}
+
+	return prepareLimit(selection, statement)
+}
+
+// checkSelectExpr checks an expression in the select list, HAVING or
+// ORDER BY of a select, where aggregate functions can be used, and returns
+// it with its aggregates taken out into statement.Aggregates
+func checkSelectExpr(statement *Statement, expr parser.Expr, schema *record.Schema) (parser.Expr, exprType, PrepareResult) {
+	expr, result := extractAggregates(statement, expr, schema)
+	if result != PREPARE_SUCCESS {
+		return expr, TYPE_NULL, result
+	}
+
+	exprType, result := checkExpr(statement, expr, schema)
+	return expr, exprType, result
+}
+
+// resultColumn returns the result column that a GROUP BY or ORDER BY term
+// that is a number n refers to, the nth one, or nil for any other term
+func resultColumn(statement *Statement, clause string, term parser.Expr, results []parser.Expr) (parser.Expr, PrepareResult) {
+	n, ok := integerLiteral(term)
+	if !ok {
+		return nil, PREPARE_SUCCESS
+	}
+
+	if n < 1 || n > int64(len(results)) {
+		return nil, syntaxError(statement, term.Position(), "%s term %d is not between 1 and %d", clause, n, len(results))
+	}
+	return results[n-1], PREPARE_SUCCESS
+}
+
+// prepareGroupBy checks the GROUP BY terms and HAVING clause of a select.
+// Rows are grouped by the values of their terms, which cannot use
+// aggregate functions, as the groups are what those work on.
+func prepareGroupBy(selection *parser.SelectStatement, columns []parser.Expr, aliases map[string]parser.Expr, statement *Statement, schema *record.Schema) PrepareResult {
+	for _, term := range selection.GroupBy {
+		expr, result := resultColumn(statement, "GROUP BY", term, columns)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		if expr == nil {
+			expr = replaceAliases(term, aliases, schema)
+		}
+
+		_, result = checkExpr(statement, expr, schema)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		statement.GroupBy = append(statement.GroupBy, expr)
+	}
+
+	if selection.Having == nil {
+		return PREPARE_SUCCESS
+	}
+
+	having, havingType, result := checkSelectExpr(statement, replaceAliases(selection.Having, aliases, schema), schema)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	if !havingType.isNumeric() {
+		return syntaxError(statement, having.Position(), "HAVING needs a condition, not a %v value", havingType)
+	}
+	statement.Having = having
+
+	return PREPARE_SUCCESS
+}
+
+// prepareOrderBy checks the ORDER BY terms of a select. A term that is a
+// number n sorts by the nth result column.
+func prepareOrderBy(terms []parser.OrderingTerm, aliases map[string]parser.Expr, statement *Statement, schema *record.Schema) PrepareResult {
+	for _, term := range terms {
+		expr, result := resultColumn(statement, "ORDER BY", term.Expr, statement.Projection)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+
+		if expr == nil {
+			expr, _, result = checkSelectExpr(statement, replaceAliases(term.Expr, aliases, schema), schema)
+			if result != PREPARE_SUCCESS {
+				return result
+			}
+		}
+
+		statement.OrderBy = append(statement.OrderBy, OrderTerm{Expr: expr, Descending: term.Descending})
+	}
+
+	return PREPARE_SUCCESS
+}
+
+// prepareLimit checks the LIMIT and OFFSET of a select, which have to be
+// whole numbers that are not negative
+func prepareLimit(selection *parser.SelectStatement, statement *Statement) PrepareResult {
+	statement.Limit = -1
+	if selection.Limit == nil {
+		return PREPARE_SUCCESS
+	}
+
+	limit, ok := integerLiteral(selection.Limit)
+	if !ok || limit < 0 {
+		return syntaxError(statement, selection.Limit.Position(), "LIMIT needs a whole number of at least 0")
+	}
+	statement.Limit = limit
+
+	if selection.Offset == nil {
+		return PREPARE_SUCCESS
+	}
+
+	offset, ok := integerLiteral(selection.Offset)
+	if !ok || offset < 0 {
+		return syntaxError(statement, selection.Offset.Position(), "OFFSET needs a whole number of at least 0")
+	}
+	statement.Offset = offset
+
+	return PREPARE_SUCCESS
+}
+
+// prepareWhere checks the where clause of a select or delete and works out
+// the range of keys it can match. When the clause does not narrow the keys,
+// an index on a column it does narrow is used instead.
+func prepareWhere(where parser.Expr, statement *Statement, table *Table) PrepareResult {
+	schema := table.Schema
+	statement.Where = where
+	statement.KeysToScan = KeyRange{}
+	if where == nil {
+		return PREPARE_SUCCESS
+	}
+
+	whereType, result := checkExpr(statement, where, schema)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	if !whereType.isNumeric() {
+		return syntaxError(statement, where.Position(), "WHERE needs a condition, not a %v value", whereType)
+	}
+
+	statement.KeysToScan = whereKeyRange(where, schema)
+	if statement.KeysToScan.isFull() {
+		statement.IndexToScan = whereIndexRange(where, table)
+	}
+	return PREPARE_SUCCESS
+}
+
+// prepareUpdate collects the new column values of an update and the key of
+// the row it changes, given either in front of SET or as "where id = N".
+// A key of several columns is given as an equality for each, joined by
+// AND, and cannot go in front of SET.
+func prepareUpdate(update *parser.UpdateStatement, statement *Statement, schema *record.Schema) PrepareResult {
+	statement.Type = STATEMENT_UPDATE
+
+	var conditions []string
+	for _, column := range schema.PrimaryKey {
+		conditions = append(conditions, schema.Columns[column].Name+" = <key>")
+	}
+	needsKey := "UPDATE needs WHERE " + strings.Join(conditions, " AND ")
+
+	keyValues := make([]parser.Expr, len(schema.Columns))
+	switch {
+	case update.Key != nil && len(schema.PrimaryKey) == 1:
+		keyValues[schema.PrimaryKey[0]] = update.Key
+	case update.Key != nil || update.Where == nil:
+		return syntaxError(statement, update.Pos, "%s", needsKey)
+	default:
+		wrong := updateKeyValues(update.Where, schema, keyValues)
+		if wrong != nil {
+			return syntaxError(statement, wrong.Position(), "%s", needsKey)
+		}
+	}
+
+	values := make([]record.Value, len(schema.Columns))
+	for _, column := range schema.PrimaryKey {
+		if keyValues[column] == nil {
+			return syntaxError(statement, update.Pos, "%s", needsKey)
+		}
+
+		var result PrepareResult
+		values[column], result = prepareKeyValue(statement, schema, column, keyValues[column])
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+
+	key, result := prepareRowKey(schema, values)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+
+	statement.RowToUpdate.Key = key
+	return prepareAssignments(update.Assignments, statement, schema, nil)
+}
+
+// updateKeyValues collects the values the WHERE clause of an update gives
+// the primary key columns in keyValues. The clause may only compare key
+// columns to values with =, joined by AND, and name each column once. It
+// returns the first part of the clause that does not, or nil.
+func updateKeyValues(where parser.Expr, schema *record.Schema, keyValues []parser.Expr) parser.Expr {
+	comparison, ok := where.(*parser.BinaryExpr)
+	if ok && comparison.Op == "AND" {
+		wrong := updateKeyValues(comparison.Left, schema, keyValues)
+		if wrong != nil {
+			return wrong
+		}
+		return updateKeyValues(comparison.Right, schema, keyValues)
+	}
+	if !ok || comparison.Op != "=" {
+		return where
+	}
+
+	column, ok := comparison.Left.(*parser.ColumnRef)
+	if !ok || (column.Table != "" && column.Table != schema.TableName) {
+		return where
+	}
+
+	columnIndex := schema.ColumnIndex(column.Name)
+	if !schema.IsPrimaryKey(columnIndex) || keyValues[columnIndex] != nil {
+		return where
+	}
+
+	keyValues[columnIndex] = comparison.Right
+	return nil
+}
+
+// prepareAssignments fills in the values and columns an UPDATE, or the DO
+// UPDATE of an insert, sets, leaving RowToUpdate.Key alone. Each value is a
+// literal, or for a DO UPDATE it may be excluded.<column>, the value the
+// insert gave that column, which is taken from excluded.
+func prepareAssignments(assignments []parser.Assignment, statement *Statement, schema *record.Schema, excluded []record.Value) PrepareResult {
+	statement.RowToUpdate.Values = make([]record.Value, len(schema.Columns))
+
+	for _, assignment := range assignments {
+		// The primary key cannot be changed in place
+		columnIndex := schema.ColumnIndex(assignment.Column)
+		if schema.IsPrimaryKey(columnIndex) {
+			return syntaxError(statement, assignment.Pos, "the primary key %s cannot be changed", assignment.Column)
+		}
+		if columnIndex == -1 {
+			return syntaxError(statement, assignment.Pos, "table %s has no column %s", schema.TableName, assignment.Column)
+		}
+
+		var value record.Value
+		ref, ok := assignment.Value.(*parser.ColumnRef)
+		if ok && excluded != nil && ref.Table == "excluded" {
+			excludedIndex := schema.ColumnIndex(ref.Name)
+			if excludedIndex == -1 {
+				return syntaxError(statement, ref.Pos, "table %s has no column %s", schema.TableName, ref.Name)
+			}
+			column := schema.Columns[columnIndex]
+			if schema.Columns[excludedIndex].Type != column.Type {
+				return syntaxError(statement, ref.Pos, "column %s cannot be set to %s, which has a different type", assignment.Column, ref.Name)
+			}
+
+			value = excluded[excludedIndex]
+			switch v := value.(type) {
+			case string:
+				ok = column.MaxLength == 0 || len(v) <= column.MaxLength
+			case []byte:
+				ok = column.MaxLength == 0 || len(v) <= column.MaxLength
+			}
+			if !ok {
+				return PREPARE_STRING_TOO_LONG
+			}
+		} else {
+			var result PrepareResult
+			value, result = literalValue(statement, schema.Columns[columnIndex], assignment.Value)
+			if result != PREPARE_SUCCESS {
+				return result
+			}
+		}
+
+		statement.RowToUpdate.Values[columnIndex] = value
+		statement.ColumnsToSet = append(statement.ColumnsToSet, columnIndex)
+	}
+
+	return PREPARE_SUCCESS
+}
+
+// prepareCreateTable turns the column definitions of a create table into a
+// schema. Column types are integer, text, real and blob; text and blob take
+// an optional maximum length in bytes, as in text(32). The primary key is
+// a column marked PRIMARY KEY or the columns of a PRIMARY KEY after the
+// columns; without one it is the first column, which must be an integer.
+func prepareCreateTable(create *parser.CreateTableStatement, statement *Statement) PrepareResult {
+	statement.Type = STATEMENT_CREATE_TABLE
+
+	schema := &record.Schema{TableName: create.Name}
+	for i, definition := range create.Columns {
+		if schema.ColumnIndex(definition.Name) != -1 {
+			return syntaxError(statement, definition.Pos, "column %s is defined twice", definition.Name)
+		}
+
+		column := record.Column{Name: definition.Name, MaxLength: definition.MaxLength, Unique: definition.Unique}
+		switch strings.ToLower(definition.TypeName) {
+		case "integer":
+			column.Type = record.COLUMN_INTEGER
+		case "text":
+			column.Type = record.COLUMN_TEXT
+		case "real":
+			column.Type = record.COLUMN_REAL
+		case "blob":
+			column.Type = record.COLUMN_BLOB
+		default:
+			return syntaxError(statement, definition.TypePos, "unknown column type %s", definition.TypeName)
+		}
+
+		if column.MaxLength > 0 && column.Type != record.COLUMN_TEXT && column.Type != record.COLUMN_BLOB {
+			return syntaxError(statement, definition.TypePos, "only text and blob columns take a length")
+		}
+
+		schema.Columns = append(schema.Columns, column)
+
+		if definition.PrimaryKey {
+			if schema.PrimaryKey != nil {
+				return syntaxError(statement, definition.Pos, "table %s has more than one primary key", create.Name)
+			}
+			schema.PrimaryKey = []int{i}
+		}
+	}
+
+	if create.PrimaryKey != nil {
+		if schema.PrimaryKey != nil {
+			return syntaxError(statement, create.PrimaryKeyPos, "table %s has more than one primary key", create.Name)
+		}
+
+		for _, name := range create.PrimaryKey {
+			columnIndex := schema.ColumnIndex(name)
+			if columnIndex == -1 {
+				return syntaxError(statement, create.PrimaryKeyPos, "table %s has no column %s", create.Name, name)
+			}
+			if schema.IsPrimaryKey(columnIndex) {
+				return syntaxError(statement, create.PrimaryKeyPos, "column %s is named twice", name)
+			}
+			schema.PrimaryKey = append(schema.PrimaryKey, columnIndex)
+		}
+	}
+
+	schema.DeclaredKey = schema.PrimaryKey != nil
+	if schema.PrimaryKey == nil {
+		if schema.Columns[0].Type != record.COLUMN_INTEGER {
+			return PREPARE_BAD_PRIMARY_KEY
+		}
+		schema.PrimaryKey = []int{0}
+	}
+
+	statement.SchemaToCreate = schema
+	return PREPARE_SUCCESS
+}
+
+// parseCreateTable parses the statement a table was created with, as kept
+// in the catalog, into its schema
+func parseCreateTable(sql string) (*record.Schema, PrepareResult) {
+	parsed, err := parser.Parse(sql)
+	create, ok := parsed.(*parser.CreateTableStatement)
+	if err != nil || !ok {
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+
+	var statement Statement
+	result := prepareCreateTable(create, &statement)
+	return statement.SchemaToCreate, result
+}
+
+// prepareCreateIndex checks that the table and column of a create index
+// exist
+func prepareCreateIndex(create *parser.CreateIndexStatement, statement *Statement, db *Database) PrepareResult {
+	statement.Type = STATEMENT_CREATE_INDEX
+	statement.TableName = create.Table
+
+	table, ok := db.Tables[create.Table]
+	if !ok {
+		return PREPARE_NO_SUCH_TABLE
+	}
+
+	column := table.Schema.ColumnIndex(create.Column)
+	if column == -1 {
+		return syntaxError(statement, create.ColumnPos, "table %s has no column %s", create.Table, create.Column)
+	}
+
+	statement.IndexToCreate = &Index{Name: create.Name, Column: column, Unique: create.Unique}
+	return PREPARE_SUCCESS
+}
+
+// parseCreateIndex parses the statement an index was created with, as kept
+// in the catalog, against the tables loaded so far
+func parseCreateIndex(sql string, db *Database) (*Statement, PrepareResult) {
+	parsed, err := parser.Parse(sql)
+	create, ok := parsed.(*parser.CreateIndexStatement)
+	if err != nil || !ok {
+		return nil, PREPARE_SYNTAX_ERROR
+	}
+
+	var statement Statement
+	result := prepareCreateIndex(create, &statement, db)
+	return &statement, result
+}
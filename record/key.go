@@ -0,0 +1,122 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Key Encoding
+//
+// AppendKey encodes a value so that comparing encoded values byte by byte
+// orders them the same way as the values themselves. A tag byte comes
+// first, so NULL sorts before every other value. Integers and reals follow
+// as 8 big-endian bytes, with the bits rearranged so that negative numbers
+// sort before positive ones. TEXT and BLOB bytes follow with each 0x00
+// written as 0x00 0xFF and a terminating 0x00 0x00, so that a value sorts
+// before every longer value it is a prefix of and no encoding is a prefix
+// of another.
+const (
+	KEY_NULL    = 0x01
+	KEY_INTEGER = 0x02
+	KEY_REAL    = 0x03
+	KEY_TEXT    = 0x04
+	KEY_BLOB    = 0x05
+)
+
+// AppendKey appends the order-preserving encoding of value to dst
+func AppendKey(dst []byte, value Value) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(dst, KEY_NULL), nil
+	case int64:
+		dst = append(dst, KEY_INTEGER)
+		return binary.BigEndian.AppendUint64(dst, uint64(v)^1<<63), nil
+	case float64:
+		if v == 0 {
+			v = 0 // -0 and 0 are equal, so they must encode the same
+		}
+
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		dst = append(dst, KEY_REAL)
+		return binary.BigEndian.AppendUint64(dst, bits), nil
+	case string:
+		return appendKeyBytes(append(dst, KEY_TEXT), []byte(v)), nil
+	case []byte:
+		return appendKeyBytes(append(dst, KEY_BLOB), v), nil
+	default:
+		return nil, fmt.Errorf("Cannot encode a value of type %T as a key", value)
+	}
+}
+
+func appendKeyBytes(dst []byte, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, c)
+		if c == 0 {
+			dst = append(dst, 0xFF)
+		}
+	}
+	return append(dst, 0, 0)
+}
+
+// DecodeKey decodes the value at the start of an encoded key and returns it
+// with the number of bytes its encoding takes, so that the values of a key
+// made of several can be decoded in turn
+func DecodeKey(key []byte) (Value, int, error) {
+	if len(key) == 0 {
+		return nil, 0, fmt.Errorf("Key ends before its value")
+	}
+
+	switch key[0] {
+	case KEY_NULL:
+		return nil, 1, nil
+	case KEY_INTEGER, KEY_REAL:
+		if len(key) < 9 {
+			return nil, 0, fmt.Errorf("Key ends inside a number")
+		}
+
+		bits := binary.BigEndian.Uint64(key[1:])
+		if key[0] == KEY_INTEGER {
+			return int64(bits ^ 1<<63), 9, nil
+		}
+
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), 9, nil
+	case KEY_TEXT, KEY_BLOB:
+		var b []byte
+		for i := 1; i+1 < len(key); i++ {
+			if key[i] != 0 {
+				b = append(b, key[i])
+				continue
+			}
+
+			switch key[i+1] {
+			case 0:
+				if key[0] == KEY_TEXT {
+					return string(b), i + 2, nil
+				}
+				if b == nil {
+					b = []byte{}
+				}
+				return b, i + 2, nil
+			case 0xFF:
+				b = append(b, 0)
+				i++
+			default:
+				return nil, 0, fmt.Errorf("Key has a stray 0x00 byte")
+			}
+		}
+		return nil, 0, fmt.Errorf("Key ends inside a string")
+	default:
+		return nil, 0, fmt.Errorf("Key has unknown tag 0x%02x", key[0])
+	}
+}
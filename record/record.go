@@ -0,0 +1,239 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// ColumnType is the declared type of a column
+type ColumnType uint8
+
+const (
+	COLUMN_INTEGER ColumnType = iota
+	COLUMN_TEXT
+	COLUMN_REAL
+	COLUMN_BLOB
+)
+
+func (t ColumnType) String() string {
+	switch t {
+	case COLUMN_INTEGER:
+		return "integer"
+	case COLUMN_TEXT:
+		return "text"
+	case COLUMN_REAL:
+		return "real"
+	case COLUMN_BLOB:
+		return "blob"
+	default:
+		return fmt.Sprintf("type %d", uint8(t))
+	}
+}
+
+// Column describes one column of a table
+type Column struct {
+	Name      string
+	Type      ColumnType
+	MaxLength int  // Longest TEXT or BLOB value in bytes, 0 for no limit
+	Unique    bool // Whether no two rows may hold the same value, other than NULL
+}
+
+// Schema describes the columns of a table. PrimaryKey lists the columns
+// whose values make up the key of each row, in the order they are encoded
+// in it. Unless a table says otherwise its first column is its key, and
+// must be an INTEGER.
+type Schema struct {
+	TableName   string
+	Columns     []Column
+	PrimaryKey  []int // Positions of the key columns in Columns
+	DeclaredKey bool  // Whether the table names its key rather than taking the default
+}
+
+// ColumnIndex returns the position of the named column, or -1
+func (s *Schema) ColumnIndex(name string) int {
+	for i, column := range s.Columns {
+		if column.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// IsPrimaryKey reports whether a column is part of the primary key
+func (s *Schema) IsPrimaryKey(column int) bool {
+	return slices.Contains(s.PrimaryKey, column)
+}
+
+// HasDefaultKey reports whether the table is keyed by its first column, an
+// INTEGER, because it has no PRIMARY KEY
+func (s *Schema) HasDefaultKey() bool {
+	return !s.DeclaredKey
+}
+
+// Key returns the key of a row with the given values: the values of the
+// key columns encoded with AppendKey, one after another. Comparing keys
+// byte by byte orders rows by their first key column, then their second
+// and so on.
+func (s *Schema) Key(values []Value) ([]byte, error) {
+	var key []byte
+	for _, column := range s.PrimaryKey {
+		var err error
+		key, err = AppendKey(key, values[column])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// SQL renders the schema as the create table statement that defines it. A
+// declared key of one column is marked on the column, and a key of several
+// columns is listed after them.
+func (s *Schema) SQL() string {
+	sql := "create table " + s.TableName + " ("
+	for i, column := range s.Columns {
+		if i > 0 {
+			sql += ", "
+		}
+
+		sql += column.Name + " " + column.Type.String()
+		if column.MaxLength > 0 {
+			sql += fmt.Sprintf("(%d)", column.MaxLength)
+		}
+		if len(s.PrimaryKey) == 1 && s.PrimaryKey[0] == i && !s.HasDefaultKey() {
+			sql += " primary key"
+		}
+		if column.Unique {
+			sql += " unique"
+		}
+	}
+
+	if len(s.PrimaryKey) > 1 {
+		names := make([]string, len(s.PrimaryKey))
+		for i, column := range s.PrimaryKey {
+			names[i] = s.Columns[column].Name
+		}
+		sql += ", primary key (" + strings.Join(names, ", ") + ")"
+	}
+
+	return sql + ")"
+}
+
+// Value is a single column value: nil for NULL, or an int64, float64, string
+// or []byte for INTEGER, REAL, TEXT and BLOB columns respectively
+type Value any
+
+// Record Layout
+//
+// A record holds every column except those of the primary key, whose values
+// are in the key of the cell the record is stored in. Each value is a
+// uvarint serial type followed by its payload.
+const (
+	SERIAL_NULL    = 0 // No payload
+	SERIAL_INTEGER = 1 // Zig-zag varint payload
+	SERIAL_REAL    = 2 // 8 byte IEEE 754 payload
+	SERIAL_BYTES   = 3 // TEXT or BLOB of length serial-SERIAL_BYTES
+)
+
+// Encode serializes the values of a row, one per column of the schema
+func Encode(schema *Schema, values []Value) ([]byte, error) {
+	if len(values) != len(schema.Columns) {
+		return nil, fmt.Errorf("Row has %d values but table %s has %d columns", len(values), schema.TableName, len(schema.Columns))
+	}
+
+	var record []byte
+	for i, value := range values {
+		if schema.IsPrimaryKey(i) {
+			continue
+		}
+		column := schema.Columns[i]
+
+		switch v := value.(type) {
+		case nil:
+			record = binary.AppendUvarint(record, SERIAL_NULL)
+		case int64:
+			record = binary.AppendUvarint(record, SERIAL_INTEGER)
+			record = binary.AppendVarint(record, v)
+		case float64:
+			record = binary.AppendUvarint(record, SERIAL_REAL)
+			record = binary.LittleEndian.AppendUint64(record, math.Float64bits(v))
+		case string:
+			record = binary.AppendUvarint(record, SERIAL_BYTES+uint64(len(v)))
+			record = append(record, v...)
+		case []byte:
+			record = binary.AppendUvarint(record, SERIAL_BYTES+uint64(len(v)))
+			record = append(record, v...)
+		default:
+			return nil, fmt.Errorf("Column %s cannot hold a value of type %T", column.Name, value)
+		}
+	}
+
+	return record, nil
+}
+
+// Decode rebuilds the values of a row from its key and its record. Bytes
+// after the last value are ignored.
+func Decode(schema *Schema, key []byte, record []byte) ([]Value, error) {
+	values := make([]Value, len(schema.Columns))
+
+	rest := key
+	for _, column := range schema.PrimaryKey {
+		value, n, err := DecodeKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Key %x does not hold the primary key of table %s: %v", key, schema.TableName, err)
+		}
+		values[column] = value
+		rest = rest[n:]
+	}
+
+	offset := 0
+	for i := range schema.Columns {
+		if schema.IsPrimaryKey(i) {
+			continue
+		}
+
+		serial, n := binary.Uvarint(record[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("Record for key %x is truncated", key)
+		}
+		offset += n
+
+		switch {
+		case serial == SERIAL_NULL:
+			values[i] = nil
+		case serial == SERIAL_INTEGER:
+			v, n := binary.Varint(record[offset:])
+			if n <= 0 {
+				return nil, fmt.Errorf("Record for key %x is truncated", key)
+			}
+			offset += n
+			values[i] = v
+		case serial == SERIAL_REAL:
+			if offset+8 > len(record) {
+				return nil, fmt.Errorf("Record for key %x is truncated", key)
+			}
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(record[offset:]))
+			offset += 8
+		default:
+			length := serial - SERIAL_BYTES
+			if length > uint64(len(record)-offset) {
+				return nil, fmt.Errorf("Record for key %x is truncated", key)
+			}
+			payload := record[offset : offset+int(length)]
+			offset += int(length)
+
+			if schema.Columns[i].Type == COLUMN_TEXT {
+				values[i] = string(payload)
+			} else {
+				values[i] = append([]byte(nil), payload...)
+			}
+		}
+	}
+
+	return values, nil
+}
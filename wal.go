@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math/rand"
+	"os"
+	"toydb/wal"
+)
+
+// WriteAheadLog appends page images to a log file next to the database.
+// Changes reach the database file only when the log is checkpointed, so a
+// crash at any point leaves the database file as it was at the last
+// checkpoint plus whatever the log holds for committed transactions.
+type WriteAheadLog struct {
+	FileDescriptor *os.File
+	Salt           uint32            // Identifies frames written since the log was last reset
+	NumFrames      uint32            // Frames in the log, committed or not
+	CommitFrames   uint32            // Frames up to and including the last commit record
+	Committed      map[uint32]uint32 // Latest committed frame of each page
+	Pending        map[uint32]uint32 // Latest frame of each page in the open transaction
+}
+
+// walOpen opens the log file, creating it if it does not exist. Frames
+// already in the log are not read until walRecover is called. A log opened
+// read-only is never created or reset; if there is none, FileDescriptor is
+// nil and the log is empty.
+func walOpen(filename string, readOnly bool) (*WriteAheadLog, error) {
+	w := &WriteAheadLog{
+		Committed: make(map[uint32]uint32),
+		Pending:   make(map[uint32]uint32),
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(filename, flag, 0666)
+	if readOnly && errors.Is(err, fs.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open write-ahead log: %v", err)
+	}
+	w.FileDescriptor = file
+
+	walHeader := make([]byte, wal.HEADER_SIZE)
+	_, err = file.ReadAt(walHeader, 0)
+	if err == io.EOF && readOnly {
+		return w, nil
+	}
+	if err == io.EOF {
+		// New log, or the crash happened while a reset was writing the
+		// header. Either way there is nothing to recover.
+		err = w.reset()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error reading write-ahead log: %v", err)
+	}
+
+	err = wal.ValidateHeader(walHeader)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.Salt = wal.Salt(walHeader)
+
+	return w, nil
+}
+
+// walRecover scans the log for committed transactions and indexes their
+// frames. Frames after the last commit, including a frame torn by a crash,
+// are discarded. It returns the page count of the database as of the last
+// commit, or 0 if the log holds no committed transaction.
+func (w *WriteAheadLog) walRecover() (uint32, error) {
+	if w.FileDescriptor == nil {
+		return 0, nil
+	}
+
+	var pageCount uint32
+	transaction := make(map[uint32]uint32)
+	frame := make([]byte, wal.FRAME_SIZE)
+
+	for frameNum := uint32(0); ; frameNum++ {
+		_, err := w.FileDescriptor.ReadAt(frame, wal.FrameOffset(frameNum))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Error reading write-ahead log: %v", err)
+		}
+
+		if !wal.IsValidFrame(frame, w.Salt) {
+			break
+		}
+
+		transaction[wal.FramePageNum(frame)] = frameNum
+		if wal.FrameCommit(frame) != 0 {
+			for pageNum, committedFrame := range transaction {
+				w.Committed[pageNum] = committedFrame
+			}
+			clear(transaction)
+
+			pageCount = wal.FrameCommit(frame)
+			w.NumFrames = frameNum + 1
+			w.CommitFrames = w.NumFrames
+		}
+	}
+
+	return pageCount, nil
+}
+
+// frameFor returns the frame holding the newest image of a page, if the log
+// has one
+func (w *WriteAheadLog) frameFor(pageNum uint32) (uint32, bool) {
+	frameNum, ok := w.Pending[pageNum]
+	if !ok {
+		frameNum, ok = w.Committed[pageNum]
+	}
+
+	return frameNum, ok
+}
+
+// readPage copies the image of a page held by a frame into page
+func (w *WriteAheadLog) readPage(pageNum uint32, frameNum uint32, page []byte) error {
+	frame := make([]byte, wal.FRAME_SIZE)
+	_, err := w.FileDescriptor.ReadAt(frame, wal.FrameOffset(frameNum))
+	if err != nil {
+		return fmt.Errorf("Error reading frame %d of write-ahead log: %v", frameNum, err)
+	}
+
+	if !wal.IsValidFrame(frame, w.Salt) || wal.FramePageNum(frame) != pageNum {
+		return &CorruptPageError{PageNum: pageNum, Reason: fmt.Sprintf("frame %d of the write-ahead log does not match its checksum", frameNum)}
+	}
+
+	copy(page, wal.FramePage(frame))
+	return nil
+}
+
+// appendFrame adds a page image to the open transaction. A non-zero commit
+// is the page count of the database and marks the frame as the last one of
+// the transaction.
+func (w *WriteAheadLog) appendFrame(pageNum uint32, page []byte, commit uint32) error {
+	frame := make([]byte, wal.FRAME_SIZE)
+	wal.InitializeFrame(frame, pageNum, commit, w.Salt, page)
+
+	_, err := w.FileDescriptor.WriteAt(frame, wal.FrameOffset(w.NumFrames))
+	if err != nil {
+		return fmt.Errorf("Error writing write-ahead log: %v", err)
+	}
+
+	w.Pending[pageNum] = w.NumFrames
+	w.NumFrames++
+
+	return nil
+}
+
+// commitPending makes the frames of the open transaction visible to readers
+// once the commit frame is on stable storage
+func (w *WriteAheadLog) commitPending() {
+	for pageNum, frameNum := range w.Pending {
+		w.Committed[pageNum] = frameNum
+	}
+	clear(w.Pending)
+	w.CommitFrames = w.NumFrames
+}
+
+// rollbackPending discards the frames of the open transaction
+func (w *WriteAheadLog) rollbackPending() error {
+	return w.rollbackTo(w.CommitFrames, nil)
+}
+
+// rollbackTo discards the frames of the open transaction from numFrames on.
+// pending is what Pending held when the log had numFrames frames.
+func (w *WriteAheadLog) rollbackTo(numFrames uint32, pending map[uint32]uint32) error {
+	clear(w.Pending)
+	maps.Copy(w.Pending, pending)
+	w.NumFrames = numFrames
+
+	err := w.FileDescriptor.Truncate(wal.FrameOffset(w.NumFrames))
+	if err != nil {
+		return fmt.Errorf("Error truncating write-ahead log: %v", err)
+	}
+
+	return nil
+}
+
+// reset empties the log. A new salt is chosen so that frames left over from
+// before the reset can never be mistaken for new ones.
+func (w *WriteAheadLog) reset() error {
+	err := w.FileDescriptor.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("Error truncating write-ahead log: %v", err)
+	}
+
+	salt := rand.Uint32()
+	walHeader := make([]byte, wal.HEADER_SIZE)
+	wal.InitializeHeader(walHeader, salt)
+
+	_, err = w.FileDescriptor.WriteAt(walHeader, 0)
+	if err != nil {
+		return fmt.Errorf("Error writing write-ahead log: %v", err)
+	}
+
+	err = w.FileDescriptor.Sync()
+	if err != nil {
+		return fmt.Errorf("Error syncing write-ahead log: %v", err)
+	}
+
+	w.Salt = salt
+	w.NumFrames = 0
+	w.CommitFrames = 0
+	clear(w.Committed)
+	clear(w.Pending)
+
+	return nil
+}
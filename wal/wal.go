@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"toydb/constants"
+)
+
+// The write-ahead log is a header followed by frames. Each frame holds one
+// page image; the last frame of a transaction carries the page count of the
+// database after it committed, marking everything up to it as committed.
+const (
+	MAGIC          = "toydbwal"
+	FORMAT_VERSION = 1
+
+	AUTOCHECKPOINT_FRAMES = 1000 // Checkpoint once the log holds about 4 MB
+)
+
+// WAL Header Layout
+const (
+	MAGIC_SIZE       = 8
+	MAGIC_OFFSET     = 0
+	VERSION_SIZE     = 4
+	VERSION_OFFSET   = MAGIC_OFFSET + MAGIC_SIZE
+	PAGE_SIZE_SIZE   = 4
+	PAGE_SIZE_OFFSET = VERSION_OFFSET + VERSION_SIZE
+	SALT_SIZE        = 4
+	SALT_OFFSET      = PAGE_SIZE_OFFSET + PAGE_SIZE_SIZE
+	HEADER_SIZE      = SALT_OFFSET + SALT_SIZE
+)
+
+// Frame Layout
+const (
+	FRAME_PAGE_NUM_SIZE   = 4
+	FRAME_PAGE_NUM_OFFSET = 0
+	FRAME_COMMIT_SIZE     = 4 // Database page count on commit frames, 0 otherwise
+	FRAME_COMMIT_OFFSET   = FRAME_PAGE_NUM_OFFSET + FRAME_PAGE_NUM_SIZE
+	FRAME_SALT_SIZE       = 4
+	FRAME_SALT_OFFSET     = FRAME_COMMIT_OFFSET + FRAME_COMMIT_SIZE
+	FRAME_CHECKSUM_SIZE   = 4
+	FRAME_CHECKSUM_OFFSET = FRAME_SALT_OFFSET + FRAME_SALT_SIZE
+	FRAME_HEADER_SIZE     = FRAME_CHECKSUM_OFFSET + FRAME_CHECKSUM_SIZE
+	FRAME_SIZE            = FRAME_HEADER_SIZE + constants.PAGE_SIZE
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// FrameOffset returns the position of a frame in the log file
+func FrameOffset(frameNum uint32) int64 {
+	return HEADER_SIZE + int64(frameNum)*FRAME_SIZE
+}
+
+func Salt(walHeader []byte) uint32 {
+	return binary.LittleEndian.Uint32(walHeader[SALT_OFFSET:])
+}
+
+func InitializeHeader(walHeader []byte, salt uint32) {
+	copy(walHeader[MAGIC_OFFSET:], MAGIC)
+	binary.LittleEndian.PutUint32(walHeader[VERSION_OFFSET:], FORMAT_VERSION)
+	binary.LittleEndian.PutUint32(walHeader[PAGE_SIZE_OFFSET:], constants.PAGE_SIZE)
+	binary.LittleEndian.PutUint32(walHeader[SALT_OFFSET:], salt)
+}
+
+// ValidateHeader checks that a log header was written by this build
+func ValidateHeader(walHeader []byte) error {
+	if !bytes.Equal(walHeader[MAGIC_OFFSET:MAGIC_OFFSET+MAGIC_SIZE], []byte(MAGIC)) {
+		return fmt.Errorf("File is not a toydb write-ahead log")
+	}
+
+	version := binary.LittleEndian.Uint32(walHeader[VERSION_OFFSET:])
+	if version != FORMAT_VERSION {
+		return fmt.Errorf("Unsupported write-ahead log version %d, expected %d", version, FORMAT_VERSION)
+	}
+
+	pageSize := binary.LittleEndian.Uint32(walHeader[PAGE_SIZE_OFFSET:])
+	if pageSize != constants.PAGE_SIZE {
+		return fmt.Errorf("Unsupported write-ahead log page size %d, expected %d", pageSize, constants.PAGE_SIZE)
+	}
+
+	return nil
+}
+
+func FramePageNum(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[FRAME_PAGE_NUM_OFFSET:])
+}
+
+func FrameCommit(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[FRAME_COMMIT_OFFSET:])
+}
+
+func FrameSalt(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[FRAME_SALT_OFFSET:])
+}
+
+// FramePage returns the page image held by a frame
+func FramePage(frame []byte) []byte {
+	return frame[FRAME_HEADER_SIZE:FRAME_SIZE]
+}
+
+// frameChecksum covers the frame header, except the checksum itself, and
+// the page image
+func frameChecksum(frame []byte) uint32 {
+	checksum := crc32.Checksum(frame[:FRAME_CHECKSUM_OFFSET], castagnoli)
+	return crc32.Update(checksum, castagnoli, FramePage(frame))
+}
+
+// InitializeFrame fills in a frame for a page image and seals it with a
+// checksum
+func InitializeFrame(frame []byte, pageNum uint32, commit uint32, salt uint32, page []byte) {
+	binary.LittleEndian.PutUint32(frame[FRAME_PAGE_NUM_OFFSET:], pageNum)
+	binary.LittleEndian.PutUint32(frame[FRAME_COMMIT_OFFSET:], commit)
+	binary.LittleEndian.PutUint32(frame[FRAME_SALT_OFFSET:], salt)
+	copy(FramePage(frame), page)
+	binary.LittleEndian.PutUint32(frame[FRAME_CHECKSUM_OFFSET:], frameChecksum(frame))
+}
+
+// IsValidFrame reports whether a frame was completely written during the
+// current generation of the log, the one identified by salt
+func IsValidFrame(frame []byte, salt uint32) bool {
+	if FrameSalt(frame) != salt {
+		return false
+	}
+
+	return binary.LittleEndian.Uint32(frame[FRAME_CHECKSUM_OFFSET:]) == frameChecksum(frame)
+}